@@ -1,19 +1,25 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/gorilla/mux"
+	"github.com/periskop-dev/periskop/events"
 	"github.com/periskop-dev/periskop/metrics"
 	"github.com/periskop-dev/periskop/repository"
 )
 
 func NewServicesListHandler(r *repository.ErrorsRepository) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		err := servicesList(w, r)
+		err := servicesList(w, req, r)
 		if err != nil {
 			metrics.ErrorCollector.ReportWithHTTPRequest(err, req)
 		}
@@ -22,20 +28,31 @@ func NewServicesListHandler(r *repository.ErrorsRepository) http.Handler {
 
 func NewTargetsHandler(r *repository.ErrorsRepository) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		err := targets(w, r)
+		err := targets(w, req, r)
 		if err != nil {
 			metrics.ErrorCollector.ReportWithHTTPRequest(err, req)
 		}
 	})
 }
 
+// defaultOccurrencesPerError is the number of occurrences listed per error when occurrences isn't set
+const defaultOccurrencesPerError = 100
+
+// NewErrorsListHandler lists the errors of a service. Query parameters severity and search (in the aggregation key,
+// class and message) filter the errors, sort orders them by count, last_seen (default) or created_at, limit and
+// cursor paginate them and occurrences is the number of occurrences listed per error.
+// The next page is linked in the Link header.
 func NewErrorsListHandler(r *repository.ErrorsRepository) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		vars := mux.Vars(req)
-		numberOfOccurrencesPerError := 100
 
 		if service, found := vars["service_name"]; found {
-			err := errorsForService(w, r, service, numberOfOccurrencesPerError)
+			query, err := parseErrorsQuery(req.URL.Query())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			err = errorsForService(w, req, r, service, query)
 			if err != nil {
 				metrics.ErrorCollector.ReportWithHTTPRequest(err, req)
 			}
@@ -45,16 +62,131 @@ func NewErrorsListHandler(r *repository.ErrorsRepository) http.Handler {
 	})
 }
 
-func NewErrorResolveHandler(r *repository.ErrorsRepository) http.Handler {
+func parseErrorsQuery(values url.Values) (repository.ErrorsQuery, error) {
+	query := repository.ErrorsQuery{
+		Severity:       values.Get("severity"),
+		Search:         values.Get("search"),
+		Sort:           values.Get("sort"),
+		Cursor:         values.Get("cursor"),
+		NumberOfErrors: defaultOccurrencesPerError,
+	}
+	var err error
+	if value := values.Get("limit"); value != "" {
+		if query.Limit, err = strconv.Atoi(value); err != nil {
+			return query, fmt.Errorf("invalid limit parameter: %s", err)
+		}
+	}
+	if value := values.Get("occurrences"); value != "" {
+		if query.NumberOfErrors, err = strconv.Atoi(value); err != nil {
+			return query, fmt.Errorf("invalid occurrences parameter: %s", err)
+		}
+	}
+	return query, query.Validate()
+}
+
+// defaultOccurrencesPageSize is the number of occurrences per page when limit isn't set
+const defaultOccurrencesPageSize = 20
+
+// NewErrorHandler returns an error whatever its status. Query parameter occurrences is the number of occurrences
+// listed, 100 by default.
+func NewErrorHandler(r *repository.ErrorsRepository) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+
+		numberOfOccurrences := defaultOccurrencesPerError
+		if value := req.URL.Query().Get("occurrences"); value != "" {
+			var err error
+			if numberOfOccurrences, err = strconv.Atoi(value); err != nil || numberOfOccurrences < 0 {
+				http.Error(w, fmt.Sprintf("invalid occurrences parameter: %s", value), http.StatusBadRequest)
+				return
+			}
+		}
+		errorAggregate, err := (*r).GetError(req.Context(), vars["service_name"], vars["error_key"],
+			numberOfOccurrences)
+		if err != nil {
+			renderRepositoryError(w, err)
+			return
+		}
+		err = renderJSON(w, errorAggregate)
+		if err != nil {
+			metrics.ErrorCollector.ReportWithHTTPRequest(err, req)
+		}
+	})
+}
+
+// NewErrorOccurrencesHandler pages through the stored occurrences of an error, newest first. Query parameters limit
+// (20 by default) and cursor paginate them, the next page is linked in the Link header.
+func NewErrorOccurrencesHandler(r *repository.ErrorsRepository) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+
+		query, err := parseOccurrencesQuery(req.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		page, err := (*r).GetOccurrences(req.Context(), vars["service_name"], vars["error_key"], query)
+		if err != nil {
+			renderRepositoryError(w, err)
+			return
+		}
+		setNextPageLink(w, req, page.NextCursor)
+		err = renderJSON(w, page.Occurrences)
+		if err != nil {
+			metrics.ErrorCollector.ReportWithHTTPRequest(err, req)
+		}
+	})
+}
+
+func parseOccurrencesQuery(values url.Values) (repository.OccurrencesQuery, error) {
+	query := repository.OccurrencesQuery{
+		Limit:  defaultOccurrencesPageSize,
+		Cursor: values.Get("cursor"),
+	}
+	if value := values.Get("limit"); value != "" {
+		var err error
+		if query.Limit, err = strconv.Atoi(value); err != nil {
+			return query, fmt.Errorf("invalid limit parameter: %s", err)
+		}
+	}
+	return query, query.Validate()
+}
+
+// setNextPageLink links the next page of a paginated response in the Link header, if there is one
+func setNextPageLink(w http.ResponseWriter, req *http.Request, cursor string) {
+	if cursor == "" {
+		return
+	}
+	next := *req.URL
+	values := next.Query()
+	values.Set("cursor", cursor)
+	next.RawQuery = values.Encode()
+	w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", next.RequestURI()))
+}
+
+// NewErrorResolveHandler resolves an error and publishes the resolution.
+// The body can optionally include a note: {"note": "..."}
+func NewErrorResolveHandler(r *repository.ErrorsRepository, broker *events.Broker) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		vars := mux.Vars(req)
 
 		if service, found := vars["service_name"]; found {
 			errKey := vars["error_key"]
-			err := (*r).ResolveError(service, errKey)
+			change := repository.StatusChange{}
+			if req.Body != nil {
+				if err := json.NewDecoder(req.Body).Decode(&change); err != nil && err != io.EOF {
+					http.Error(w, fmt.Sprintf("invalid resolution: %s", err), http.StatusBadRequest)
+					return
+				}
+			}
+			change.Status = repository.StatusResolved
+			change.Actor = requestActor(req)
+			err := (*r).SetErrorStatus(req.Context(), service, errKey, change)
 			if err != nil {
-				http.NotFound(w, req)
+				renderRepositoryError(w, err)
+				return
 			}
+			broker.Publish(events.NewStatusEvent(service, errKey, change))
 			w.WriteHeader(http.StatusNoContent)
 		} else {
 			http.NotFound(w, req)
@@ -62,7 +194,139 @@ func NewErrorResolveHandler(r *repository.ErrorsRepository) http.Handler {
 	})
 }
 
-// CORSLocalhostMiddleware allows CORS requests for local development since API and frontend run on different ports
+// NewErrorResolutionsHandler lists who resolved an error and when
+func NewErrorResolutionsHandler(r *repository.ErrorsRepository) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		status, err := (*r).GetErrorStatus(req.Context(), vars["service_name"], vars["error_key"])
+		if err != nil {
+			renderRepositoryError(w, err)
+			return
+		}
+		err = renderJSON(w, status.Resolutions())
+		if err != nil {
+			metrics.ErrorCollector.ReportWithHTTPRequest(err, req)
+		}
+	})
+}
+
+func NewErrorStatusHandler(r *repository.ErrorsRepository) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		status, err := (*r).GetErrorStatus(req.Context(), vars["service_name"], vars["error_key"])
+		if err != nil {
+			renderRepositoryError(w, err)
+			return
+		}
+		err = renderJSON(w, status)
+		if err != nil {
+			metrics.ErrorCollector.ReportWithHTTPRequest(err, req)
+		}
+	})
+}
+
+// NewErrorStatusUpdateHandler changes the status of an error and publishes the change
+func NewErrorStatusUpdateHandler(r *repository.ErrorsRepository, broker *events.Broker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+
+		var change repository.StatusChange
+		if err := json.NewDecoder(req.Body).Decode(&change); err != nil {
+			http.Error(w, fmt.Sprintf("invalid status change: %s", err), http.StatusBadRequest)
+			return
+		}
+		if err := change.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		change.Actor = requestActor(req)
+		if err := (*r).SetErrorStatus(req.Context(), vars["service_name"], vars["error_key"], change); err != nil {
+			renderRepositoryError(w, err)
+			return
+		}
+		broker.Publish(events.NewStatusEvent(vars["service_name"], vars["error_key"], change))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// Pusher ingests the errors pushed by short-lived instances of a service
+type Pusher interface {
+	Push(instance string, header http.Header, body io.Reader) error
+}
+
+// ErrPushQueueFull is returned by pushers when a pushed payload can't be queued because the service is busy
+var ErrPushQueueFull = errors.New("too many pushes waiting to be processed")
+
+// ErrPushUnauthorized is returned by pushers when a push doesn't send the token of the service
+var ErrPushUnauthorized = errors.New("invalid or missing push token")
+
+// ErrTooManyPushedInstances is returned by pushers when a new instance pushes while the service already has
+// the maximum number of pushing instances
+var ErrTooManyPushedInstances = errors.New("too many instances pushing")
+
+// NewPushHandler ingests the errors pushed by an instance of a service. Pushes are rejected with 401 without the
+// token of the service, with 503 when the service is too busy to queue them and with 429 when the service has too
+// many pushing instances.
+func NewPushHandler(pushers map[string]Pusher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+
+		pusher, found := pushers[vars["service_name"]]
+		if !found {
+			http.NotFound(w, req)
+			return
+		}
+		err := pusher.Push(vars["instance"], req.Header, req.Body)
+		switch {
+		case errors.Is(err, ErrPushUnauthorized):
+			metrics.ServiceErrors.WithLabelValues("push_unauthorized").Inc()
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		case errors.Is(err, ErrPushQueueFull):
+			metrics.ServiceErrors.WithLabelValues("push_rejected").Inc()
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		case errors.Is(err, ErrTooManyPushedInstances):
+			metrics.ServiceErrors.WithLabelValues("push_rejected").Inc()
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		case err != nil:
+			metrics.ServiceErrors.WithLabelValues("push_errors").Inc()
+			metrics.ErrorCollector.ReportWithHTTPRequest(err, req)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
+
+// actorKey is the context key of the actor of a request
+type actorKey struct{}
+
+// TrustedActorMiddleware identifies who makes the requests from a header set by an authenticating proxy.
+// Requests are anonymous when no header is configured.
+func TrustedActorMiddleware(header string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if actor := req.Header.Get(header); header != "" && actor != "" {
+				req = req.WithContext(context.WithValue(req.Context(), actorKey{}, actor))
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// requestActor returns who made a request as identified by TrustedActorMiddleware, empty for anonymous requests
+func requestActor(req *http.Request) string {
+	actor, _ := req.Context().Value(actorKey{}).(string)
+	return actor
+}
+
+// CORSLocalhostMiddleware allows CORS requests for local development since API and frontend run on different ports.
+// Preflight requests from localhost are answered here, so they never reach the handlers of the routes. It must wrap
+// the router rather than being one of its middlewares, which only run for the methods of the matched routes.
 func CORSLocalhostMiddleware(r *mux.Router) mux.MiddlewareFunc {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
@@ -70,30 +334,68 @@ func CORSLocalhostMiddleware(r *mux.Router) mux.MiddlewareFunc {
 			if strings.HasPrefix(origin, "http://localhost:") {
 				w.Header().Set("Access-Control-Allow-Origin", origin)
 				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE")
+				w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+				if req.Method == http.MethodOptions {
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
 			}
 			next.ServeHTTP(w, req)
 		})
 	}
 }
 
-func errorsForService(w http.ResponseWriter, r *repository.ErrorsRepository,
-	service string, numberOfOccurrencesPerError int) error {
-	repoErrors, err := (*r).GetErrors(service, numberOfOccurrencesPerError)
+func errorsForService(w http.ResponseWriter, req *http.Request, r *repository.ErrorsRepository,
+	service string, query repository.ErrorsQuery) error {
+	page, err := (*r).QueryErrors(req.Context(), service, query)
 	if err == nil {
-		err = renderJSON(w, repoErrors)
+		setNextPageLink(w, req, page.NextCursor)
+		err = renderJSON(w, withoutStatusHistory(page.Errors))
 	} else {
 		metrics.ServiceErrors.WithLabelValues("get_errors").Inc()
-		http.Error(w, err.Error(), 404)
+		renderRepositoryError(w, err)
 	}
 	return err
 }
 
-func servicesList(w http.ResponseWriter, r *repository.ErrorsRepository) error {
-	return renderJSON(w, (*r).GetServices())
+// withoutStatusHistory returns the errors without the history of their statuses, which is only rendered for a
+// single error
+func withoutStatusHistory(errorAggregates []repository.ErrorAggregate) []repository.ErrorAggregate {
+	listed := make([]repository.ErrorAggregate, len(errorAggregates))
+	for i, errorAggregate := range errorAggregates {
+		errorAggregate.StatusHistory = nil
+		listed[i] = errorAggregate
+	}
+	return listed
 }
 
-func targets(w http.ResponseWriter, r *repository.ErrorsRepository) error {
-	return renderJSON(w, (*r).GetTargets())
+func servicesList(w http.ResponseWriter, req *http.Request, r *repository.ErrorsRepository) error {
+	services, err := (*r).GetServices(req.Context())
+	if err != nil {
+		renderRepositoryError(w, err)
+		return err
+	}
+	return renderJSON(w, services)
+}
+
+func targets(w http.ResponseWriter, req *http.Request, r *repository.ErrorsRepository) error {
+	targets, err := (*r).GetTargets(req.Context())
+	if err != nil {
+		renderRepositoryError(w, err)
+		return err
+	}
+	return renderJSON(w, targets)
+}
+
+// renderRepositoryError responds to a failed repository operation: 404 when the service or error doesn't exist
+// and 503 when the repository is unavailable, so clients can retry later
+func renderRepositoryError(w http.ResponseWriter, err error) {
+	if errors.Is(err, repository.ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	metrics.ServiceErrors.WithLabelValues("repository_unavailable").Inc()
+	http.Error(w, err.Error(), http.StatusServiceUnavailable)
 }
 
 func renderJSON(w http.ResponseWriter, value interface{}) error {
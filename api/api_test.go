@@ -1,9 +1,14 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -37,8 +42,9 @@ func TestServicesWithEmptyRepoReturnsEmptyArray(t *testing.T) {
 }
 
 func TestServicesWithNonEmptyRepoReturnsServiceNames(t *testing.T) {
+	ctx := context.Background()
 	r := repository.NewMemoryRepository()
-	r.ReplaceErrors("api-test", []repository.ErrorAggregate{})
+	r.ReplaceErrors(ctx, "api-test", []repository.ErrorAggregate{})
 
 	rr := httptest.NewRecorder()
 	serveMockServiceList(rr, r)
@@ -69,9 +75,44 @@ func TestErrorsForUnknownServiceReturnsNotFound(t *testing.T) {
 	}
 }
 
+// unavailableRepository fails like a repository whose database is down
+type unavailableRepository struct {
+	repository.ErrorsRepository
+}
+
+func (unavailableRepository) QueryErrors(ctx context.Context, serviceName string,
+	query repository.ErrorsQuery) (repository.ErrorsPage, error) {
+	return repository.ErrorsPage{}, fmt.Errorf("connection refused")
+}
+
+func (unavailableRepository) GetServices(ctx context.Context) ([]string, error) {
+	return nil, fmt.Errorf("connection refused")
+}
+
+func TestErrorsWithUnavailableRepoReturnsServiceUnavailable(t *testing.T) {
+	rr := httptest.NewRecorder()
+	serveMockErrorList(rr, unavailableRepository{}, "api-test")
+
+	if status := rr.Code; status != http.StatusServiceUnavailable {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusServiceUnavailable)
+	}
+}
+
+func TestServicesWithUnavailableRepoReturnsServiceUnavailable(t *testing.T) {
+	rr := httptest.NewRecorder()
+	serveMockServiceList(rr, unavailableRepository{})
+
+	if status := rr.Code; status != http.StatusServiceUnavailable {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusServiceUnavailable)
+	}
+}
+
 func TestErrorsForKnownServiceReturnsSuccess(t *testing.T) {
+	ctx := context.Background()
 	r := repository.NewMemoryRepository()
-	r.ReplaceErrors("api-test", []repository.ErrorAggregate{})
+	r.ReplaceErrors(ctx, "api-test", []repository.ErrorAggregate{})
 
 	rr := httptest.NewRecorder()
 	serveMockErrorList(rr, r, "api-test")
@@ -83,8 +124,9 @@ func TestErrorsForKnownServiceReturnsSuccess(t *testing.T) {
 }
 
 func TestErrorsForKnownServiceReturnsErrors(t *testing.T) {
+	ctx := context.Background()
 	r := repository.NewMemoryRepository()
-	r.ReplaceErrors("api-test", []repository.ErrorAggregate{
+	r.ReplaceErrors(ctx, "api-test", []repository.ErrorAggregate{
 		{
 			AggregationKey: "key",
 			Severity:       "error",
@@ -102,13 +144,162 @@ func TestErrorsForKnownServiceReturnsErrors(t *testing.T) {
 	serveMockErrorList(rr, r, "api-test")
 
 	// nolint
-	expected := `[{"aggregation_key":"key","total_count":0,"severity":"error","latest_errors":[{"error":{"class":"","message":"","stacktrace":null,"cause":null},"uuid":"","timestamp":0,"severity":"error","http_context":null}],"created_at":0}]` + "\n"
+	expected := `[{"aggregation_key":"key","total_count":0,"severity":"error","latest_errors":[{"error":{"class":"","message":"","stacktrace":null,"cause":null},"uuid":"","timestamp":0,"severity":"error","http_context":null}],"created_at":0,"first_seen":0,"last_seen":0,"status":"open"}]` + "\n"
 	if rr.Body.String() != expected {
 		t.Errorf("handler returned unexpected body: got %v want %v",
 			rr.Body.String(), expected)
 	}
 }
 
+func TestErrorsListIsFilteredSortedAndPaginated(t *testing.T) {
+	ctx := context.Background()
+	r := repository.NewMemoryRepository()
+	r.ReplaceErrors(ctx, "api-test", []repository.ErrorAggregate{ // nolint[errcheck]
+		{AggregationKey: "key-0", TotalCount: 1, Severity: "error"},
+		{AggregationKey: "key-1", TotalCount: 3, Severity: "error"},
+		{AggregationKey: "key-2", TotalCount: 2, Severity: "error"},
+		{AggregationKey: "key-3", TotalCount: 5, Severity: "warning"},
+	})
+	router := mux.NewRouter()
+	router.Handle("/services/{service_name}/errors/", NewErrorsListHandler(&r)).Methods(http.MethodGet)
+
+	keys := []string{}
+	next := "/services/api-test/errors/?severity=error&sort=count&limit=2"
+	for next != "" {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", next, nil)
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+		var errors []repository.ErrorAggregate
+		json.Unmarshal(rr.Body.Bytes(), &errors) // nolint[errcheck]
+		for _, errorAggregate := range errors {
+			keys = append(keys, errorAggregate.AggregationKey)
+		}
+		next = strings.TrimSuffix(strings.TrimPrefix(rr.Header().Get("Link"), "<"), `>; rel="next"`)
+	}
+	if !reflect.DeepEqual(keys, []string{"key-1", "key-2", "key-0"}) {
+		t.Errorf("Expected errors sorted by count, Found %v", keys)
+	}
+}
+
+func TestErrorsListOmitsStatusHistory(t *testing.T) {
+	ctx := context.Background()
+	r := repository.NewMemoryRepository()
+	r.ReplaceErrors(ctx, "api-test", []repository.ErrorAggregate{{AggregationKey: "key"}}) // nolint[errcheck]
+	reopen := repository.StatusChange{Status: repository.StatusOpen}
+	r.SetErrorStatus(ctx, "api-test", "key", reopen) // nolint[errcheck]
+	router := mux.NewRouter()
+	router.Handle("/services/{service_name}/errors/", NewErrorsListHandler(&r)).Methods(http.MethodGet)
+	router.Handle("/services/{service_name}/errors/{error_key}/", NewErrorHandler(&r)).Methods(http.MethodGet)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/services/api-test/errors/", nil)
+	router.ServeHTTP(rr, req)
+	if strings.Contains(rr.Body.String(), "status_history") {
+		t.Errorf("Expected the errors list without status history, Found %s", rr.Body.String())
+	}
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/services/api-test/errors/key/", nil)
+	router.ServeHTTP(rr, req)
+	if !strings.Contains(rr.Body.String(), "status_history") {
+		t.Errorf("Expected the error with its status history, Found %s", rr.Body.String())
+	}
+}
+
+func TestErrorsListWithInvalidQueryReturnsBadRequest(t *testing.T) {
+	ctx := context.Background()
+	r := repository.NewMemoryRepository()
+	r.ReplaceErrors(ctx, "api-test", []repository.ErrorAggregate{}) // nolint[errcheck]
+	router := mux.NewRouter()
+	router.Handle("/services/{service_name}/errors/", NewErrorsListHandler(&r)).Methods(http.MethodGet)
+
+	for _, query := range []string{"sort=name", "limit=ten", "limit=-1", "occurrences=all", "cursor=invalid"} {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/services/api-test/errors/?"+query, nil)
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code for %s: got %v want %v", query, rr.Code,
+				http.StatusBadRequest)
+		}
+	}
+}
+
+func TestErrorReturnsErrorWhateverItsStatus(t *testing.T) {
+	ctx := context.Background()
+	r := repository.NewMemoryRepository()
+	r.ReplaceErrors(ctx, "api-test", []repository.ErrorAggregate{{AggregationKey: "test/key", TotalCount: 2, // nolint[errcheck]
+		LatestErrors: []repository.ErrorWithContext{{UUID: "uuid1"}, {UUID: "uuid0"}}}})
+	r.ResolveError(ctx, "api-test", "test/key") // nolint[errcheck]
+	router := mux.NewRouter()
+	router.Handle("/services/{service_name}/errors/{error_key:.*}/", NewErrorHandler(&r)).Methods(http.MethodGet)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/services/api-test/errors/test/key/?occurrences=1", nil)
+	router.ServeHTTP(rr, req)
+	var errorAggregate repository.ErrorAggregate
+	json.Unmarshal(rr.Body.Bytes(), &errorAggregate) // nolint[errcheck]
+	if rr.Code != http.StatusOK || errorAggregate.Status != repository.StatusResolved ||
+		len(errorAggregate.LatestErrors) != 1 {
+		t.Errorf("Unexpected response %d %s", rr.Code, rr.Body.String())
+	}
+
+	for path, status := range map[string]int{
+		"/services/api-test/errors/unknown/":                   http.StatusNotFound,
+		"/services/api-test/errors/test/key/?occurrences=many": http.StatusBadRequest,
+	} {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		router.ServeHTTP(rr, req)
+		if rr.Code != status {
+			t.Errorf("handler returned wrong status code for %s: got %v want %v", path, rr.Code, status)
+		}
+	}
+}
+
+func TestErrorOccurrencesArePaginated(t *testing.T) {
+	ctx := context.Background()
+	r := repository.NewMemoryRepository()
+	r.ReplaceErrors(ctx, "api-test", []repository.ErrorAggregate{{AggregationKey: "test", TotalCount: 3, // nolint[errcheck]
+		LatestErrors: []repository.ErrorWithContext{
+			{UUID: "uuid2", Timestamp: 2}, {UUID: "uuid1", Timestamp: 1}, {UUID: "uuid0", Timestamp: 0},
+		}}})
+	router := mux.NewRouter()
+	router.Handle("/services/{service_name}/errors/{error_key:.*}/occurrences/",
+		NewErrorOccurrencesHandler(&r)).Methods(http.MethodGet)
+
+	uuids := []string{}
+	next := "/services/api-test/errors/test/occurrences/?limit=2"
+	for next != "" {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", next, nil)
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+		var occurrences []repository.ErrorWithContext
+		json.Unmarshal(rr.Body.Bytes(), &occurrences) // nolint[errcheck]
+		for _, occurrence := range occurrences {
+			uuids = append(uuids, occurrence.UUID)
+		}
+		next = strings.TrimSuffix(strings.TrimPrefix(rr.Header().Get("Link"), "<"), `>; rel="next"`)
+	}
+	if !reflect.DeepEqual(uuids, []string{"uuid2", "uuid1", "uuid0"}) {
+		t.Errorf("Expected the occurrences newest first, Found %v", uuids)
+	}
+
+	for _, query := range []string{"limit=-1", "limit=all", "cursor=invalid"} {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/services/api-test/errors/test/occurrences/?"+query, nil)
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code for %s: got %v want %v", query, rr.Code,
+				http.StatusBadRequest)
+		}
+	}
+}
+
 func serveMockErrorList(rr *httptest.ResponseRecorder, r repository.ErrorsRepository, serviceName string) {
 	handler := NewErrorsListHandler(&r)
 	router := mux.NewRouter()
@@ -128,9 +319,24 @@ func TestResolveErrorForUnknownServiceReturnsNotFound(t *testing.T) {
 	}
 }
 
+func TestResolveUnknownErrorReturnsNotFound(t *testing.T) {
+	ctx := context.Background()
+	r := repository.NewMemoryRepository()
+	r.ReplaceErrors(ctx, "api-test", []repository.ErrorAggregate{})
+
+	rr := httptest.NewRecorder()
+	serveMockErrorResolve(rr, r, "api-test", "test")
+
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusNotFound)
+	}
+}
+
 func TestResolveErrorsReturnsSuccess(t *testing.T) {
+	ctx := context.Background()
 	r := repository.NewMemoryRepository()
-	r.ReplaceErrors("api-test", []repository.ErrorAggregate{})
+	r.ReplaceErrors(ctx, "api-test", []repository.ErrorAggregate{{AggregationKey: "test"}})
 
 	rr := httptest.NewRecorder()
 	serveMockErrorResolve(rr, r, "api-test", "test")
@@ -141,15 +347,178 @@ func TestResolveErrorsReturnsSuccess(t *testing.T) {
 	}
 }
 
+func TestResolutionsReturnsAuditTrail(t *testing.T) {
+	ctx := context.Background()
+	r := repository.NewMemoryRepository()
+	r.ReplaceErrors(ctx, "api-test", []repository.ErrorAggregate{{AggregationKey: "test", TotalCount: 7}})
+
+	router := mux.NewRouter()
+	router.Handle("/services/{service_name}/errors/{error_key}/resolutions/",
+		NewErrorResolutionsHandler(&r)).Methods(http.MethodGet)
+	router.Handle("/services/{service_name}/errors/{error_key}/",
+		NewErrorResolveHandler(&r, nil)).Methods(http.MethodDelete)
+	router.Use(TrustedActorMiddleware("X-Forwarded-User"))
+
+	req, _ := http.NewRequest("DELETE", "/services/api-test/errors/test/", strings.NewReader(`{"note":"fixed"}`))
+	req.Header.Set("X-Forwarded-User", "alice")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	req, _ = http.NewRequest("DELETE", "/services/api-test/errors/test/", nil)
+	req.Header.Set("X-Forwarded-Email", "mallory@example.com")
+	req.SetBasicAuth("bob", "secret")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	rr := httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/services/api-test/errors/test/resolutions/", nil)
+	router.ServeHTTP(rr, req)
+
+	var resolutions []repository.StatusTransition
+	json.Unmarshal(rr.Body.Bytes(), &resolutions) // nolint[errcheck]
+	if len(resolutions) != 2 {
+		t.Fatalf("Expected 2 resolutions, Found %d", len(resolutions))
+	}
+	if resolutions[0].Actor != "alice" || resolutions[0].Note != "fixed" || resolutions[0].TotalCount != 7 {
+		t.Errorf("Unexpected resolution %+v", resolutions[0])
+	}
+	if resolutions[1].Actor != "" || resolutions[1].Note != "" {
+		t.Errorf("Expected an anonymous resolution, Found %+v", resolutions[1])
+	}
+}
+
+func TestUntrustedActorIsAnonymous(t *testing.T) {
+	ctx := context.Background()
+	r := repository.NewMemoryRepository()
+	r.ReplaceErrors(ctx, "api-test", []repository.ErrorAggregate{{AggregationKey: "test"}})
+
+	router := mux.NewRouter()
+	router.Handle("/services/{service_name}/errors/{error_key}/",
+		NewErrorResolveHandler(&r, nil)).Methods(http.MethodDelete)
+	router.Use(TrustedActorMiddleware(""))
+
+	req, _ := http.NewRequest("DELETE", "/services/api-test/errors/test/", nil)
+	req.Header.Set("X-Forwarded-User", "alice")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	status, _ := r.GetErrorStatus(ctx, "api-test", "test")
+	if resolutions := status.Resolutions(); len(resolutions) != 1 || resolutions[0].Actor != "" {
+		t.Errorf("Expected an anonymous resolution, Found %+v", resolutions)
+	}
+}
+
+func TestPreflightDoesNotResolveError(t *testing.T) {
+	ctx := context.Background()
+	r := repository.NewMemoryRepository()
+	r.ReplaceErrors(ctx, "api-test", []repository.ErrorAggregate{{AggregationKey: "test"}})
+
+	router := mux.NewRouter()
+	router.Handle("/services/{service_name}/errors/{error_key}/",
+		NewErrorResolveHandler(&r, nil)).Methods(http.MethodDelete)
+	handler := CORSLocalhostMiddleware(router)(router)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("OPTIONS", "/services/api-test/errors/test/", nil)
+	req.Header.Set("Origin", "http://localhost:3000")
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusNoContent {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNoContent)
+	}
+	if origin := rr.Header().Get("Access-Control-Allow-Origin"); origin != "http://localhost:3000" {
+		t.Errorf("Expected the origin to be allowed, Found %q", origin)
+	}
+	if status, _ := r.GetErrorStatus(ctx, "api-test", "test"); status.Status != repository.StatusOpen {
+		t.Errorf("Expected the error to be still open, Found %s", status.Status)
+	}
+
+	rr = httptest.NewRecorder()
+	req.Header.Set("Origin", "http://example.com")
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusMethodNotAllowed {
+		t.Errorf("Expected preflight requests of other origins to reach the router, Found status %v", status)
+	}
+	if status, _ := r.GetErrorStatus(ctx, "api-test", "test"); status.Status != repository.StatusOpen {
+		t.Errorf("Expected the error to be still open, Found %s", status.Status)
+	}
+}
+
+func TestResolveErrorWithInvalidBodyReturnsBadRequest(t *testing.T) {
+	ctx := context.Background()
+	r := repository.NewMemoryRepository()
+	r.ReplaceErrors(ctx, "api-test", []repository.ErrorAggregate{})
+
+	rr := httptest.NewRecorder()
+	router := mux.NewRouter()
+	router.Handle("/services/{service_name}/errors/{error_key}/",
+		NewErrorResolveHandler(&r, nil)).Methods(http.MethodDelete)
+	req, _ := http.NewRequest("DELETE", "/services/api-test/errors/test/", strings.NewReader(`{"note":`))
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusBadRequest)
+	}
+}
+
 func serveMockErrorResolve(rr *httptest.ResponseRecorder, r repository.ErrorsRepository,
 	serviceName string, errKey string) {
-	handler := NewErrorResolveHandler(&r)
+	handler := NewErrorResolveHandler(&r, nil)
 	router := mux.NewRouter()
 	router.Handle("/services/{service_name}/errors/{error_key}/", handler).Methods(http.MethodDelete)
 	req, _ := http.NewRequest("DELETE", fmt.Sprintf("/services/%s/errors/%s/", serviceName, errKey), nil)
 	router.ServeHTTP(rr, req)
 }
 
+func TestUpdateErrorStatusWithInvalidStatusReturnsBadRequest(t *testing.T) {
+	ctx := context.Background()
+	r := repository.NewMemoryRepository()
+	r.ReplaceErrors(ctx, "api-test", []repository.ErrorAggregate{{AggregationKey: "test"}})
+
+	for _, body := range []string{`{"status":"regressed"}`, `{"status":"snoozed"}`, `{`} {
+		rr := httptest.NewRecorder()
+		serveMockErrorStatusUpdate(rr, r, "api-test", "test", body)
+
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code for %s: got %v want %v",
+				body, status, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestUpdateErrorStatusReturnsSuccess(t *testing.T) {
+	ctx := context.Background()
+	r := repository.NewMemoryRepository()
+	r.ReplaceErrors(ctx, "api-test", []repository.ErrorAggregate{{AggregationKey: "test", TotalCount: 2}})
+
+	rr := httptest.NewRecorder()
+	serveMockErrorStatusUpdate(rr, r, "api-test", "test", `{"status":"snoozed","snooze_count":3}`)
+	if status := rr.Code; status != http.StatusNoContent {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusNoContent)
+	}
+
+	rr = httptest.NewRecorder()
+	handler := NewErrorStatusHandler(&r)
+	router := mux.NewRouter()
+	router.Handle("/services/{service_name}/errors/{error_key}/status/", handler).Methods(http.MethodGet)
+	req, _ := http.NewRequest("GET", "/services/api-test/errors/test/status/", nil)
+	router.ServeHTTP(rr, req)
+
+	expected := `{"status":"snoozed","snoozed_until_count":5,"status_history":[{"from":"open","to":"snoozed",`
+	if !strings.HasPrefix(rr.Body.String(), expected) {
+		t.Errorf("handler returned unexpected body: got %v want prefix %v",
+			rr.Body.String(), expected)
+	}
+}
+
+func serveMockErrorStatusUpdate(rr *httptest.ResponseRecorder, r repository.ErrorsRepository,
+	serviceName string, errKey string, body string) {
+	handler := NewErrorStatusUpdateHandler(&r, nil)
+	router := mux.NewRouter()
+	router.Handle("/services/{service_name}/errors/{error_key}/status/", handler).Methods(http.MethodPut)
+	req, _ := http.NewRequest("PUT", fmt.Sprintf("/services/%s/errors/%s/status/", serviceName, errKey),
+		strings.NewReader(body))
+	router.ServeHTTP(rr, req)
+}
+
 func TestTargetsWithEmptyRepoReturnsSuccess(t *testing.T) {
 	r := repository.NewMemoryRepository()
 
@@ -163,11 +532,12 @@ func TestTargetsWithEmptyRepoReturnsSuccess(t *testing.T) {
 }
 
 func TestTargetsReturnsListOfTargets(t *testing.T) {
+	ctx := context.Background()
 	r := repository.NewMemoryRepository()
 	targets := []repository.Target{
 		{Endpoint: "localhost:3000/-/exceptions"},
 	}
-	r.StoreTargets("api-test", targets)
+	r.StoreTargets(ctx, "api-test", targets)
 
 	rr := httptest.NewRecorder()
 	serveMockTargets(rr, r)
@@ -186,3 +556,77 @@ func serveMockTargets(rr *httptest.ResponseRecorder, r repository.ErrorsReposito
 	req, _ := http.NewRequest("GET", "/targets/", nil)
 	router.ServeHTTP(rr, req)
 }
+
+type mockPusher struct {
+	instances []string
+	err       error
+}
+
+func (p *mockPusher) Push(instance string, header http.Header, body io.Reader) error {
+	if p.err != nil {
+		return p.err
+	}
+	if header.Get("Content-Type") != "application/json" {
+		return fmt.Errorf("unsupported content type")
+	}
+	p.instances = append(p.instances, instance)
+	return nil
+}
+
+func TestPushForUnknownServiceReturnsNotFound(t *testing.T) {
+	rr := httptest.NewRecorder()
+	serveMockPush(rr, map[string]Pusher{}, "api-test", "application/json")
+
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusNotFound)
+	}
+}
+
+func TestPushReturnsAccepted(t *testing.T) {
+	pusher := &mockPusher{}
+	rr := httptest.NewRecorder()
+	serveMockPush(rr, map[string]Pusher{"api-test": pusher}, "api-test", "application/json")
+
+	if status := rr.Code; status != http.StatusAccepted {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusAccepted)
+	}
+	if len(pusher.instances) != 1 || pusher.instances[0] != "job-1" {
+		t.Errorf("Expected push from job-1 instance, Found %v", pusher.instances)
+	}
+}
+
+func TestPushWithInvalidPayloadReturnsBadRequest(t *testing.T) {
+	rr := httptest.NewRecorder()
+	serveMockPush(rr, map[string]Pusher{"api-test": &mockPusher{}}, "api-test", "text/plain")
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusBadRequest)
+	}
+}
+
+func TestRejectedPushReturnsUnavailable(t *testing.T) {
+	expectedStatuses := map[error]int{
+		ErrPushUnauthorized:       http.StatusUnauthorized,
+		ErrPushQueueFull:          http.StatusServiceUnavailable,
+		ErrTooManyPushedInstances: http.StatusTooManyRequests,
+	}
+	for err, expected := range expectedStatuses {
+		rr := httptest.NewRecorder()
+		serveMockPush(rr, map[string]Pusher{"api-test": &mockPusher{err: err}}, "api-test", "application/json")
+		if status := rr.Code; status != expected {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, expected)
+		}
+	}
+}
+
+func serveMockPush(rr *httptest.ResponseRecorder, pushers map[string]Pusher, serviceName string, contentType string) {
+	handler := NewPushHandler(pushers)
+	router := mux.NewRouter()
+	router.Handle("/push/{service_name}/{instance}", handler).Methods(http.MethodPost)
+	req, _ := http.NewRequest("POST", fmt.Sprintf("/push/%s/job-1", serviceName), strings.NewReader("{}"))
+	req.Header.Set("Content-Type", contentType)
+	router.ServeHTTP(rr, req)
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/periskop-dev/periskop/events"
+)
+
+// keepAliveInterval is how often a comment is sent on idle event streams, so proxies don't close them
+const keepAliveInterval = 15 * time.Second
+
+// NewEventsHandler streams the changes of the errors of a service, or of every service without service_name,
+// as Server-Sent Events. Query parameter types is a comma separated list of the event types streamed,
+// all of them by default.
+func NewEventsHandler(broker *events.Broker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		types, err := parseEventTypes(req.URL.Query().Get("types"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		subscription := broker.Subscribe(mux.Vars(req)["service_name"])
+		defer subscription.Close()
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		// disable the buffering of nginx proxies
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(keepAliveInterval)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case <-req.Context().Done():
+				return
+			case <-keepAlive.C:
+				if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+			case event, open := <-subscription.Events():
+				if !open {
+					return
+				}
+				if len(types) > 0 && !types[event.Type] {
+					continue
+				}
+				if err := writeEvent(w, event); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	})
+}
+
+// parseEventTypes parses a comma separated list of event types, an empty list means every type
+func parseEventTypes(value string) (map[string]bool, error) {
+	types := make(map[string]bool)
+	if value == "" {
+		return types, nil
+	}
+	for _, eventType := range strings.Split(value, ",") {
+		switch eventType {
+		case events.EventNewError, events.EventCountChanged, events.EventRegressed, events.EventResolved,
+			events.EventStatusChanged:
+			types[eventType] = true
+		default:
+			return nil, fmt.Errorf("invalid event type %s", eventType)
+		}
+	}
+	return types, nil
+}
+
+// writeEvent writes an event in the Server-Sent Events format, with its type as event name
+func writeEvent(w http.ResponseWriter, event events.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
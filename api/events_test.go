@@ -0,0 +1,76 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/periskop-dev/periskop/events"
+	"github.com/periskop-dev/periskop/repository"
+)
+
+func TestEventsHandlerStreamsServiceEvents(t *testing.T) {
+	ctx := context.Background()
+	r := repository.NewMemoryRepository()
+	errors := []repository.ErrorAggregate{{AggregationKey: "key", TotalCount: 1}}
+	r.ReplaceErrors(ctx, "api-test", errors) // nolint[errcheck]
+	broker := events.NewBroker()
+	router := mux.NewRouter()
+	router.Handle("/services/{service_name}/events/", NewEventsHandler(broker)).Methods(http.MethodGet)
+	router.Handle("/services/{service_name}/errors/{error_key:.*}/",
+		NewErrorResolveHandler(&r, broker)).Methods(http.MethodDelete)
+	router.Use(TrustedActorMiddleware("X-Forwarded-User"))
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/services/api-test/events/?types=resolved")
+	if err != nil {
+		t.Fatalf("Fail to open the event stream: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Unexpected content type %s", resp.Header.Get("Content-Type"))
+	}
+
+	broker.Publish(events.Event{Type: events.EventNewError, Service: "api-test", AggregationKey: "key"},
+		events.Event{Type: events.EventResolved, Service: "other-service", AggregationKey: "key"})
+	req, _ := http.NewRequest(http.MethodDelete, server.URL+"/services/api-test/errors/key/", nil)
+	req.Header.Set("X-Forwarded-User", "alice")
+	resolved, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Fail to resolve error: %s", err)
+	}
+	resolved.Body.Close()
+
+	reader := bufio.NewReader(resp.Body)
+	lines := make([]string, 0, 3)
+	for len(lines) < 3 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Fail to read the event stream: %s", err)
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+	if lines[0] != "id: 3" || lines[1] != "event: resolved" {
+		t.Errorf("Unexpected event %v", lines)
+	}
+	var event events.Event
+	json.Unmarshal([]byte(strings.TrimPrefix(lines[2], "data: ")), &event) // nolint[errcheck]
+	if event.Service != "api-test" || event.AggregationKey != "key" || event.Actor != "alice" {
+		t.Errorf("Unexpected event data %+v", event)
+	}
+}
+
+func TestEventsHandlerWithInvalidTypesReturnsBadRequest(t *testing.T) {
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/events/?types=new_error,unknown", nil)
+	NewEventsHandler(events.NewBroker()).ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
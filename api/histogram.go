@@ -0,0 +1,104 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/periskop-dev/periskop/metrics"
+	"github.com/periskop-dev/periskop/repository"
+)
+
+const (
+	defaultHistogramRange = 24 * time.Hour
+	defaultHistogramStep  = time.Hour
+	minHistogramStep      = repository.MinuteBucket
+	// maxHistogramBuckets bounds the size of the response
+	maxHistogramBuckets = 11000
+)
+
+// histogramQuery is the time range and the step of a histogram request
+type histogramQuery struct {
+	from time.Time
+	to   time.Time
+	step time.Duration
+}
+
+// NewErrorHistogramHandler returns the occurrences of an error over time.
+// Query parameters from and to are unix times, step is a duration (e.g. 5m) or a number of seconds.
+// By default it returns the occurrences of the last day by hour.
+func NewErrorHistogramHandler(r *repository.ErrorsRepository) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+
+		query, err := parseHistogramQuery(req.URL.Query(), time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		histogram, err := (*r).GetOccurrencesHistogram(req.Context(), vars["service_name"], vars["error_key"],
+			query.from, query.to, query.step)
+		if err != nil {
+			renderRepositoryError(w, err)
+			return
+		}
+		err = renderJSON(w, histogram)
+		if err != nil {
+			metrics.ErrorCollector.ReportWithHTTPRequest(err, req)
+		}
+	})
+}
+
+func parseHistogramQuery(values url.Values, now time.Time) (histogramQuery, error) {
+	query := histogramQuery{
+		from: now.Add(-defaultHistogramRange),
+		to:   now,
+		step: defaultHistogramStep,
+	}
+	var err error
+	if value := values.Get("to"); value != "" {
+		if query.to, err = parseUnixTime(value); err != nil {
+			return query, fmt.Errorf("invalid to parameter: %s", err)
+		}
+		query.from = query.to.Add(-defaultHistogramRange)
+	}
+	if value := values.Get("from"); value != "" {
+		if query.from, err = parseUnixTime(value); err != nil {
+			return query, fmt.Errorf("invalid from parameter: %s", err)
+		}
+	}
+	if value := values.Get("step"); value != "" {
+		if query.step, err = parseStep(value); err != nil {
+			return query, fmt.Errorf("invalid step parameter: %s", err)
+		}
+	}
+
+	if !query.from.Before(query.to) {
+		return query, fmt.Errorf("from must be before to")
+	}
+	if query.step < minHistogramStep {
+		return query, fmt.Errorf("step must be at least %s", minHistogramStep)
+	}
+	if query.to.Sub(query.from)/query.step > maxHistogramBuckets {
+		return query, fmt.Errorf("exceeded maximum of %d buckets, increase the step", maxHistogramBuckets)
+	}
+	return query, nil
+}
+
+func parseUnixTime(value string) (time.Time, error) {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(seconds, 0), nil
+}
+
+func parseStep(value string) (time.Duration, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(value)
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/periskop-dev/periskop/repository"
+)
+
+func TestParseHistogramQuery(t *testing.T) {
+	now := time.Unix(1600000200, 0)
+
+	query, err := parseHistogramQuery(url.Values{}, now)
+	if err != nil || !query.to.Equal(now) || !query.from.Equal(now.Add(-24*time.Hour)) || query.step != time.Hour {
+		t.Errorf("Unexpected default query %+v, error %v", query, err)
+	}
+
+	query, err = parseHistogramQuery(url.Values{"from": {"1600000000"}, "to": {"1600000600"}, "step": {"5m"}}, now)
+	if err != nil || query.from.Unix() != 1600000000 || query.to.Unix() != 1600000600 || query.step != 5*time.Minute {
+		t.Errorf("Unexpected query %+v, error %v", query, err)
+	}
+
+	query, err = parseHistogramQuery(url.Values{"step": {"120"}}, now)
+	if err != nil || query.step != 2*time.Minute {
+		t.Errorf("Unexpected step %s, error %v", query.step, err)
+	}
+
+	invalidQueries := []url.Values{
+		{"from": {"yesterday"}},
+		{"from": {"1600000600"}, "to": {"1600000000"}},
+		{"step": {"10s"}},
+		{"step": {"often"}},
+		{"from": {"0"}, "step": {"1m"}},
+	}
+	for _, values := range invalidQueries {
+		if _, err := parseHistogramQuery(values, now); err == nil {
+			t.Errorf("Expected an error parsing %v", values)
+		}
+	}
+}
+
+func TestErrorHistogramReturnsOccurrences(t *testing.T) {
+	ctx := context.Background()
+	r := repository.NewMemoryRepository()
+	r.AddOccurrences(ctx, "api-test", map[string]int{"test": 3}, time.Unix(1600000200, 0))
+
+	rr := httptest.NewRecorder()
+	handler := NewErrorHistogramHandler(&r)
+	router := mux.NewRouter()
+	router.Handle("/services/{service_name}/errors/{error_key}/histogram/", handler).Methods(http.MethodGet)
+	req, _ := http.NewRequest("GET",
+		"/services/api-test/errors/test/histogram/?from=1600000080&to=1600000320&step=2m", nil)
+	router.ServeHTTP(rr, req)
+
+	expected := `[{"timestamp":1600000080,"count":0},{"timestamp":1600000200,"count":3}]` + "\n"
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v",
+			rr.Body.String(), expected)
+	}
+}
@@ -3,8 +3,11 @@ package config
 import (
 	"fmt"
 	"io/ioutil"
+	"net/url"
+	"path/filepath"
 	"time"
 
+	prometheus_config "github.com/prometheus/common/config"
 	prometheus_discovery_config "github.com/prometheus/prometheus/discovery/config"
 	prometheus_relabel "github.com/prometheus/prometheus/pkg/relabel"
 
@@ -14,12 +17,104 @@ import (
 type PeriskopConfig struct {
 	Services   []Service  `yaml:"services"`
 	Repository Repository `yaml:"repository"`
+	// ExternalURL is the URL where users reach Periskop, used to link errors from notifications
+	ExternalURL string `yaml:"external_url,omitempty"`
+	// TrustedAuthHeader is the header identifying users set by an authenticating proxy in front of Periskop, like
+	// X-Forwarded-User. Status changes are anonymous when it isn't configured, since any client can set headers.
+	TrustedAuthHeader string `yaml:"trusted_auth_header,omitempty"`
 }
 
 type Repository struct {
-	Type string `yaml:"type"`
+	Type      string    `yaml:"type"`
+	Path      string    `yaml:"path,omitempty"`
+	Dsn       string    `yaml:"dsn,omitempty"`
+	Retention Retention `yaml:"retention,omitempty"`
+	Snapshot  Snapshot  `yaml:"snapshot,omitempty"`
+}
+
+// Validate checks the repository settings are consistent
+func (r Repository) Validate() error {
+	if err := r.Retention.Validate(); err != nil {
+		return err
+	}
+	if err := r.Snapshot.Validate(); err != nil {
+		return err
+	}
+	if r.Snapshot.Enabled() && r.Type != "" && r.Type != "memory" {
+		return fmt.Errorf("snapshots are only supported by the memory repository, not by %s", r.Type)
+	}
+	return nil
+}
+
+// Snapshot configures the periodic snapshots of the memory repository to a local file.
+// Snapshots are disabled when no path is configured.
+type Snapshot struct {
+	// Path is the file where the snapshots are written and loaded from on startup
 	Path string `yaml:"path,omitempty"`
-	Dsn  string `yaml:"dsn,omitempty"`
+	// Interval is how often a snapshot is written. Defaults to DefaultSnapshotInterval.
+	Interval time.Duration `yaml:"interval,omitempty"`
+}
+
+// DefaultSnapshotInterval is how often a snapshot is written when interval isn't configured
+const DefaultSnapshotInterval = time.Minute
+
+// Enabled returns whether snapshots are configured
+func (s Snapshot) Enabled() bool {
+	return s.Path != ""
+}
+
+// GetInterval returns the configured interval to write snapshots or its default value
+func (s Snapshot) GetInterval() time.Duration {
+	if s.Interval <= 0 {
+		return DefaultSnapshotInterval
+	}
+	return s.Interval
+}
+
+// Validate checks the snapshot interval isn't negative
+func (s Snapshot) Validate() error {
+	if s.Interval < 0 {
+		return fmt.Errorf("snapshot interval can't be negative")
+	}
+	return nil
+}
+
+// Retention configures which errors are pruned from the repository. Every policy is disabled when not configured.
+type Retention struct {
+	// MaxAge is how long errors are kept since they were last seen
+	MaxAge time.Duration `yaml:"max_age,omitempty"`
+	// ResolvedMaxAge is how long resolved errors are kept since they were resolved
+	ResolvedMaxAge time.Duration `yaml:"resolved_max_age,omitempty"`
+	// MaxOccurrences is the maximum number of occurrences kept per error, the newest ones are kept
+	MaxOccurrences int `yaml:"max_occurrences,omitempty"`
+	// MaxErrorsPerService is the maximum number of errors kept per service, the most recently seen ones are kept
+	MaxErrorsPerService int `yaml:"max_errors_per_service,omitempty"`
+	// Interval is how often the retention policies are applied. Defaults to DefaultRetentionInterval.
+	Interval time.Duration `yaml:"interval,omitempty"`
+}
+
+// DefaultRetentionInterval is how often the retention policies are applied when interval isn't configured
+const DefaultRetentionInterval = time.Hour
+
+// Enabled returns whether any retention policy is configured
+func (r Retention) Enabled() bool {
+	return r.MaxAge > 0 || r.ResolvedMaxAge > 0 || r.MaxOccurrences > 0 || r.MaxErrorsPerService > 0
+}
+
+// GetInterval returns the configured interval to apply the retention policies or its default value
+func (r Retention) GetInterval() time.Duration {
+	if r.Interval <= 0 {
+		return DefaultRetentionInterval
+	}
+	return r.Interval
+}
+
+// Validate checks the retention settings aren't negative
+func (r Retention) Validate() error {
+	if r.MaxAge < 0 || r.ResolvedMaxAge < 0 || r.MaxOccurrences < 0 || r.MaxErrorsPerService < 0 || r.Interval < 0 {
+		return fmt.Errorf("retention settings can't be negative")
+	}
+	return nil
 }
 
 type Service struct {
@@ -27,11 +122,285 @@ type Service struct {
 	ServiceDiscovery prometheus_discovery_config.ServiceDiscoveryConfig `yaml:",inline"`
 	Scraper          Scraper                                            `yaml:"scraper"`
 	RelabelConfigs   []*prometheus_relabel.Config                       `yaml:"relabel_configs,omitempty"`
+	Push             Push                                               `yaml:"push,omitempty"`
+	Notifications    []Notification                                     `yaml:"notifications,omitempty"`
+}
+
+// Severities of the errors, from the least to the most severe
+var Severities = []string{"info", "warning", "error"}
+
+// Triggers of the notifications of a service
+const (
+	// TriggerNewError notifies the errors scraped for the first time
+	TriggerNewError = "new_error"
+	// TriggerRegressed notifies the resolved errors that reappear
+	TriggerRegressed = "regressed"
+	// TriggerSeverity notifies the new occurrences of the errors at or above a severity
+	TriggerSeverity = "severity"
+	// TriggerCountThreshold notifies the errors whose total count reaches a threshold
+	TriggerCountThreshold = "count_threshold"
+)
+
+// Formats of the payloads of the notifications
+const (
+	NotificationFormatJSON  = "json"
+	NotificationFormatSlack = "slack"
+	NotificationFormatTeams = "teams"
+)
+
+// Notification configures a webhook notified when the errors of a service trigger any of its triggers.
+// Notifications of the same error and trigger are sent once per dedup window.
+type Notification struct {
+	URL      string   `yaml:"url"`
+	Triggers []string `yaml:"triggers"`
+	// Severities routes only the errors of the given severities to the webhook, all of them if not configured
+	Severities []string `yaml:"severities,omitempty"`
+	// Format is the format of the payload: json (default), or the incoming webhook messages of slack or teams
+	Format string `yaml:"format,omitempty"`
+	// SeverityThreshold is the lowest severity notified by the severity trigger
+	SeverityThreshold string `yaml:"severity_threshold,omitempty"`
+	// CountThreshold is the total count notified by the count_threshold trigger
+	CountThreshold int `yaml:"count_threshold,omitempty"`
+	// Template is a Go template of the payload of the json format, the notification is sent as JSON if not configured
+	Template string `yaml:"template,omitempty"`
+	// Headers are extra headers added to every request, like authentication tokens
+	Headers map[string]string `yaml:"headers,omitempty"`
+	// MaxRetries is the number of retries of failed requests, 0 disables them.
+	// Defaults to DefaultNotificationMaxRetries when not configured.
+	MaxRetries *int `yaml:"max_retries,omitempty"`
+	// RetryBackoff is the wait before the first retry, which doubles on every retry.
+	// Defaults to DefaultNotificationRetryBackoff.
+	RetryBackoff time.Duration `yaml:"retry_backoff,omitempty"`
+	// DedupWindow is how long notifications of the same error and trigger are suppressed.
+	// Defaults to DefaultNotificationDedupWindow.
+	DedupWindow time.Duration `yaml:"dedup_window,omitempty"`
+}
+
+// Defaults of the notifications when they aren't configured
+const (
+	DefaultNotificationMaxRetries   = 3
+	DefaultNotificationRetryBackoff = time.Second
+	DefaultNotificationDedupWindow  = time.Hour
+)
+
+// GetFormat returns the configured format of the payload or json if not configured
+func (n Notification) GetFormat() string {
+	if n.Format == "" {
+		return NotificationFormatJSON
+	}
+	return n.Format
+}
+
+// GetMaxRetries returns the configured number of retries or its default value
+func (n Notification) GetMaxRetries() int {
+	if n.MaxRetries == nil {
+		return DefaultNotificationMaxRetries
+	}
+	return *n.MaxRetries
+}
+
+// GetRetryBackoff returns the configured wait before the first retry or its default value
+func (n Notification) GetRetryBackoff() time.Duration {
+	if n.RetryBackoff <= 0 {
+		return DefaultNotificationRetryBackoff
+	}
+	return n.RetryBackoff
+}
+
+// GetDedupWindow returns the configured dedup window or its default value
+func (n Notification) GetDedupWindow() time.Duration {
+	if n.DedupWindow <= 0 {
+		return DefaultNotificationDedupWindow
+	}
+	return n.DedupWindow
+}
+
+// Validate checks the notification settings are consistent
+func (n Notification) Validate() error {
+	if u, err := url.Parse(n.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("invalid notification url %s", n.URL)
+	}
+	if len(n.Triggers) == 0 {
+		return fmt.Errorf("notification to %s without triggers", n.URL)
+	}
+	for _, trigger := range n.Triggers {
+		switch trigger {
+		case TriggerNewError, TriggerRegressed:
+		case TriggerSeverity:
+			if SeverityRank(n.SeverityThreshold) < 0 {
+				return fmt.Errorf("invalid severity_threshold %s, expected one of %v", n.SeverityThreshold,
+					Severities)
+			}
+		case TriggerCountThreshold:
+			if n.CountThreshold <= 0 {
+				return fmt.Errorf("count_threshold must be positive")
+			}
+		default:
+			return fmt.Errorf("invalid trigger %s, expected %s, %s, %s or %s", trigger, TriggerNewError,
+				TriggerRegressed, TriggerSeverity, TriggerCountThreshold)
+		}
+	}
+	for _, severity := range n.Severities {
+		if SeverityRank(severity) < 0 {
+			return fmt.Errorf("invalid severity %s, expected one of %v", severity, Severities)
+		}
+	}
+	switch format := n.GetFormat(); format {
+	case NotificationFormatJSON:
+	case NotificationFormatSlack, NotificationFormatTeams:
+		if n.Template != "" {
+			return fmt.Errorf("templates are only supported by the %s format, not by %s", NotificationFormatJSON,
+				format)
+		}
+	default:
+		return fmt.Errorf("invalid format %s, expected %s, %s or %s", format, NotificationFormatJSON,
+			NotificationFormatSlack, NotificationFormatTeams)
+	}
+	if n.GetMaxRetries() < 0 || n.RetryBackoff < 0 || n.DedupWindow < 0 {
+		return fmt.Errorf("notification settings can't be negative")
+	}
+	return nil
+}
+
+// SeverityRank returns the position of a severity in Severities, or -1 for unknown severities
+func SeverityRank(severity string) int {
+	for rank, known := range Severities {
+		if severity == known {
+			return rank
+		}
+	}
+	return -1
+}
+
+// Push configures the ingestion of errors pushed by short-lived instances of a service
+type Push struct {
+	Enabled bool `yaml:"enabled"`
+	// Expiry is how long the errors pushed by an instance are kept after its last push.
+	// Defaults to DefaultPushExpiry.
+	Expiry time.Duration `yaml:"expiry,omitempty"`
+	// MaxInstances is the maximum number of instances pushing at the same time, pushes of new instances are
+	// rejected once it's reached. Defaults to DefaultPushMaxInstances.
+	MaxInstances int `yaml:"max_instances,omitempty"`
+	// BearerToken is the token pushes must send in their Authorization header. Any client can push when it isn't
+	// configured.
+	BearerToken prometheus_config.Secret `yaml:"bearer_token,omitempty"`
+}
+
+// DefaultPushExpiry is the expiry of pushed instances used when expiry isn't configured
+const DefaultPushExpiry = time.Hour
+
+// DefaultPushMaxInstances is the maximum number of pushing instances used when max_instances isn't configured
+const DefaultPushMaxInstances = 1000
+
+// GetExpiry returns the configured expiry of pushed instances or its default value
+func (p Push) GetExpiry() time.Duration {
+	if p.Expiry <= 0 {
+		return DefaultPushExpiry
+	}
+	return p.Expiry
+}
+
+// GetMaxInstances returns the configured maximum number of pushing instances or its default value
+func (p Push) GetMaxInstances() int {
+	if p.MaxInstances <= 0 {
+		return DefaultPushMaxInstances
+	}
+	return p.MaxInstances
 }
 
 type Scraper struct {
 	RefreshInterval time.Duration `yaml:"refresh_interval"`
 	Endpoint        string        `yaml:"endpoint"`
+	// MaxResponseSize is the maximum size in bytes of a decompressed response body,
+	// scrapes exceeding it are aborted. Defaults to DefaultMaxResponseSize.
+	MaxResponseSize int64 `yaml:"max_response_size,omitempty"`
+	// MaxLatestErrors is the maximum number of occurrences kept per error. Defaults to DefaultMaxLatestErrors.
+	MaxLatestErrors int `yaml:"max_latest_errors,omitempty"`
+	// LatestErrorsStrategy selects which occurrences are kept once MaxLatestErrors is reached:
+	// the newest ones (default) or a reservoir sample across all targets
+	LatestErrorsStrategy string `yaml:"latest_errors_strategy,omitempty"`
+	// Scheme is the protocol used to scrape the targets, either http (default) or https
+	Scheme string `yaml:"scheme,omitempty"`
+	// Headers are extra headers added to every scrape request
+	Headers map[string]string `yaml:"headers,omitempty"`
+	// HTTPClientConfig holds the TLS and authentication settings, mirroring Prometheus scrape configs
+	HTTPClientConfig prometheus_config.HTTPClientConfig `yaml:",inline"`
+}
+
+// DefaultMaxLatestErrors is the maximum number of occurrences kept per error when max_latest_errors isn't configured
+const DefaultMaxLatestErrors = 100
+
+// Strategies to retain the latest occurrences of an error
+const (
+	LatestErrorsStrategyNewest    = "newest"
+	LatestErrorsStrategyReservoir = "reservoir"
+)
+
+// GetMaxLatestErrors returns the configured maximum number of occurrences per error or its default value
+func (s Scraper) GetMaxLatestErrors() int {
+	if s.MaxLatestErrors <= 0 {
+		return DefaultMaxLatestErrors
+	}
+	return s.MaxLatestErrors
+}
+
+// GetLatestErrorsStrategy returns the configured strategy to retain occurrences or newest if not configured
+func (s Scraper) GetLatestErrorsStrategy() string {
+	if s.LatestErrorsStrategy == "" {
+		return LatestErrorsStrategyNewest
+	}
+	return s.LatestErrorsStrategy
+}
+
+// GetScheme returns the configured scheme or http if not configured
+func (s Scraper) GetScheme() string {
+	if s.Scheme == "" {
+		return "http"
+	}
+	return s.Scheme
+}
+
+// Validate checks the scraper settings are consistent
+func (s Scraper) Validate() error {
+	if scheme := s.GetScheme(); scheme != "http" && scheme != "https" {
+		return fmt.Errorf("invalid scheme %s, expected http or https", scheme)
+	}
+	if strategy := s.GetLatestErrorsStrategy(); strategy != LatestErrorsStrategyNewest &&
+		strategy != LatestErrorsStrategyReservoir {
+		return fmt.Errorf("invalid latest_errors_strategy %s, expected %s or %s", strategy,
+			LatestErrorsStrategyNewest, LatestErrorsStrategyReservoir)
+	}
+	return s.HTTPClientConfig.Validate()
+}
+
+// DefaultMaxResponseSize is the maximum response size used when max_response_size isn't configured
+const DefaultMaxResponseSize int64 = 100 * 1024 * 1024
+
+// GetMaxResponseSize returns the configured maximum response size or its default value
+func (s Scraper) GetMaxResponseSize() int64 {
+	if s.MaxResponseSize <= 0 {
+		return DefaultMaxResponseSize
+	}
+	return s.MaxResponseSize
+}
+
+// SetDirectory resolves the relative paths of the TLS and authentication files against the directory of the
+// configuration file, like Prometheus does
+func (s *Scraper) SetDirectory(dir string) {
+	join := func(path string) string {
+		if path != "" && !filepath.IsAbs(path) {
+			return filepath.Join(dir, path)
+		}
+		return path
+	}
+	clientConfig := &s.HTTPClientConfig
+	if clientConfig.BasicAuth != nil {
+		clientConfig.BasicAuth.PasswordFile = join(clientConfig.BasicAuth.PasswordFile)
+	}
+	clientConfig.BearerTokenFile = join(clientConfig.BearerTokenFile)
+	clientConfig.TLSConfig.CAFile = join(clientConfig.TLSConfig.CAFile)
+	clientConfig.TLSConfig.CertFile = join(clientConfig.TLSConfig.CertFile)
+	clientConfig.TLSConfig.KeyFile = join(clientConfig.TLSConfig.KeyFile)
 }
 
 // LoadFile parses the given YAML file into a Config.
@@ -44,6 +413,9 @@ func LoadFile(filename string) (*PeriskopConfig, error) {
 	if err != nil {
 		return nil, fmt.Errorf("parsing YAML file %s: %v", filename, err)
 	}
+	for i := range cfg.Services {
+		cfg.Services[i].Scraper.SetDirectory(filepath.Dir(filename))
+	}
 
 	return cfg, nil
 }
@@ -56,5 +428,21 @@ func Load(s string) (*PeriskopConfig, error) {
 	if err != nil {
 		return nil, err
 	}
+	if u, err := url.Parse(cfg.ExternalURL); err != nil || (cfg.ExternalURL != "" && u.Host == "") {
+		return nil, fmt.Errorf("invalid external_url %s", cfg.ExternalURL)
+	}
+	if err := cfg.Repository.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid repository configuration: %v", err)
+	}
+	for _, service := range cfg.Services {
+		if err := service.Scraper.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid scraper configuration for service %s: %v", service.Name, err)
+		}
+		for _, notification := range service.Notifications {
+			if err := notification.Validate(); err != nil {
+				return nil, fmt.Errorf("invalid notification configuration for service %s: %v", service.Name, err)
+			}
+		}
+	}
 	return cfg, nil
 }
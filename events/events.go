@@ -0,0 +1,168 @@
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/periskop-dev/periskop/metrics"
+	"github.com/periskop-dev/periskop/repository"
+)
+
+// Types of the events of an aggregated error
+const (
+	// EventNewError is published when an aggregation key is seen for the first time
+	EventNewError = "new_error"
+	// EventCountChanged is published when an error has new occurrences
+	EventCountChanged = "count_changed"
+	// EventRegressed is published when a resolved error reappears
+	EventRegressed = "regressed"
+	// EventResolved is published when an error is resolved
+	EventResolved = "resolved"
+	// EventStatusChanged is published on any other change of status, like ignoring or reopening an error
+	EventStatusChanged = "status_changed"
+)
+
+// subscriptionBufferSize is the number of events queued per subscriber, events are dropped for slower subscribers
+const subscriptionBufferSize = 256
+
+// Event is a change of an aggregated error of a service
+type Event struct {
+	// ID increases with every event published by a broker
+	ID             uint64 `json:"id"`
+	Type           string `json:"type"`
+	Service        string `json:"service"`
+	AggregationKey string `json:"aggregation_key"`
+	Severity       string `json:"severity,omitempty"`
+	TotalCount     int    `json:"total_count,omitempty"`
+	// PreviousCount is the total count of the error when it was last stored, for count changes
+	PreviousCount int `json:"previous_count,omitempty"`
+	// Status, Actor and Note describe status changes
+	Status string `json:"status,omitempty"`
+	Actor  string `json:"actor,omitempty"`
+	Note   string `json:"note,omitempty"`
+	// LatestError is the newest occurrence of the error, if known
+	LatestError *repository.ErrorWithContext `json:"latest_error,omitempty"`
+	// Timestamp is the unix time of the event
+	Timestamp int64 `json:"timestamp"`
+}
+
+// NewStatusEvent returns the event of a change of status of an error
+func NewStatusEvent(serviceName string, key string, change repository.StatusChange) Event {
+	event := Event{
+		Type:           EventStatusChanged,
+		Service:        serviceName,
+		AggregationKey: key,
+		Status:         change.Status,
+		Actor:          change.Actor,
+		Note:           change.Note,
+	}
+	switch change.Status {
+	case repository.StatusResolved:
+		event.Type = EventResolved
+	case repository.StatusRegressed:
+		event.Type = EventRegressed
+		if change.Regression != nil {
+			event.LatestError = change.Regression.Occurrence
+		}
+	}
+	return event
+}
+
+// Broker fans out the published events to its subscribers. A nil broker drops every event.
+type Broker struct {
+	mutex         sync.Mutex
+	lastID        uint64
+	subscriptions map[*Subscription]bool
+	closed        bool
+}
+
+// Subscription receives the events of a service, or of every service
+type Subscription struct {
+	service string
+	events  chan Event
+	broker  *Broker
+}
+
+// NewBroker creates a broker without subscribers
+func NewBroker() *Broker {
+	return &Broker{subscriptions: make(map[*Subscription]bool)}
+}
+
+// Publish sends events to the subscribers of their services, setting their ID and timestamp.
+// It never blocks: events are dropped for subscribers whose buffer is full.
+func (b *Broker) Publish(events ...Event) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := time.Now().Unix()
+	for _, event := range events {
+		b.lastID++
+		event.ID = b.lastID
+		if event.Timestamp == 0 {
+			event.Timestamp = now
+		}
+		for subscription := range b.subscriptions {
+			if subscription.service != "" && subscription.service != event.Service {
+				continue
+			}
+			select {
+			case subscription.events <- event:
+			default:
+				metrics.DroppedEvents.Inc()
+			}
+		}
+	}
+}
+
+// Subscribe returns a subscription to the events of a service, or of every service if the service is empty.
+// The subscription must be closed once it's no longer used.
+func (b *Broker) Subscribe(serviceName string) *Subscription {
+	return b.SubscribeBuffered(serviceName, subscriptionBufferSize)
+}
+
+// SubscribeBuffered returns a subscription like Subscribe that queues up to bufferSize events, for subscribers
+// that must not miss events during bursts. Events are still dropped, and counted by periskop_dropped_events_total,
+// once the buffer is full, so a stalled subscriber never holds the events in memory.
+func (b *Broker) SubscribeBuffered(serviceName string, bufferSize int) *Subscription {
+	subscription := &Subscription{
+		service: serviceName,
+		events:  make(chan Event, bufferSize),
+		broker:  b,
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		close(subscription.events)
+	} else {
+		b.subscriptions[subscription] = true
+	}
+	return subscription
+}
+
+// Close closes every subscription, subscribing afterwards returns closed subscriptions
+func (b *Broker) Close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.closed = true
+	for subscription := range b.subscriptions {
+		delete(b.subscriptions, subscription)
+		close(subscription.events)
+	}
+}
+
+// Events returns the channel of the events of the subscription, which is closed with the subscription
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Close stops receiving events
+func (s *Subscription) Close() {
+	s.broker.mutex.Lock()
+	defer s.broker.mutex.Unlock()
+	if s.broker.subscriptions[s] {
+		delete(s.broker.subscriptions, s)
+		close(s.events)
+	}
+}
@@ -0,0 +1,90 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/periskop-dev/periskop/repository"
+)
+
+func TestBrokerPublishesToServiceSubscribers(t *testing.T) {
+	broker := NewBroker()
+	service := broker.Subscribe("test-service")
+	all := broker.Subscribe("")
+	defer service.Close()
+	defer all.Close()
+
+	broker.Publish(Event{Type: EventNewError, Service: "other-service"},
+		Event{Type: EventNewError, Service: "test-service", AggregationKey: "key"})
+
+	if event := <-service.Events(); event.AggregationKey != "key" || event.ID != 2 || event.Timestamp == 0 {
+		t.Errorf("Unexpected event %+v", event)
+	}
+	if len(service.Events()) != 0 {
+		t.Errorf("Expected only the events of test-service, Found %d more", len(service.Events()))
+	}
+	if len(all.Events()) != 2 {
+		t.Errorf("Expected the events of every service, Found %d", len(all.Events()))
+	}
+}
+
+func TestBrokerDropsEventsOfSlowSubscribers(t *testing.T) {
+	broker := NewBroker()
+	subscription := broker.Subscribe("")
+	defer subscription.Close()
+	for i := 0; i < subscriptionBufferSize+1; i++ {
+		broker.Publish(Event{Type: EventCountChanged, Service: "test-service"})
+	}
+	if len(subscription.Events()) != subscriptionBufferSize {
+		t.Errorf("Expected %d queued events, Found %d", subscriptionBufferSize, len(subscription.Events()))
+	}
+}
+
+func TestBrokerSubscribeBuffered(t *testing.T) {
+	broker := NewBroker()
+	subscription := broker.SubscribeBuffered("", 2*subscriptionBufferSize)
+	defer subscription.Close()
+	for i := 0; i < 2*subscriptionBufferSize+1; i++ {
+		broker.Publish(Event{Type: EventCountChanged, Service: "test-service", TotalCount: i})
+	}
+	if len(subscription.Events()) != 2*subscriptionBufferSize {
+		t.Errorf("Expected %d queued events, Found %d", 2*subscriptionBufferSize, len(subscription.Events()))
+	}
+	if event := <-subscription.Events(); event.TotalCount != 0 {
+		t.Errorf("Expected the oldest events to be kept, Found %+v", event)
+	}
+}
+
+func TestBrokerClose(t *testing.T) {
+	broker := NewBroker()
+	subscription := broker.Subscribe("")
+	broker.Close()
+	if _, open := <-subscription.Events(); open {
+		t.Errorf("Expected subscription to be closed")
+	}
+	subscription.Close()
+	if _, open := <-broker.Subscribe("").Events(); open {
+		t.Errorf("Expected subscriptions to a closed broker to be closed")
+	}
+
+	var nilBroker *Broker
+	nilBroker.Publish(Event{Type: EventNewError})
+}
+
+func TestNewStatusEvent(t *testing.T) {
+	occurrence := &repository.ErrorWithContext{UUID: "uuid0"}
+	changes := map[string]repository.StatusChange{
+		EventResolved:      {Status: repository.StatusResolved, Actor: "alice", Note: "fixed"},
+		EventRegressed:     {Status: repository.StatusRegressed, Regression: &repository.Regression{Occurrence: occurrence}},
+		EventStatusChanged: {Status: repository.StatusIgnored},
+	}
+	for expected, change := range changes {
+		event := NewStatusEvent("test-service", "key", change)
+		if event.Type != expected || event.Status != change.Status || event.Actor != change.Actor ||
+			event.Note != change.Note {
+			t.Errorf("Expected %s event, Found %+v", expected, event)
+		}
+	}
+	if event := NewStatusEvent("test-service", "key", changes[EventRegressed]); event.LatestError != occurrence {
+		t.Errorf("Expected the occurrence of the regression, Found %+v", event.LatestError)
+	}
+}
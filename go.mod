@@ -3,9 +3,13 @@ module github.com/periskop-dev/periskop
 require (
 	github.com/go-kit/kit v0.10.0
 	github.com/gorilla/mux v1.7.4
+	github.com/klauspost/compress v1.15.15
 	github.com/periskop-dev/periskop-go v0.0.0-20220512172842-c5603b259677
 	github.com/prometheus/client_golang v1.5.1
+	github.com/prometheus/common v0.9.1
 	github.com/prometheus/prometheus v1.8.2-0.20200507164740-ecee9c8abfd1
+	go.etcd.io/bbolt v1.3.6
+	google.golang.org/protobuf v1.21.0
 	gopkg.in/yaml.v2 v2.2.8
 	gorm.io/driver/mysql v1.1.2
 	gorm.io/driver/postgres v1.1.0
@@ -75,7 +79,6 @@ require (
 	github.com/mwitkow/go-conntrack v0.0.0-20190716064945-2f068394615f // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/prometheus/client_model v0.2.0 // indirect
-	github.com/prometheus/common v0.9.1 // indirect
 	github.com/prometheus/procfs v0.0.11 // indirect
 	github.com/samuel/go-zookeeper v0.0.0-20190923202752-2cc03de413da // indirect
 	go.opencensus.io v0.22.3 // indirect
@@ -90,7 +93,6 @@ require (
 	google.golang.org/appengine v1.6.6 // indirect
 	google.golang.org/genproto v0.0.0-20200420144010-e5e8543f8aeb // indirect
 	google.golang.org/grpc v1.29.0 // indirect
-	google.golang.org/protobuf v1.21.0 // indirect
 	gopkg.in/fsnotify/fsnotify.v1 v1.4.7 // indirect
 	gopkg.in/inf.v0 v0.9.1 // indirect
 	k8s.io/api v0.17.5 // indirect
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/periskop-dev/periskop-go"
@@ -14,7 +18,9 @@ import (
 
 	"github.com/periskop-dev/periskop/api"
 	"github.com/periskop-dev/periskop/config"
+	"github.com/periskop-dev/periskop/events"
 	"github.com/periskop-dev/periskop/metrics"
+	"github.com/periskop-dev/periskop/notifier"
 	"github.com/periskop-dev/periskop/repository"
 	"github.com/periskop-dev/periskop/scraper"
 	"github.com/periskop-dev/periskop/servicediscovery"
@@ -22,10 +28,15 @@ import (
 
 const numOfProcessors = 8
 
+// shutdownTimeout is how long in-flight requests are waited for on shutdown
+const shutdownTimeout = 10 * time.Second
+
 func main() {
 	var (
 		port              = flag.String("port", os.Getenv("PORT"), "The server port")
 		configurationFile = flag.String("config", os.Getenv("CONFIG_FILE"), "The configuration file")
+		exportFile        = flag.String("export", "", "Export the repository to an archive file and exit, - for stdout")
+		importFile        = flag.String("import", "", "Import an archive file to the repository and exit, - for stdin")
 	)
 
 	flag.Parse()
@@ -40,19 +51,69 @@ func main() {
 		panic(err)
 	}
 
+	repo, err := repository.NewRepository(cfg.Repository)
+	if err != nil {
+		log.Fatalf("Could not create repository: %v", err)
+	}
+	if *exportFile != "" {
+		if err := exportRepository(repo, *exportFile); err != nil {
+			log.Fatalf("Could not export repository: %v", err)
+		}
+		return
+	}
+	if *importFile != "" {
+		if err := importRepository(repo, cfg.Repository, *importFile); err != nil {
+			log.Fatalf("Could not import repository: %v", err)
+		}
+		return
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	processor := scraper.NewProcessor(numOfProcessors)
 	processor.Run()
-	repo := repository.NewRepository(cfg.Repository)
+	var snapshotter *repository.Snapshotter
+	if snapshot := cfg.Repository.Snapshot; snapshot.Enabled() {
+		snapshotter, err = repository.NewSnapshotter(repo, snapshot)
+		if err != nil {
+			log.Fatalf("Could not create snapshotter: %v", err)
+		}
+		go snapshotter.Run(ctx)
+	}
+	broker := events.NewBroker()
+	pushers := make(map[string]api.Pusher)
+	scrapers := make(map[string]scraper.Scraper, len(cfg.Services))
 	for _, service := range cfg.Services {
 		resolver := servicediscovery.NewResolver(service)
-		s := scraper.NewScraper(resolver, &repo, service, processor)
-		go s.Scrape()
+		s, err := scraper.NewScraper(resolver, &repo, service, processor, broker)
+		if err != nil {
+			log.Fatalf("Could not create scraper for service %s: %v", service.Name, err)
+		}
+		scrapers[service.Name] = s
+		if service.Push.Enabled {
+			pushers[service.Name] = s
+		}
+		if len(service.Notifications) > 0 {
+			n, err := notifier.New(service.Name, service.Notifications, cfg.ExternalURL, broker)
+			if err != nil {
+				log.Fatalf("Could not create notifier for service %s: %v", service.Name, err)
+			}
+			go n.Run(ctx)
+		}
+		go s.Scrape(ctx)
+	}
+	if retention := cfg.Repository.Retention; retention.Enabled() {
+		// scrapers forget the pruned errors, so they aren't kept in memory nor stored again
+		go repository.NewJanitor(repo, retention, func(serviceName string, keys []string) {
+			if s, exists := scrapers[serviceName]; exists {
+				s.Forget(keys)
+			}
+		}).Run(ctx)
 	}
 
 	router := mux.NewRouter()
 
 	// API routing
-	setupAPIRouting(repo, router)
+	setupAPIRouting(repo, pushers, broker, cfg.TrustedAuthHeader, router)
 
 	// Web routing
 	setupWebRouting(router)
@@ -67,7 +128,77 @@ func main() {
 
 	address := fmt.Sprintf(":%s", *port)
 	log.Printf("Serving on address %s", address)
-	log.Fatal(http.ListenAndServe(address, nil))
+	server := &http.Server{Addr: address}
+	// event streams never end by themselves, they are closed on shutdown
+	server.RegisterOnShutdown(broker.Close)
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	// a second signal stops periskop without waiting for the shutdown
+	stop()
+	log.Printf("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Failed to shut down the server: %v", err)
+	}
+	if snapshotter != nil {
+		// failures are logged by the snapshotter
+		snapshotter.Flush() // nolint[errcheck]
+	}
+}
+
+// exportRepository writes every service of the repository to an archive file
+func exportRepository(repo repository.ErrorsRepository, path string) error {
+	file := os.Stdout
+	if path != "-" {
+		var err error
+		if file, err = os.Create(path); err != nil {
+			return err
+		}
+	}
+	summary, err := repository.Export(context.Background(), repo, file)
+	if err != nil {
+		file.Close() // nolint[errcheck]
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	log.Printf("Exported %d errors of %d services to %s", summary.Errors, summary.Services, path)
+	return nil
+}
+
+// importRepository stores the contents of an archive file in the repository. Memory repositories are only kept
+// when snapshots are configured, so the snapshot is written after importing.
+func importRepository(repo repository.ErrorsRepository, repositoryConfig config.Repository, path string) error {
+	file := os.Stdin
+	if path != "-" {
+		var err error
+		if file, err = os.Open(path); err != nil {
+			return err
+		}
+		defer file.Close()
+	}
+	summary, err := repository.Import(context.Background(), repo, file)
+	if err != nil {
+		return err
+	}
+	if snapshot := repositoryConfig.Snapshot; snapshot.Enabled() {
+		snapshotter, err := repository.NewSnapshotter(repo, snapshot)
+		if err != nil {
+			return err
+		}
+		if err := snapshotter.Flush(); err != nil {
+			return err
+		}
+	}
+	log.Printf("Imported %d errors of %d services from %s", summary.Errors, summary.Services, path)
+	return nil
 }
 
 func setupWebRouting(r *mux.Router) {
@@ -84,17 +215,37 @@ func setupWebRouting(r *mux.Router) {
 	r.PathPrefix("/").Handler(http.StripPrefix("/", fs))
 }
 
-func setupAPIRouting(repo repository.ErrorsRepository, r *mux.Router) {
+func setupAPIRouting(repo repository.ErrorsRepository, pushers map[string]api.Pusher, broker *events.Broker,
+	trustedAuthHeader string, r *mux.Router) {
 	r.Handle("/services/",
 		api.NewServicesListHandler(&repo)).Methods(http.MethodGet)
 	r.Handle("/services/{service_name}/errors/",
 		api.NewErrorsListHandler(&repo)).Methods(http.MethodGet)
+	r.Handle("/services/{service_name}/errors/{error_key:.*}/status/",
+		api.NewErrorStatusHandler(&repo)).Methods(http.MethodGet)
+	r.Handle("/services/{service_name}/errors/{error_key:.*}/status/",
+		api.NewErrorStatusUpdateHandler(&repo, broker)).Methods(http.MethodPut)
+	r.Handle("/services/{service_name}/errors/{error_key:.*}/resolutions/",
+		api.NewErrorResolutionsHandler(&repo)).Methods(http.MethodGet)
+	r.Handle("/services/{service_name}/errors/{error_key:.*}/histogram/",
+		api.NewErrorHistogramHandler(&repo)).Methods(http.MethodGet)
+	r.Handle("/services/{service_name}/errors/{error_key:.*}/occurrences/",
+		api.NewErrorOccurrencesHandler(&repo)).Methods(http.MethodGet)
+	r.Handle("/services/{service_name}/errors/{error_key:.*}/",
+		api.NewErrorHandler(&repo)).Methods(http.MethodGet)
 	r.Handle("/services/{service_name}/errors/{error_key:.*}/",
-		api.NewErrorResolveHandler(&repo)).Methods(http.MethodDelete, http.MethodOptions)
+		api.NewErrorResolveHandler(&repo, broker)).Methods(http.MethodDelete)
+	r.Handle("/services/{service_name}/events/",
+		api.NewEventsHandler(broker)).Methods(http.MethodGet)
+	r.Handle("/events/",
+		api.NewEventsHandler(broker)).Methods(http.MethodGet)
 	r.Handle("/targets/",
 		api.NewTargetsHandler(&repo)).Methods(http.MethodGet)
-	r.Use(api.CORSLocalhostMiddleware(r))
-	http.Handle("/", r)
+	r.Handle("/push/{service_name}/{instance}",
+		api.NewPushHandler(pushers)).Methods(http.MethodPost)
+	r.Use(api.TrustedActorMiddleware(trustedAuthHeader))
+	// preflight requests match no route, so CORS is handled before routing
+	http.Handle("/", api.CORSLocalhostMiddleware(r)(r))
 }
 
 func healthHandler(w http.ResponseWriter, r *http.Request) {
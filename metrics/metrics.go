@@ -49,6 +49,67 @@ var (
 		},
 		[]string{"service_name", "severity", "target", "aggregation_key"},
 	)
+	// CounterResets is a Prometheus counter to track the number of error counters reset by scraped targets
+	CounterResets = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "counter_resets_total",
+			Help:      "Total number of error counters reset by scraped targets, usually after a restart.",
+		},
+		scrappedLabels,
+	)
+	// ErrorRegressions is a Prometheus counter to track the number of times that resolved errors reappear
+	ErrorRegressions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "error_regressions_total",
+			Help:      "Total number of resolved errors that reappeared per service and error type.",
+		},
+		[]string{"service_name", "aggregation_key"},
+	)
+	// ScrapeCycleFailures is a Prometheus counter to track the scrape cycles whose results couldn't be stored
+	ScrapeCycleFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "scrape_cycle_failures_total",
+			Help:      "Total number of scrape cycles whose results couldn't be stored in the repository.",
+		},
+		scrappedLabels,
+	)
+	// PrunedErrors is a Prometheus counter to track the errors removed from the repository by retention policies
+	PrunedErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "pruned_errors_total",
+			Help:      "Total number of errors removed from the repository per retention policy.",
+		},
+		[]string{"policy"},
+	)
+	// PrunedOccurrences is a Prometheus counter to track the occurrences removed from the repository
+	PrunedOccurrences = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "pruned_occurrences_total",
+			Help:      "Total number of occurrences removed from the repository by the max occurrences policy.",
+		},
+	)
+	// DroppedEvents is a Prometheus counter to track the events not delivered to slow subscribers
+	DroppedEvents = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "dropped_events_total",
+			Help:      "Total number of events dropped because their subscribers were too slow.",
+		},
+	)
+	// Notifications is a Prometheus counter to track the notifications of every service by trigger and result
+	Notifications = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "notifications_total",
+			Help:      "Total number of notifications per service, trigger and result: sent, failed, dropped or deduplicated.",
+		},
+		[]string{"service_name", "trigger", "result"},
+	)
 	ErrorCollector = periskop.NewErrorCollector()
 )
 
@@ -57,5 +118,12 @@ func init() {
 	prometheus.MustRegister(ErrorsScrapped)
 	prometheus.MustRegister(ServiceErrors)
 	prometheus.MustRegister(ErrorOccurrences)
+	prometheus.MustRegister(CounterResets)
+	prometheus.MustRegister(ErrorRegressions)
+	prometheus.MustRegister(ScrapeCycleFailures)
+	prometheus.MustRegister(PrunedErrors)
+	prometheus.MustRegister(PrunedOccurrences)
+	prometheus.MustRegister(DroppedEvents)
+	prometheus.MustRegister(Notifications)
 	prometheus.MustRegister(prometheus.NewBuildInfoCollector())
 }
@@ -0,0 +1,157 @@
+package notifier
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/periskop-dev/periskop/config"
+)
+
+// maxStackFrames is the number of frames of the stacktrace included in chat messages
+const maxStackFrames = 5
+
+// triggerTitles describe the triggers in chat messages
+var triggerTitles = map[string]string{
+	config.TriggerNewError:       "New error",
+	config.TriggerRegressed:      "Regressed error",
+	config.TriggerSeverity:       "Severe error",
+	config.TriggerCountThreshold: "Frequent error",
+}
+
+// slackMessage is a message of a Slack incoming webhook, made of Block Kit blocks
+type slackMessage struct {
+	// Text is shown in notifications and by clients that can't render blocks
+	Text   string       `json:"text"`
+	Blocks []slackBlock `json:"blocks"`
+}
+
+type slackBlock struct {
+	Type   string      `json:"type"`
+	Text   *slackText  `json:"text,omitempty"`
+	Fields []slackText `json:"fields,omitempty"`
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// newSlackMessage formats a notification as a Slack message
+func newSlackMessage(notification Notification) slackMessage {
+	title := fmt.Sprintf("%s in %s", triggerTitles[notification.Trigger], notification.Service)
+	heading := fmt.Sprintf("*%s*: `%s`", slackEscape(title), slackEscape(notification.AggregationKey))
+	if notification.Link != "" {
+		heading = fmt.Sprintf("*<%s|%s>*: `%s`", notification.Link, slackEscape(title),
+			slackEscape(notification.AggregationKey))
+	}
+	blocks := []slackBlock{
+		{Type: "section", Text: &slackText{Type: "mrkdwn", Text: heading}},
+		{Type: "section", Fields: []slackText{
+			{Type: "mrkdwn", Text: "*Severity*\n" + slackEscape(notification.Severity)},
+			{Type: "mrkdwn", Text: fmt.Sprintf("*Count*\n%d", notification.TotalCount)},
+		}},
+	}
+	if occurrence := notification.LatestError; occurrence != nil {
+		text := fmt.Sprintf("*%s*: %s", slackEscape(occurrence.Error.Class), slackEscape(occurrence.Error.Message))
+		if frames := topFrames(occurrence.Error.Stacktrace); frames != "" {
+			text += "\n```" + slackEscape(frames) + "```"
+		}
+		blocks = append(blocks, slackBlock{Type: "section", Text: &slackText{Type: "mrkdwn", Text: text}})
+	}
+	return slackMessage{Text: fmt.Sprintf("%s: %s", title, notification.AggregationKey), Blocks: blocks}
+}
+
+// slackEscape escapes the control characters of Slack mrkdwn
+func slackEscape(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+}
+
+// teamsMessage is a message of a Microsoft Teams incoming webhook, holding an Adaptive Card
+type teamsMessage struct {
+	Type        string            `json:"type"`
+	Attachments []teamsAttachment `json:"attachments"`
+}
+
+type teamsAttachment struct {
+	ContentType string    `json:"contentType"`
+	Content     teamsCard `json:"content"`
+}
+
+type teamsCard struct {
+	Schema  string         `json:"$schema"`
+	Type    string         `json:"type"`
+	Version string         `json:"version"`
+	Body    []teamsElement `json:"body"`
+	Actions []teamsAction  `json:"actions,omitempty"`
+}
+
+type teamsElement struct {
+	Type     string      `json:"type"`
+	Text     string      `json:"text,omitempty"`
+	Size     string      `json:"size,omitempty"`
+	Weight   string      `json:"weight,omitempty"`
+	FontType string      `json:"fontType,omitempty"`
+	Wrap     bool        `json:"wrap,omitempty"`
+	Facts    []teamsFact `json:"facts,omitempty"`
+}
+
+type teamsFact struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+}
+
+type teamsAction struct {
+	Type  string `json:"type"`
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+// newTeamsMessage formats a notification as a Teams message
+func newTeamsMessage(notification Notification) teamsMessage {
+	card := teamsCard{
+		Schema:  "http://adaptivecards.io/schemas/adaptive-card.json",
+		Type:    "AdaptiveCard",
+		Version: "1.4",
+		Body: []teamsElement{
+			{
+				Type:   "TextBlock",
+				Text:   fmt.Sprintf("%s in %s", triggerTitles[notification.Trigger], notification.Service),
+				Size:   "Large",
+				Weight: "Bolder",
+				Wrap:   true,
+			},
+			{Type: "FactSet", Facts: []teamsFact{
+				{Title: "Aggregation key", Value: notification.AggregationKey},
+				{Title: "Severity", Value: notification.Severity},
+				{Title: "Count", Value: fmt.Sprintf("%d", notification.TotalCount)},
+			}},
+		},
+	}
+	if occurrence := notification.LatestError; occurrence != nil {
+		card.Body = append(card.Body, teamsElement{
+			Type:   "TextBlock",
+			Text:   fmt.Sprintf("%s: %s", occurrence.Error.Class, occurrence.Error.Message),
+			Weight: "Bolder",
+			Wrap:   true,
+		})
+		if frames := topFrames(occurrence.Error.Stacktrace); frames != "" {
+			card.Body = append(card.Body, teamsElement{Type: "TextBlock", Text: frames, FontType: "Monospace",
+				Wrap: true})
+		}
+	}
+	if notification.Link != "" {
+		card.Actions = []teamsAction{{Type: "Action.OpenUrl", Title: "Open in Periskop", URL: notification.Link}}
+	}
+	return teamsMessage{
+		Type:        "message",
+		Attachments: []teamsAttachment{{ContentType: "application/vnd.microsoft.card.adaptive", Content: card}},
+	}
+}
+
+// topFrames returns the first frames of a stacktrace, one per line
+func topFrames(stacktrace []string) string {
+	if len(stacktrace) > maxStackFrames {
+		stacktrace = stacktrace[:maxStackFrames]
+	}
+	return strings.Join(stacktrace, "\n")
+}
@@ -0,0 +1,111 @@
+package notifier
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/periskop-dev/periskop/config"
+	"github.com/periskop-dev/periskop/events"
+	"github.com/periskop-dev/periskop/repository"
+)
+
+// newChatEvent returns the event of a new error with a stacktrace longer than the frames included in messages
+func newChatEvent() events.Event {
+	return events.Event{
+		Type:           events.EventNewError,
+		Service:        serviceName,
+		AggregationKey: "NullPointerException@<main>",
+		Severity:       "error",
+		TotalCount:     42,
+		LatestError: &repository.ErrorWithContext{Error: repository.ErrorInstance{
+			Class:      "NullPointerException",
+			Message:    "value is null",
+			Stacktrace: []string{"frame 0", "frame 1", "frame 2", "frame 3", "frame 4", "frame 5"},
+		}},
+	}
+}
+
+// receiveChatMessage sends an event to a webhook of the given format served by a local stand-in,
+// returning the received payload
+func receiveChatMessage(t *testing.T, format string) string {
+	payloads := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		payloads <- string(body)
+	}))
+	defer server.Close()
+
+	broker := events.NewBroker()
+	n, err := New(serviceName, []config.Notification{{
+		URL:      server.URL,
+		Triggers: []string{config.TriggerNewError},
+		Format:   format,
+	}}, "https://periskop.example.com/", broker)
+	if err != nil {
+		t.Fatalf("Fail to create notifier: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go n.Run(ctx)
+
+	broker.Publish(newChatEvent())
+	select {
+	case payload := <-payloads:
+		return payload
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected a %s message", format)
+	}
+	return ""
+}
+
+func TestSlackMessage(t *testing.T) {
+	payload := receiveChatMessage(t, config.NotificationFormatSlack)
+	message := slackMessage{}
+	if err := json.Unmarshal([]byte(payload), &message); err != nil || len(message.Blocks) != 3 {
+		t.Fatalf("Unexpected slack message %s, %v", payload, err)
+	}
+	heading := message.Blocks[0].Text.Text
+	expected := "*<https://periskop.example.com/#/test-service/errors/NullPointerException@%3Cmain%3E|" +
+		"New error in test-service>*: `NullPointerException@&lt;main&gt;`"
+	if heading != expected {
+		t.Errorf("Expected heading %s, Found %s", expected, heading)
+	}
+	if fields := message.Blocks[1].Fields; fields[0].Text != "*Severity*\nerror" || fields[1].Text != "*Count*\n42" {
+		t.Errorf("Unexpected fields %+v", fields)
+	}
+	details := message.Blocks[2].Text.Text
+	if !strings.HasPrefix(details, "*NullPointerException*: value is null\n```frame 0") ||
+		!strings.Contains(details, "frame 4") || strings.Contains(details, "frame 5") {
+		t.Errorf("Expected the class, message and top frames, Found %s", details)
+	}
+}
+
+func TestTeamsMessage(t *testing.T) {
+	payload := receiveChatMessage(t, config.NotificationFormatTeams)
+	message := teamsMessage{}
+	if err := json.Unmarshal([]byte(payload), &message); err != nil || len(message.Attachments) != 1 {
+		t.Fatalf("Unexpected teams message %s, %v", payload, err)
+	}
+	card := message.Attachments[0].Content
+	if card.Type != "AdaptiveCard" || len(card.Body) != 4 || card.Body[0].Text != "New error in test-service" {
+		t.Fatalf("Unexpected card %+v", card)
+	}
+	facts := card.Body[1].Facts
+	if facts[0].Value != "NullPointerException@<main>" || facts[1].Value != "error" || facts[2].Value != "42" {
+		t.Errorf("Unexpected facts %+v", facts)
+	}
+	if card.Body[2].Text != "NullPointerException: value is null" ||
+		card.Body[3].Text != "frame 0\nframe 1\nframe 2\nframe 3\nframe 4" {
+		t.Errorf("Expected the class, message and top frames, Found %+v", card.Body[2:])
+	}
+	link := "https://periskop.example.com/#/test-service/errors/NullPointerException@%3Cmain%3E"
+	if len(card.Actions) != 1 || card.Actions[0].URL != link {
+		t.Errorf("Expected a link to %s, Found %+v", link, card.Actions)
+	}
+}
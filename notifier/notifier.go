@@ -0,0 +1,291 @@
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/periskop-dev/periskop/config"
+	"github.com/periskop-dev/periskop/events"
+	"github.com/periskop-dev/periskop/metrics"
+)
+
+const (
+	// eventsBufferSize is the number of events waiting to be routed to the webhooks, so bursts of events of a
+	// scrape aren't dropped
+	eventsBufferSize = 4096
+	// queueSize is the number of notifications waiting to be sent per webhook, newer ones are dropped once it's full
+	queueSize = 100
+	// requestTimeout is how long a webhook request is waited for before retrying it
+	requestTimeout = 10 * time.Second
+	// maxRetryBackoff bounds the wait between retries
+	maxRetryBackoff = time.Minute
+)
+
+// Notification is the payload sent to the webhooks: the event of an error and the trigger it matched
+type Notification struct {
+	Trigger string `json:"trigger"`
+	// Link is the URL of the error in the UI, when the external URL of Periskop is configured
+	Link string `json:"link,omitempty"`
+	events.Event
+}
+
+// templateFuncs are the functions available to the templates of the payloads,
+// json encodes a value so it can be safely embedded in the payload
+var templateFuncs = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		encoded, err := json.Marshal(value)
+		return string(encoded), err
+	},
+}
+
+// Notifier sends the notifications of the errors of a service to its webhooks
+type Notifier struct {
+	serviceName  string
+	externalURL  string
+	webhooks     []*webhook
+	subscription *events.Subscription
+	client       *http.Client
+}
+
+// webhook is a configured notification along with its queue of notifications to send
+type webhook struct {
+	config   config.Notification
+	template *template.Template
+	queue    chan Notification
+	// sent is when every trigger and error was last notified, it's only accessed by Run
+	sent       map[string]time.Time
+	lastExpiry time.Time
+}
+
+// New creates a notifier of the configured notifications of a service, subscribed to the events of the service.
+// The external URL of Periskop is used to link the errors, they aren't linked when it's empty.
+func New(serviceName string, notifications []config.Notification, externalURL string,
+	broker *events.Broker) (*Notifier, error) {
+	webhooks := make([]*webhook, 0, len(notifications))
+	for _, notification := range notifications {
+		w := &webhook{
+			config: notification,
+			queue:  make(chan Notification, queueSize),
+			sent:   make(map[string]time.Time),
+		}
+		if notification.Template != "" {
+			var err error
+			w.template, err = template.New(notification.URL).Funcs(templateFuncs).Parse(notification.Template)
+			if err != nil {
+				return nil, fmt.Errorf("invalid notification template: %w", err)
+			}
+		}
+		webhooks = append(webhooks, w)
+	}
+	return &Notifier{
+		serviceName:  serviceName,
+		externalURL:  strings.TrimSuffix(externalURL, "/"),
+		webhooks:     webhooks,
+		subscription: broker.SubscribeBuffered(serviceName, eventsBufferSize),
+		client:       &http.Client{Timeout: requestTimeout},
+	}, nil
+}
+
+// Run sends the notifications triggered by the events of the service until the context is cancelled
+func (n *Notifier) Run(ctx context.Context) {
+	defer n.subscription.Close()
+	for _, w := range n.webhooks {
+		go n.deliver(ctx, w)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, open := <-n.subscription.Events():
+			if !open {
+				return
+			}
+			n.notify(event, time.Now())
+		}
+	}
+}
+
+// notify queues the notification of an event to every webhook routing its severity with a matching trigger, unless
+// the error was already notified for that trigger within the dedup window. Only one notification is sent per event
+// and webhook.
+func (n *Notifier) notify(event events.Event, now time.Time) {
+	for _, w := range n.webhooks {
+		if !w.routes(event.Severity) {
+			continue
+		}
+		w.expire(now)
+		for _, trigger := range w.triggers(event) {
+			key := trigger + ":" + event.AggregationKey
+			if sentAt, sent := w.sent[key]; sent && now.Sub(sentAt) < w.config.GetDedupWindow() {
+				metrics.Notifications.WithLabelValues(n.serviceName, trigger, "deduplicated").Inc()
+				continue
+			}
+			select {
+			case w.queue <- Notification{Trigger: trigger, Link: n.link(event), Event: event}:
+				w.sent[key] = now
+			default:
+				metrics.Notifications.WithLabelValues(n.serviceName, trigger, "dropped").Inc()
+			}
+			break
+		}
+	}
+}
+
+// link returns the URL of the error of an event in the UI
+func (n *Notifier) link(event events.Event) string {
+	if n.externalURL == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/#/%s/errors/%s", n.externalURL, url.PathEscape(event.Service),
+		url.PathEscape(event.AggregationKey))
+}
+
+// routes returns whether the errors of a severity are sent to the webhook
+func (w *webhook) routes(severity string) bool {
+	if len(w.config.Severities) == 0 {
+		return true
+	}
+	for _, routed := range w.config.Severities {
+		if severity == routed {
+			return true
+		}
+	}
+	return false
+}
+
+// triggers returns the configured triggers matched by an event, in the configured order
+func (w *webhook) triggers(event events.Event) []string {
+	occurred := event.Type == events.EventNewError || event.Type == events.EventCountChanged
+	triggers := []string{}
+	for _, trigger := range w.config.Triggers {
+		var matches bool
+		switch trigger {
+		case config.TriggerNewError:
+			matches = event.Type == events.EventNewError
+		case config.TriggerRegressed:
+			matches = event.Type == events.EventRegressed
+		case config.TriggerSeverity:
+			matches = occurred &&
+				config.SeverityRank(event.Severity) >= config.SeverityRank(w.config.SeverityThreshold)
+		case config.TriggerCountThreshold:
+			matches = occurred && event.PreviousCount < w.config.CountThreshold &&
+				event.TotalCount >= w.config.CountThreshold
+		}
+		if matches {
+			triggers = append(triggers, trigger)
+		}
+	}
+	return triggers
+}
+
+// expire forgets the notifications sent before the dedup window, at most once per window
+func (w *webhook) expire(now time.Time) {
+	window := w.config.GetDedupWindow()
+	if now.Sub(w.lastExpiry) < window {
+		return
+	}
+	for key, sentAt := range w.sent {
+		if now.Sub(sentAt) >= window {
+			delete(w.sent, key)
+		}
+	}
+	w.lastExpiry = now
+}
+
+// deliver sends the queued notifications of a webhook until the context is cancelled
+func (n *Notifier) deliver(ctx context.Context, w *webhook) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case notification := <-w.queue:
+			result := "sent"
+			if err := n.send(ctx, w, notification); err != nil {
+				log.Printf("%s: failed to notify %s of error %s: %s", n.serviceName, w.config.URL,
+					notification.AggregationKey, err)
+				result = "failed"
+			}
+			metrics.Notifications.WithLabelValues(n.serviceName, notification.Trigger, result).Inc()
+		}
+	}
+}
+
+// send posts a notification to a webhook, retrying with an exponential backoff on network errors,
+// server errors and rate limits
+func (n *Notifier) send(ctx context.Context, w *webhook, notification Notification) error {
+	payload, err := w.payload(notification)
+	if err != nil {
+		return err
+	}
+	backoff := w.config.GetRetryBackoff()
+	for attempt := 0; ; attempt++ {
+		retry, err := n.post(ctx, w, payload)
+		if err == nil || !retry || attempt >= w.config.GetMaxRetries() {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// payload formats a notification as a chat message, renders the template of the webhook, or encodes the
+// notification as JSON without template
+func (w *webhook) payload(notification Notification) ([]byte, error) {
+	switch w.config.GetFormat() {
+	case config.NotificationFormatSlack:
+		return json.Marshal(newSlackMessage(notification))
+	case config.NotificationFormatTeams:
+		return json.Marshal(newTeamsMessage(notification))
+	}
+	if w.template == nil {
+		return json.Marshal(notification)
+	}
+	payload := bytes.Buffer{}
+	if err := w.template.Execute(&payload, notification); err != nil {
+		return nil, err
+	}
+	if !json.Valid(payload.Bytes()) {
+		return nil, fmt.Errorf("notification template rendered invalid JSON: %s", payload.String())
+	}
+	return payload.Bytes(), nil
+}
+
+// post sends a payload to a webhook, returning whether the request can be retried when it fails
+func (n *Notifier) post(ctx context.Context, w *webhook, payload []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.config.URL, bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	for name, value := range w.config.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body) // nolint[errcheck]
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("webhook returned HTTP status %s", resp.Status)
+}
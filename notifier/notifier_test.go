@@ -0,0 +1,197 @@
+package notifier
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/periskop-dev/periskop/config"
+	"github.com/periskop-dev/periskop/events"
+)
+
+const serviceName = "test-service"
+
+func newTestNotifier(t *testing.T, notifications ...config.Notification) *Notifier {
+	n, err := New(serviceName, notifications, "", events.NewBroker())
+	if err != nil {
+		t.Fatalf("Fail to create notifier: %s", err)
+	}
+	return n
+}
+
+// queued returns the triggers of the notifications queued for the first webhook
+func queued(n *Notifier) []string {
+	triggers := []string{}
+	for len(n.webhooks[0].queue) > 0 {
+		notification := <-n.webhooks[0].queue
+		triggers = append(triggers, notification.Trigger)
+	}
+	return triggers
+}
+
+func TestNotifierTriggers(t *testing.T) {
+	n := newTestNotifier(t, config.Notification{
+		URL: "http://localhost/webhook",
+		Triggers: []string{config.TriggerNewError, config.TriggerRegressed, config.TriggerSeverity,
+			config.TriggerCountThreshold},
+		SeverityThreshold: "error",
+		CountThreshold:    100,
+	})
+	now := time.Now()
+	n.notify(events.Event{Type: events.EventNewError, AggregationKey: "new", Severity: "warning"}, now)
+	n.notify(events.Event{Type: events.EventRegressed, AggregationKey: "regressed"}, now)
+	n.notify(events.Event{Type: events.EventCountChanged, AggregationKey: "severe", Severity: "error"}, now)
+	n.notify(events.Event{Type: events.EventCountChanged, AggregationKey: "below", Severity: "info",
+		PreviousCount: 10, TotalCount: 99}, now)
+	n.notify(events.Event{Type: events.EventCountChanged, AggregationKey: "crossing", Severity: "info",
+		PreviousCount: 99, TotalCount: 120}, now)
+	n.notify(events.Event{Type: events.EventCountChanged, AggregationKey: "above", Severity: "info",
+		PreviousCount: 120, TotalCount: 130}, now)
+	n.notify(events.Event{Type: events.EventResolved, AggregationKey: "resolved", Severity: "error"}, now)
+
+	expected := []string{config.TriggerNewError, config.TriggerRegressed, config.TriggerSeverity,
+		config.TriggerCountThreshold}
+	if triggers := queued(n); !reflect.DeepEqual(triggers, expected) {
+		t.Errorf("Expected notifications %v, Found %v", expected, triggers)
+	}
+}
+
+func TestNotifierDeduplicates(t *testing.T) {
+	n := newTestNotifier(t, config.Notification{
+		URL:               "http://localhost/webhook",
+		Triggers:          []string{config.TriggerSeverity, config.TriggerCountThreshold},
+		SeverityThreshold: "warning",
+		CountThreshold:    10,
+		DedupWindow:       time.Hour,
+	})
+	now := time.Now()
+	n.notify(events.Event{Type: events.EventNewError, AggregationKey: "key", Severity: "error", TotalCount: 1}, now)
+	// the severity was already notified, but not the count threshold
+	n.notify(events.Event{Type: events.EventCountChanged, AggregationKey: "key", Severity: "error",
+		PreviousCount: 1, TotalCount: 10}, now.Add(time.Minute))
+	n.notify(events.Event{Type: events.EventCountChanged, AggregationKey: "key", Severity: "error",
+		PreviousCount: 10, TotalCount: 11}, now.Add(time.Minute))
+	n.notify(events.Event{Type: events.EventCountChanged, AggregationKey: "key", Severity: "error",
+		PreviousCount: 11, TotalCount: 12}, now.Add(time.Hour))
+
+	expected := []string{config.TriggerSeverity, config.TriggerCountThreshold, config.TriggerSeverity}
+	if triggers := queued(n); !reflect.DeepEqual(triggers, expected) {
+		t.Errorf("Expected notifications %v, Found %v", expected, triggers)
+	}
+}
+
+func TestNotifierRoutesSeverities(t *testing.T) {
+	n := newTestNotifier(t, config.Notification{
+		URL:        "http://localhost/webhook",
+		Triggers:   []string{config.TriggerNewError},
+		Severities: []string{"warning", "error"},
+	})
+	now := time.Now()
+	for _, severity := range []string{"info", "warning", "error"} {
+		n.notify(events.Event{Type: events.EventNewError, AggregationKey: severity, Severity: severity}, now)
+	}
+	keys := []string{}
+	for len(n.webhooks[0].queue) > 0 {
+		notification := <-n.webhooks[0].queue
+		keys = append(keys, notification.AggregationKey)
+	}
+	if !reflect.DeepEqual(keys, []string{"warning", "error"}) {
+		t.Errorf("Expected only warnings and errors, Found %v", keys)
+	}
+}
+
+func TestNotifierRetriesTemplatedPayload(t *testing.T) {
+	requests := make(chan *http.Request, 10)
+	payloads := make(chan []byte, 10)
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		requests <- req
+		payloads <- body
+	}))
+	defer server.Close()
+
+	broker := events.NewBroker()
+	n, err := New(serviceName, []config.Notification{{
+		URL:          server.URL,
+		Triggers:     []string{config.TriggerNewError},
+		Template:     `{"text": {{json .AggregationKey}}, "count": {{.TotalCount}}}`,
+		Headers:      map[string]string{"Authorization": "Bearer token"},
+		RetryBackoff: time.Millisecond,
+	}}, "", broker)
+	if err != nil {
+		t.Fatalf("Fail to create notifier: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go n.Run(ctx)
+
+	broker.Publish(events.Event{Type: events.EventNewError, Service: serviceName, AggregationKey: `"quoted"`,
+		TotalCount: 2})
+	select {
+	case req := <-requests:
+		if req.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("Expected the configured headers, Found %v", req.Header)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the notification to be retried until it's sent")
+	}
+	payload := make(map[string]interface{})
+	if err := json.Unmarshal(<-payloads, &payload); err != nil || payload["text"] != `"quoted"` ||
+		payload["count"] != float64(2) {
+		t.Errorf("Unexpected payload %v, %v", payload, err)
+	}
+}
+
+func TestNotifierDoesNotRetryClientErrors(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	n := newTestNotifier(t, config.Notification{URL: server.URL, Triggers: []string{config.TriggerNewError},
+		RetryBackoff: time.Millisecond})
+	err := n.send(context.Background(), n.webhooks[0], Notification{Trigger: config.TriggerNewError})
+	if err == nil || attempts != 1 {
+		t.Errorf("Expected a single failed attempt, Found %d attempts and error %v", attempts, err)
+	}
+}
+
+func TestNotifierWithoutRetries(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	maxRetries := 0
+	n := newTestNotifier(t, config.Notification{URL: server.URL, Triggers: []string{config.TriggerNewError},
+		MaxRetries: &maxRetries, RetryBackoff: time.Millisecond})
+	err := n.send(context.Background(), n.webhooks[0], Notification{Trigger: config.TriggerNewError})
+	if err == nil || attempts != 1 {
+		t.Errorf("Expected a single failed attempt, Found %d attempts and error %v", attempts, err)
+	}
+}
+
+func TestNotifierInvalidTemplate(t *testing.T) {
+	if _, err := New(serviceName, []config.Notification{{Template: "{{.Unclosed"}}, "", events.NewBroker()); err == nil {
+		t.Errorf("Expected an error parsing the template")
+	}
+	n := newTestNotifier(t, config.Notification{Template: `{"text": {{.AggregationKey}}}`})
+	if _, err := n.webhooks[0].payload(Notification{Event: events.Event{AggregationKey: "unquoted"}}); err == nil {
+		t.Errorf("Expected an error rendering invalid JSON")
+	}
+}
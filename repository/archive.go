@@ -0,0 +1,165 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// archiveVersion is the version of the archive format, archives of other versions aren't imported
+const archiveVersion = 1
+
+// Types of the records of an archive
+const (
+	archiveHeader       = "header"
+	archiveError        = "error"
+	archiveScraperState = "scraper_state"
+	archiveTargets      = "targets"
+)
+
+// archiveRecord is a line of an archive. Archives are newline delimited json: a header followed by a record per
+// error, scraper state and list of targets of every service.
+type archiveRecord struct {
+	Type string `json:"type"`
+	// Version and CreatedAt are only set in the header
+	Version      int             `json:"version,omitempty"`
+	CreatedAt    int64           `json:"created_at,omitempty"`
+	Service      string          `json:"service,omitempty"`
+	Error        *ErrorAggregate `json:"error,omitempty"`
+	ScraperState *ScraperState   `json:"scraper_state,omitempty"`
+	Targets      []Target        `json:"targets,omitempty"`
+}
+
+// ArchiveSummary is the number of services and errors exported or imported
+type ArchiveSummary struct {
+	Services int
+	Errors   int
+}
+
+// Export writes every error, with its status and occurrences, the scraper state and the targets of every service
+// of a repository to an archive. Occurrence histograms aren't exported.
+func Export(ctx context.Context, r ErrorsRepository, w io.Writer) (ArchiveSummary, error) {
+	summary := ArchiveSummary{}
+	encoder := json.NewEncoder(w)
+	err := encoder.Encode(archiveRecord{Type: archiveHeader, Version: archiveVersion, CreatedAt: time.Now().Unix()})
+	if err != nil {
+		return summary, err
+	}
+
+	services, err := r.GetServices(ctx)
+	if err != nil {
+		return summary, err
+	}
+	targets, err := r.GetTargets(ctx)
+	if err != nil {
+		return summary, err
+	}
+	for serviceName := range targets {
+		services = append(services, serviceName)
+	}
+	sort.Strings(services)
+
+	for i, serviceName := range services {
+		if i > 0 && services[i-1] == serviceName {
+			continue
+		}
+		summary.Services++
+		errorAggregates, err := r.ExportErrors(ctx, serviceName)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return summary, err
+		}
+		for j := range errorAggregates {
+			record := archiveRecord{Type: archiveError, Service: serviceName, Error: &errorAggregates[j]}
+			if err := encoder.Encode(record); err != nil {
+				return summary, err
+			}
+			summary.Errors++
+		}
+
+		state, err := r.GetScraperState(ctx, serviceName)
+		if err == nil {
+			err = encoder.Encode(archiveRecord{Type: archiveScraperState, Service: serviceName, ScraperState: &state})
+		}
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return summary, err
+		}
+		if serviceTargets, exists := targets[serviceName]; exists {
+			err := encoder.Encode(archiveRecord{Type: archiveTargets, Service: serviceName, Targets: serviceTargets})
+			if err != nil {
+				return summary, err
+			}
+		}
+	}
+	return summary, nil
+}
+
+// Import stores the contents of an archive written by Export in a repository. Stored errors with the same
+// aggregation key are replaced, errors are imported in batches.
+func Import(ctx context.Context, r ErrorsRepository, reader io.Reader) (ArchiveSummary, error) {
+	summary := ArchiveSummary{}
+	decoder := json.NewDecoder(reader)
+	header := archiveRecord{}
+	if err := decoder.Decode(&header); err != nil {
+		return summary, fmt.Errorf("invalid archive: %w", err)
+	}
+	if header.Type != archiveHeader || header.Version != archiveVersion {
+		return summary, fmt.Errorf("unsupported archive version %d, expected %d", header.Version, archiveVersion)
+	}
+
+	services := make(map[string]bool)
+	batchService := ""
+	batch := []ErrorAggregate{}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := r.ImportErrors(ctx, batchService, batch); err != nil {
+			return err
+		}
+		summary.Errors += len(batch)
+		batch = []ErrorAggregate{}
+		return nil
+	}
+
+	for {
+		record := archiveRecord{}
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return summary, fmt.Errorf("invalid archive: %w", err)
+		}
+		if record.Service == "" {
+			return summary, fmt.Errorf("invalid archive: %s record without service", record.Type)
+		}
+		services[record.Service] = true
+		if record.Service != batchService || len(batch) >= batchSize {
+			if err := flush(); err != nil {
+				return summary, err
+			}
+			batchService = record.Service
+		}
+
+		switch {
+		case record.Type == archiveError && record.Error != nil:
+			batch = append(batch, *record.Error)
+		case record.Type == archiveScraperState && record.ScraperState != nil:
+			err = r.StoreScraperState(ctx, record.Service, *record.ScraperState)
+		case record.Type == archiveTargets:
+			err = r.StoreTargets(ctx, record.Service, record.Targets)
+		default:
+			err = fmt.Errorf("invalid archive: unknown %s record", record.Type)
+		}
+		if err != nil {
+			return summary, err
+		}
+	}
+	err := flush()
+	summary.Services = len(services)
+	return summary, err
+}
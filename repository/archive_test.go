@@ -0,0 +1,81 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExportImportBetweenRepositories(t *testing.T) {
+	ctx := context.Background()
+	occurrences := []ErrorWithContext{
+		{UUID: "uuid1", Timestamp: 1, Error: ErrorInstance{Class: "Error", Stacktrace: []string{"line 1"}}},
+		{UUID: "uuid0", Timestamp: 0, Error: ErrorInstance{Class: "Error", Stacktrace: []string{"line 1"}}},
+	}
+	source := NewMemoryRepository()
+	source.ReplaceErrors(ctx, serviceName, []ErrorAggregate{ // nolint[errcheck]
+		{AggregationKey: "test-error-0", TotalCount: 2, Severity: "error", LatestErrors: occurrences},
+		{AggregationKey: "test-error-1", TotalCount: 1, Severity: "warning", LatestErrors: []ErrorWithContext{}},
+	})
+	source.SetErrorStatus(ctx, serviceName, "test-error-1", // nolint[errcheck]
+		StatusChange{Status: StatusResolved, Actor: "alice", Note: "fixed"})
+	source.StoreScraperState(ctx, serviceName, ScraperState{ // nolint[errcheck]
+		TargetErrorsCount: map[string]map[string]int{"target": {"test-error-0": 2}},
+		ErrorAggregates:   []ErrorAggregate{},
+	})
+	source.StoreTargets(ctx, "other-service", []Target{{Endpoint: "10.0.0.1:8080"}}) // nolint[errcheck]
+
+	archive := bytes.Buffer{}
+	summary, err := Export(ctx, source, &archive)
+	if err != nil || summary != (ArchiveSummary{Services: 2, Errors: 2}) {
+		t.Fatalf("Unexpected export %+v, %v", summary, err)
+	}
+	expectedErrors, _ := source.ExportErrors(ctx, serviceName)
+
+	repositories := map[string]ErrorsRepository{
+		"memory": NewMemoryRepository(),
+		"orm":    newORMTestRepository(t, newSQLiteMemory()),
+		"bolt":   newBoltTestRepository(t),
+	}
+	for name, r := range repositories {
+		t.Run(name, func(t *testing.T) {
+			summary, err := Import(ctx, r, bytes.NewReader(archive.Bytes()))
+			if err != nil || summary != (ArchiveSummary{Services: 2, Errors: 2}) {
+				t.Fatalf("Unexpected import %+v, %v", summary, err)
+			}
+			errors, _ := r.ExportErrors(ctx, serviceName)
+			byKey := make(map[string]ErrorAggregate)
+			for _, errorAggregate := range errors {
+				byKey[errorAggregate.AggregationKey] = errorAggregate
+			}
+			for _, expected := range expectedErrors {
+				if !reflect.DeepEqual(byKey[expected.AggregationKey], expected) {
+					t.Errorf("Expected error %+v, Found %+v", expected, byKey[expected.AggregationKey])
+				}
+			}
+			if state, _ := r.GetScraperState(ctx, serviceName); state.TargetErrorsCount["target"]["test-error-0"] != 2 {
+				t.Errorf("Unexpected scraper state %+v", state)
+			}
+			if targets, _ := r.GetTargets(ctx); len(targets["other-service"]) != 1 {
+				t.Errorf("Unexpected targets %+v", targets)
+			}
+		})
+	}
+}
+
+func TestImportInvalidArchive(t *testing.T) {
+	ctx := context.Background()
+	archives := []string{
+		"",
+		`{"type": "header", "version": 2}`,
+		`{"type": "header", "version": 1}` + "\n" + `{"type": "error"}`,
+		`{"type": "header", "version": 1}` + "\n" + `{"type": "unknown", "service": "test-service"}`,
+	}
+	for _, archive := range archives {
+		if _, err := Import(ctx, NewMemoryRepository(), strings.NewReader(archive)); err == nil {
+			t.Errorf("Expected an error importing archive %s", archive)
+		}
+	}
+}
@@ -0,0 +1,619 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/periskop-dev/periskop/config"
+	"github.com/periskop-dev/periskop/metrics"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Top level buckets of the bolt repository. Errors and occurrences are stored in a nested bucket per service,
+// keyed by aggregation key, so the errors of a service are read with a single cursor.
+var (
+	// errors -> service name -> aggregation key -> json ErrorAggregate, including its status
+	boltErrorsBucket = []byte("errors")
+	// occurrences -> service name -> aggregation key -> resolution + bucket start -> occurrences
+	boltOccurrencesBucket = []byte("occurrences")
+	// scraper_states -> service name -> json ScraperState
+	boltScraperStatesBucket = []byte("scraper_states")
+)
+
+type boltRepository struct {
+	DB *bolt.DB
+	targetsRepository
+}
+
+// NewBoltRepository creates a repository stored in a bolt database file, which needs no cgo nor external database
+func NewBoltRepository(path string) (ErrorsRepository, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bolt database %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltErrorsBucket, boltOccurrencesBucket, boltScraperStatesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create bolt buckets: %w", err)
+	}
+	return &boltRepository{DB: db}, nil
+}
+
+// serviceErrors returns the bucket of errors of a service, nil if the service has no errors
+func serviceErrors(tx *bolt.Tx, serviceName string) *bolt.Bucket {
+	return tx.Bucket(boltErrorsBucket).Bucket([]byte(serviceName))
+}
+
+func getError(errorsBucket *bolt.Bucket, key string) (ErrorAggregate, bool, error) {
+	errorAggregate := ErrorAggregate{}
+	value := errorsBucket.Get([]byte(key))
+	if value == nil {
+		return errorAggregate, false, nil
+	}
+	err := json.Unmarshal(value, &errorAggregate)
+	return errorAggregate, true, err
+}
+
+func putError(errorsBucket *bolt.Bucket, errorAggregate ErrorAggregate) error {
+	value, err := json.Marshal(errorAggregate)
+	if err != nil {
+		return err
+	}
+	return errorsBucket.Put([]byte(errorAggregate.AggregationKey), value)
+}
+
+// GetErrors fetches the last numberOfErrors of each aggregation of errors for the given service.
+// Resolved, ignored and snoozed errors are not listed.
+func (r *boltRepository) GetErrors(ctx context.Context, serviceName string,
+	numberOfErrors int) ([]ErrorAggregate, error) {
+	errorAggregates := []ErrorAggregate{}
+	found := false
+	err := r.DB.View(func(tx *bolt.Tx) error {
+		errorsBucket := serviceErrors(tx, serviceName)
+		if errorsBucket == nil {
+			return nil
+		}
+		found = true
+		return errorsBucket.ForEach(func(key, value []byte) error {
+			errorAggregate := ErrorAggregate{}
+			if err := json.Unmarshal(value, &errorAggregate); err != nil {
+				return err
+			}
+			if !errorAggregate.IsVisible() {
+				return nil
+			}
+			if errorAggregate.Status == "" {
+				errorAggregate.Status = StatusOpen
+			}
+			if len(errorAggregate.LatestErrors) > numberOfErrors {
+				errorAggregate.LatestErrors = errorAggregate.LatestErrors[:numberOfErrors]
+			}
+			errorAggregates = append(errorAggregates, errorAggregate)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		metrics.ServiceErrors.WithLabelValues("service_not_found").Inc()
+		return nil, fmt.Errorf("service %s %w", serviceName, ErrNotFound)
+	}
+	return errorAggregates, nil
+}
+
+// QueryErrors lists the errors of a service like GetErrors, filtered, sorted and paginated by the query
+func (r *boltRepository) QueryErrors(ctx context.Context, serviceName string, query ErrorsQuery) (ErrorsPage, error) {
+	errorAggregates, err := r.ExportErrors(ctx, serviceName)
+	if errors.Is(err, ErrNotFound) {
+		metrics.ServiceErrors.WithLabelValues("service_not_found").Inc()
+	}
+	if err != nil {
+		return ErrorsPage{}, err
+	}
+	for i := range errorAggregates {
+		if errorAggregates[i].Status == "" {
+			errorAggregates[i].Status = StatusOpen
+		}
+	}
+	return queryErrors(errorAggregates, query)
+}
+
+// GetError fetches an error of a service whatever its status, with its last numberOfErrors occurrences
+func (r *boltRepository) GetError(ctx context.Context, serviceName string, key string,
+	numberOfErrors int) (ErrorAggregate, error) {
+	errorAggregate, err := r.findError(serviceName, key)
+	if err != nil {
+		return ErrorAggregate{}, err
+	}
+	if len(errorAggregate.LatestErrors) > numberOfErrors {
+		errorAggregate.LatestErrors = errorAggregate.LatestErrors[:numberOfErrors]
+	}
+	return errorAggregate, nil
+}
+
+// GetOccurrences lists the stored occurrences of an error sorted by timestamp, newest first, paginated by the query
+func (r *boltRepository) GetOccurrences(ctx context.Context, serviceName string, key string,
+	query OccurrencesQuery) (OccurrencesPage, error) {
+	errorAggregate, err := r.findError(serviceName, key)
+	if err != nil {
+		return OccurrencesPage{}, err
+	}
+	return queryOccurrences(errorAggregate.LatestErrors, query)
+}
+
+// findError fetches an error of a service with its status
+func (r *boltRepository) findError(serviceName string, key string) (ErrorAggregate, error) {
+	errorAggregate := ErrorAggregate{}
+	err := r.DB.View(func(tx *bolt.Tx) error {
+		exists := false
+		if errorsBucket := serviceErrors(tx, serviceName); errorsBucket != nil {
+			var err error
+			if errorAggregate, exists, err = getError(errorsBucket, key); err != nil {
+				return err
+			}
+		}
+		if !exists {
+			return fmt.Errorf("error %s of service %s %w", key, serviceName, ErrNotFound)
+		}
+		return nil
+	})
+	if errorAggregate.Status == "" {
+		errorAggregate.ErrorStatus = NewErrorStatus()
+	}
+	return errorAggregate, err
+}
+
+// ReplaceErrors stores the errors of a service that are new or have more occurrences than before,
+// keeping their status
+func (r *boltRepository) ReplaceErrors(ctx context.Context, serviceName string, errors []ErrorAggregate) error {
+	err := r.DB.Update(func(tx *bolt.Tx) error {
+		errorsBucket, err := tx.Bucket(boltErrorsBucket).CreateBucketIfNotExists([]byte(serviceName))
+		if err != nil {
+			return err
+		}
+		for _, errorAggregate := range errors {
+			stored, exists, err := getError(errorsBucket, errorAggregate.AggregationKey)
+			if err != nil {
+				return err
+			}
+			if exists && errorAggregate.TotalCount <= stored.TotalCount {
+				continue
+			}
+			errorAggregate.ErrorStatus = NewErrorStatus()
+			if exists {
+				errorAggregate.ErrorStatus = stored.ErrorStatus
+			}
+			if err := putError(errorsBucket, errorAggregate); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		metrics.ServiceErrors.WithLabelValues("replace_errors").Inc()
+		return fmt.Errorf("failed to store errors of service %s: %w", serviceName, err)
+	}
+	return nil
+}
+
+// ExportErrors fetches every error of a service with its status and all its stored occurrences
+func (r *boltRepository) ExportErrors(ctx context.Context, serviceName string) ([]ErrorAggregate, error) {
+	errorAggregates := []ErrorAggregate{}
+	err := r.DB.View(func(tx *bolt.Tx) error {
+		errorsBucket := serviceErrors(tx, serviceName)
+		if errorsBucket == nil {
+			return fmt.Errorf("service %s %w", serviceName, ErrNotFound)
+		}
+		return errorsBucket.ForEach(func(key, value []byte) error {
+			errorAggregate := ErrorAggregate{}
+			if err := json.Unmarshal(value, &errorAggregate); err != nil {
+				return err
+			}
+			errorAggregates = append(errorAggregates, errorAggregate)
+			return nil
+		})
+	})
+	return errorAggregates, err
+}
+
+// ImportErrors stores errors of a service with their status, replacing the stored errors with the same
+// aggregation key
+func (r *boltRepository) ImportErrors(ctx context.Context, serviceName string, errors []ErrorAggregate) error {
+	err := r.DB.Update(func(tx *bolt.Tx) error {
+		errorsBucket, err := tx.Bucket(boltErrorsBucket).CreateBucketIfNotExists([]byte(serviceName))
+		if err != nil {
+			return err
+		}
+		for _, errorAggregate := range errors {
+			if err := putError(errorsBucket, errorAggregate); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to import errors of service %s: %w", serviceName, err)
+	}
+	return nil
+}
+
+// GetServices fetches the list of unique services, sorted by name
+func (r *boltRepository) GetServices(ctx context.Context) ([]string, error) {
+	services := make([]string, 0)
+	err := r.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltErrorsBucket).ForEach(func(key, value []byte) error {
+			services = append(services, string(key))
+			return nil
+		})
+	})
+	return services, err
+}
+
+// ResolveError changes the status of the error to resolved
+func (r *boltRepository) ResolveError(ctx context.Context, serviceName string, key string) error {
+	return r.SetErrorStatus(ctx, serviceName, key, StatusChange{Status: StatusResolved})
+}
+
+// RemoveResolved reopens a resolved error
+func (r *boltRepository) RemoveResolved(ctx context.Context, serviceName string, key string) error {
+	resolved, err := r.SearchResolved(ctx, serviceName, key)
+	if err != nil || !resolved {
+		return err
+	}
+	return r.SetErrorStatus(ctx, serviceName, key, StatusChange{Status: StatusOpen})
+}
+
+// SearchResolved searches if an error is resolved
+func (r *boltRepository) SearchResolved(ctx context.Context, serviceName string, key string) (bool, error) {
+	status, err := r.GetErrorStatus(ctx, serviceName, key)
+	return status.Status == StatusResolved, err
+}
+
+// GetErrorStatus fetches the status of an error, errors are open until their status changes
+func (r *boltRepository) GetErrorStatus(ctx context.Context, serviceName string, key string) (ErrorStatus, error) {
+	status := NewErrorStatus()
+	err := r.DB.View(func(tx *bolt.Tx) error {
+		errorsBucket := serviceErrors(tx, serviceName)
+		if errorsBucket == nil {
+			return nil
+		}
+		errorAggregate, exists, err := getError(errorsBucket, key)
+		if exists && errorAggregate.Status != "" {
+			status = errorAggregate.ErrorStatus
+		}
+		return err
+	})
+	return status, err
+}
+
+// GetErrorStatuses fetches the statuses of the errors of a service that aren't open, by aggregation key
+func (r *boltRepository) GetErrorStatuses(ctx context.Context, serviceName string) (map[string]ErrorStatus, error) {
+	statuses := make(map[string]ErrorStatus)
+	err := r.DB.View(func(tx *bolt.Tx) error {
+		errorsBucket := serviceErrors(tx, serviceName)
+		if errorsBucket == nil {
+			return nil
+		}
+		return errorsBucket.ForEach(func(key, value []byte) error {
+			// only the status is decoded, not the occurrences of the error
+			stored := struct{ ErrorStatus }{}
+			if err := json.Unmarshal(value, &stored); err != nil {
+				return err
+			}
+			if stored.Status != "" && stored.Status != StatusOpen {
+				statuses[string(key)] = stored.ErrorStatus
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+// SetErrorStatus changes the status of an error, recording the transition in its history
+func (r *boltRepository) SetErrorStatus(ctx context.Context, serviceName string, key string,
+	change StatusChange) error {
+	return r.DB.Update(func(tx *bolt.Tx) error {
+		errorsBucket := serviceErrors(tx, serviceName)
+		if errorsBucket == nil {
+			return fmt.Errorf("service %s %w", serviceName, ErrNotFound)
+		}
+		errorAggregate, exists, err := getError(errorsBucket, key)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("error %s of service %s %w", key, serviceName, ErrNotFound)
+		}
+		if errorAggregate.Status == "" {
+			errorAggregate.ErrorStatus = NewErrorStatus()
+		}
+		errorAggregate.ErrorStatus = errorAggregate.Apply(change, errorAggregate.TotalCount, time.Now())
+		return putError(errorsBucket, errorAggregate)
+	})
+}
+
+// StoreScraperState stores the aggregation state of the scraper of a service in json format
+func (r *boltRepository) StoreScraperState(ctx context.Context, serviceName string, state ScraperState) error {
+	value, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return r.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltScraperStatesBucket).Put([]byte(serviceName), value)
+	})
+}
+
+// GetScraperState fetches the aggregation state of the scraper of a service
+func (r *boltRepository) GetScraperState(ctx context.Context, serviceName string) (ScraperState, error) {
+	state := ScraperState{}
+	err := r.DB.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(boltScraperStatesBucket).Get([]byte(serviceName))
+		if value == nil {
+			return fmt.Errorf("scraper state for service %s %w", serviceName, ErrNotFound)
+		}
+		return json.Unmarshal(value, &state)
+	})
+	return state, err
+}
+
+// occurrencesKey is the key of an occurrences bucket: its resolution and start, so buckets of the same
+// resolution are sorted by time
+func occurrencesKey(resolution time.Duration, bucketStart int64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key[:8], uint64(resolution.Seconds()))
+	binary.BigEndian.PutUint64(key[8:], uint64(bucketStart))
+	return key
+}
+
+func parseOccurrencesKey(key []byte) (time.Duration, int64) {
+	resolution := time.Duration(binary.BigEndian.Uint64(key[:8])) * time.Second
+	return resolution, int64(binary.BigEndian.Uint64(key[8:]))
+}
+
+// addToOccurrencesBucket adds occurrences to a bucket of an error, creating it if needed
+func addToOccurrencesBucket(series *bolt.Bucket, resolution time.Duration, bucketStart int64, count int) error {
+	key := occurrencesKey(resolution, bucketStart)
+	value := make([]byte, 8)
+	if stored := series.Get(key); stored != nil {
+		count += int(binary.BigEndian.Uint64(stored))
+	}
+	binary.BigEndian.PutUint64(value, uint64(count))
+	return series.Put(key, value)
+}
+
+// AddOccurrences records the new occurrences of the errors of a service in minute buckets
+func (r *boltRepository) AddOccurrences(ctx context.Context, serviceName string, occurrences map[string]int,
+	at time.Time) error {
+	return r.DB.Update(func(tx *bolt.Tx) error {
+		serviceOccurrences, err := tx.Bucket(boltOccurrencesBucket).CreateBucketIfNotExists([]byte(serviceName))
+		if err != nil {
+			return err
+		}
+		for key, count := range occurrences {
+			series, err := serviceOccurrences.CreateBucketIfNotExists([]byte(key))
+			if err != nil {
+				return err
+			}
+			if err := addToOccurrencesBucket(series, MinuteBucket, bucketStartOf(at, MinuteBucket), count); err != nil {
+				return err
+			}
+		}
+		return rollupBoltOccurrences(serviceOccurrences, at)
+	})
+}
+
+// rollupBoltOccurrences moves the minute buckets older than the minute buckets retention to hour buckets
+func rollupBoltOccurrences(serviceOccurrences *bolt.Bucket, now time.Time) error {
+	// keys are collected first, as buckets can't be modified while iterating them
+	keys := [][]byte{}
+	err := serviceOccurrences.ForEach(func(key, value []byte) error {
+		keys = append(keys, append([]byte(nil), key...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	cutoff := occurrencesKey(MinuteBucket, now.Add(-minuteBucketsRetention).Unix())
+	for _, key := range keys {
+		series := serviceOccurrences.Bucket(key)
+		if series == nil {
+			continue
+		}
+		expired := make(map[int64]int)
+		cursor := series.Cursor()
+		for k, v := cursor.Seek(occurrencesKey(MinuteBucket, 0)); k != nil && bytes.Compare(k, cutoff) < 0; k, v =
+			cursor.Next() {
+			_, bucketStart := parseOccurrencesKey(k)
+			expired[bucketStart] = int(binary.BigEndian.Uint64(v))
+		}
+		for bucketStart, count := range expired {
+			if err := series.Delete(occurrencesKey(MinuteBucket, bucketStart)); err != nil {
+				return err
+			}
+			hourStart := bucketStartOf(time.Unix(bucketStart, 0), HourBucket)
+			if err := addToOccurrencesBucket(series, HourBucket, hourStart, count); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// GetOccurrencesHistogram fetches the occurrences of an error between from and to, in buckets of step duration
+func (r *boltRepository) GetOccurrencesHistogram(ctx context.Context, serviceName string, key string,
+	from time.Time, to time.Time, step time.Duration) ([]OccurrenceBucket, error) {
+	buckets := []OccurrenceBucket{}
+	err := r.DB.View(func(tx *bolt.Tx) error {
+		serviceOccurrences := tx.Bucket(boltOccurrencesBucket).Bucket([]byte(serviceName))
+		if serviceOccurrences == nil {
+			return nil
+		}
+		series := serviceOccurrences.Bucket([]byte(key))
+		if series == nil {
+			return nil
+		}
+		for _, resolution := range []time.Duration{MinuteBucket, HourBucket} {
+			start := occurrencesKey(resolution, from.Unix())
+			end := occurrencesKey(resolution, to.Unix())
+			cursor := series.Cursor()
+			for k, v := cursor.Seek(start); k != nil && bytes.Compare(k, end) < 0; k, v = cursor.Next() {
+				_, bucketStart := parseOccurrencesKey(k)
+				buckets = append(buckets, OccurrenceBucket{
+					Timestamp: bucketStart,
+					Count:     int(binary.BigEndian.Uint64(v)),
+				})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return histogram(buckets, from, to, step), nil
+}
+
+// Prune removes the errors and occurrences exceeding the retention policies
+func (r *boltRepository) Prune(ctx context.Context, retention config.Retention, now time.Time) (PruneResult, error) {
+	result := PruneResult{}
+	err := r.DB.Update(func(tx *bolt.Tx) error {
+		services := [][]byte{}
+		err := tx.Bucket(boltErrorsBucket).ForEach(func(key, value []byte) error {
+			services = append(services, append([]byte(nil), key...))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, serviceName := range services {
+			pruned, serviceResult, err := pruneBoltService(tx, serviceName, retention, now)
+			if err != nil {
+				return fmt.Errorf("failed to prune errors of service %s: %w", serviceName, err)
+			}
+			result.add(string(serviceName), serviceResult, pruned)
+		}
+		return nil
+	})
+	if err != nil {
+		return PruneResult{}, err
+	}
+	return result, nil
+}
+
+// pruneBoltService removes the errors and occurrences of a service exceeding the retention policies,
+// returning the pruned errors by aggregation key
+func pruneBoltService(tx *bolt.Tx, serviceName []byte, retention config.Retention,
+	now time.Time) (map[string]bool, PruneResult, error) {
+	errorsBucket := tx.Bucket(boltErrorsBucket).Bucket(serviceName)
+	errorAggregates := []ErrorAggregate{}
+	err := errorsBucket.ForEach(func(key, value []byte) error {
+		errorAggregate := ErrorAggregate{}
+		if err := json.Unmarshal(value, &errorAggregate); err != nil {
+			return err
+		}
+		errorAggregates = append(errorAggregates, errorAggregate)
+		return nil
+	})
+	if err != nil {
+		return nil, PruneResult{}, err
+	}
+
+	pruned, result := prunedErrors(errorAggregates, retention, now)
+	serviceOccurrences := tx.Bucket(boltOccurrencesBucket).Bucket(serviceName)
+	for _, errorAggregate := range errorAggregates {
+		key := []byte(errorAggregate.AggregationKey)
+		if pruned[errorAggregate.AggregationKey] {
+			if err := errorsBucket.Delete(key); err != nil {
+				return pruned, result, err
+			}
+			if serviceOccurrences != nil && serviceOccurrences.Bucket(key) != nil {
+				if err := serviceOccurrences.DeleteBucket(key); err != nil {
+					return pruned, result, err
+				}
+			}
+			continue
+		}
+		if max := retention.MaxOccurrences; max > 0 && len(errorAggregate.LatestErrors) > max {
+			result.Occurrences += len(errorAggregate.LatestErrors) - max
+			errorAggregate.LatestErrors = errorAggregate.LatestErrors[:max]
+			if err := putError(errorsBucket, errorAggregate); err != nil {
+				return pruned, result, err
+			}
+		}
+	}
+	if serviceOccurrences != nil && retention.MaxAge > 0 {
+		if err := expireBoltOccurrences(serviceOccurrences, now.Add(-retention.MaxAge)); err != nil {
+			return pruned, result, err
+		}
+	}
+	if len(pruned) > 0 {
+		if err := pruneBoltScraperState(tx, serviceName, pruned); err != nil {
+			return pruned, result, err
+		}
+	}
+	return pruned, result, nil
+}
+
+// expireBoltOccurrences removes the occurrences buckets of a service started before the cutoff
+func expireBoltOccurrences(serviceOccurrences *bolt.Bucket, cutoff time.Time) error {
+	// keys are collected first, as buckets can't be modified while iterating them
+	expired := make(map[string][][]byte)
+	err := serviceOccurrences.ForEach(func(key, value []byte) error {
+		series := serviceOccurrences.Bucket(key)
+		if series == nil {
+			return nil
+		}
+		return series.ForEach(func(k, v []byte) error {
+			if _, bucketStart := parseOccurrencesKey(k); bucketStart < cutoff.Unix() {
+				expired[string(key)] = append(expired[string(key)], append([]byte(nil), k...))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	for key, bucketKeys := range expired {
+		series := serviceOccurrences.Bucket([]byte(key))
+		for _, k := range bucketKeys {
+			if err := series.Delete(k); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pruneBoltScraperState removes the pruned errors from the scraper state of a service
+func pruneBoltScraperState(tx *bolt.Tx, serviceName []byte, pruned map[string]bool) error {
+	statesBucket := tx.Bucket(boltScraperStatesBucket)
+	value := statesBucket.Get(serviceName)
+	if value == nil {
+		return nil
+	}
+	state := ScraperState{}
+	if err := json.Unmarshal(value, &state); err != nil {
+		return err
+	}
+	value, err := json.Marshal(withoutErrors(state, pruned))
+	if err != nil {
+		return err
+	}
+	return statesBucket.Put(serviceName, value)
+}
@@ -0,0 +1,160 @@
+package repository
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/periskop-dev/periskop/config"
+)
+
+func newBoltTestRepository(t *testing.T) ErrorsRepository {
+	r, err := NewBoltRepository(filepath.Join(t.TempDir(), "periskop.db"))
+	if err != nil {
+		t.Fatalf("Fail to create repository: %s", err)
+	}
+	t.Cleanup(func() {
+		r.(*boltRepository).DB.Close()
+	})
+	return r
+}
+
+func TestBoltReplaceErrors(t *testing.T) {
+	ctx := context.Background()
+	r := newBoltTestRepository(t)
+	if _, err := r.GetErrors(ctx, serviceName, 10); err == nil {
+		t.Errorf("Expected an error fetching errors of an unknown service")
+	}
+
+	occurrences := []ErrorWithContext{{UUID: "uuid1", Timestamp: 1}, {UUID: "uuid0", Timestamp: 0}}
+	r.ReplaceErrors(ctx, serviceName, []ErrorAggregate{ // nolint[errcheck]
+		{AggregationKey: "test-error-0", TotalCount: 2, Severity: "error", LatestErrors: occurrences},
+		{AggregationKey: "test-error-1", TotalCount: 1},
+	})
+	r.ResolveError(ctx, serviceName, "test-error-1") // nolint[errcheck]
+	// errors without new occurrences aren't updated, and updated errors keep their status
+	r.ReplaceErrors(ctx, serviceName, []ErrorAggregate{ // nolint[errcheck]
+		{AggregationKey: "test-error-0", TotalCount: 2, Severity: "warning"},
+		{AggregationKey: "test-error-1", TotalCount: 3},
+	})
+
+	errors, err := r.GetErrors(ctx, serviceName, 1)
+	if err != nil || len(errors) != 1 {
+		t.Fatalf("Expected 1 element, Found %+v, %v", errors, err)
+	}
+	if errors[0].Severity != "error" || errors[0].Status != StatusOpen || !reflect.DeepEqual(errors[0].LatestErrors,
+		occurrences[:1]) {
+		t.Errorf("Unexpected error %+v", errors[0])
+	}
+	if resolved, _ := r.SearchResolved(ctx, serviceName, "test-error-1"); !resolved {
+		t.Errorf("Error should be kept as resolved")
+	}
+	services, _ := r.GetServices(ctx)
+	if !reflect.DeepEqual(services, []string{serviceName}) {
+		t.Errorf("Error fetching services, got %v", services)
+	}
+}
+
+func TestBoltErrorStatus(t *testing.T) {
+	ctx := context.Background()
+	r := newBoltTestRepository(t)
+	r.ReplaceErrors(ctx, serviceName, []ErrorAggregate{{AggregationKey: "test-error-0", TotalCount: 3}}) // nolint[errcheck]
+
+	snooze := StatusChange{Status: StatusSnoozed, SnoozeCount: 10, Actor: "alice"}
+	if err := r.SetErrorStatus(ctx, serviceName, "test-error-0", snooze); err != nil {
+		t.Errorf("Error changing status: %s", err)
+	}
+	status, _ := r.GetErrorStatus(ctx, serviceName, "test-error-0")
+	if status.Status != StatusSnoozed || status.SnoozedUntilCount != 13 || len(status.StatusHistory) != 1 ||
+		status.StatusHistory[0].Actor != "alice" {
+		t.Errorf("Unexpected status %+v", status)
+	}
+	if errors, _ := r.GetErrors(ctx, serviceName, 10); len(errors) != 0 {
+		t.Errorf("Expected 0 element, Found %d", len(errors))
+	}
+
+	if err := r.SetErrorStatus(ctx, serviceName, "unknown", snooze); err == nil {
+		t.Errorf("Expected an error changing the status of an unknown error")
+	}
+	if status, _ := r.GetErrorStatus(ctx, serviceName, "unknown"); status.Status != StatusOpen {
+		t.Errorf("Expected %s status, Found %s", StatusOpen, status.Status)
+	}
+}
+
+func TestBoltScraperState(t *testing.T) {
+	ctx := context.Background()
+	r := newBoltTestRepository(t)
+	if _, err := r.GetScraperState(ctx, serviceName); err == nil {
+		t.Errorf("Expected an error fetching an unknown scraper state")
+	}
+
+	state := ScraperState{
+		TargetErrorsCount: map[string]map[string]int{"target": {"test-error-0": 1}},
+		ErrorAggregates:   []ErrorAggregate{{AggregationKey: "test-error-0", TotalCount: 1}},
+	}
+	r.StoreScraperState(ctx, serviceName, state) // nolint[errcheck]
+	storedState, err := r.GetScraperState(ctx, serviceName)
+	if err != nil || !reflect.DeepEqual(storedState, state) {
+		t.Errorf("Error fetching scraper state, got %+v, expected %+v", storedState, state)
+	}
+}
+
+func TestBoltOccurrencesHistogram(t *testing.T) {
+	ctx := context.Background()
+	r := newBoltTestRepository(t)
+	now := time.Unix(1600000200, 0)
+	r.AddOccurrences(ctx, serviceName, map[string]int{"test-error-0": 2, "test-error-1": 1}, // nolint[errcheck]
+		now.Add(-2*time.Minute))
+	r.AddOccurrences(ctx, serviceName, map[string]int{"test-error-0": 3}, now.Add(-time.Minute)) // nolint[errcheck]
+	r.AddOccurrences(ctx, serviceName, map[string]int{"test-error-0": 4}, now)                   // nolint[errcheck]
+
+	histogram, _ := r.GetOccurrencesHistogram(ctx, serviceName, "test-error-0", now.Add(-3*time.Minute),
+		now.Add(time.Minute), 2*time.Minute)
+	expected := []OccurrenceBucket{
+		{Timestamp: now.Add(-3 * time.Minute).Unix(), Count: 2},
+		{Timestamp: now.Add(-time.Minute).Unix(), Count: 7},
+	}
+	if !reflect.DeepEqual(histogram, expected) {
+		t.Errorf("Expected histogram %+v, Found %+v", expected, histogram)
+	}
+
+	// minute buckets are rolled up to hour buckets after a day
+	r.AddOccurrences(ctx, serviceName, map[string]int{}, now.Add(minuteBucketsRetention+time.Hour)) // nolint[errcheck]
+	histogram, _ = r.GetOccurrencesHistogram(ctx, serviceName, "test-error-0", now.Add(-time.Hour),
+		now.Add(time.Hour), 2*time.Hour)
+	if len(histogram) != 1 || histogram[0].Count != 9 {
+		t.Errorf("Expected 9 occurrences, Found %+v", histogram)
+	}
+}
+
+func TestBoltPrune(t *testing.T) {
+	ctx := context.Background()
+	r := newBoltTestRepository(t)
+	now := time.Unix(1600000200, 0)
+	day := int64(24 * time.Hour / time.Second)
+	occurrences := []ErrorWithContext{{UUID: "uuid2"}, {UUID: "uuid1"}, {UUID: "uuid0"}}
+	r.ReplaceErrors(ctx, serviceName, []ErrorAggregate{ // nolint[errcheck]
+		{AggregationKey: "expired", TotalCount: 1, LastSeen: now.Unix() - 10*day},
+		{AggregationKey: "old", TotalCount: 1, LastSeen: now.Unix() - 2*day},
+		{AggregationKey: "recent", TotalCount: 1, LastSeen: now.Unix() - day, LatestErrors: occurrences},
+	})
+	r.AddOccurrences(ctx, serviceName, map[string]int{"expired": 1}, now) // nolint[errcheck]
+
+	retention := config.Retention{MaxAge: 7 * 24 * time.Hour, MaxOccurrences: 2, MaxErrorsPerService: 1}
+	result, err := r.Prune(ctx, retention, now)
+	expected := PruneResult{ExpiredErrors: 1, ExcessErrors: 1, Occurrences: 1,
+		Keys: map[string][]string{serviceName: {"expired", "old"}}}
+	if err != nil || !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected %+v pruned, Found %+v, %v", expected, result, err)
+	}
+	errors, _ := r.GetErrors(ctx, serviceName, 10)
+	if len(errors) != 1 || errors[0].AggregationKey != "recent" || len(errors[0].LatestErrors) != 2 {
+		t.Errorf("Expected the most recently seen error with its newest occurrences, Found %+v", errors)
+	}
+	histogram, _ := r.GetOccurrencesHistogram(ctx, serviceName, "expired", now, now.Add(time.Minute), time.Minute)
+	if len(histogram) != 1 || histogram[0].Count != 0 {
+		t.Errorf("Expected the occurrences of pruned errors to be removed, Found %+v", histogram)
+	}
+}
@@ -0,0 +1,42 @@
+package repository_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/periskop-dev/periskop/repository"
+	"github.com/periskop-dev/periskop/repository/repositorytest"
+)
+
+func TestMemoryConformance(t *testing.T) {
+	repositorytest.RunConformance(t, func(t *testing.T) repository.ErrorsRepository {
+		return repository.NewMemoryRepository()
+	})
+}
+
+func TestORMConformance(t *testing.T) {
+	repositorytest.RunConformance(t, func(t *testing.T) repository.ErrorsRepository {
+		db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "periskop.db")), &gorm.Config{})
+		if err != nil {
+			t.Fatalf("Fail to connect database: %s", err)
+		}
+		r, err := repository.NewORMRepository(db)
+		if err != nil {
+			t.Fatalf("Fail to create repository: %s", err)
+		}
+		return r
+	})
+}
+
+func TestBoltConformance(t *testing.T) {
+	repositorytest.RunConformance(t, func(t *testing.T) repository.ErrorsRepository {
+		r, err := repository.NewBoltRepository(filepath.Join(t.TempDir(), "periskop.bolt"))
+		if err != nil {
+			t.Fatalf("Fail to create repository: %s", err)
+		}
+		return r
+	})
+}
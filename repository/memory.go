@@ -1,33 +1,52 @@
 package repository
 
 import (
+	"context"
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 
+	"github.com/periskop-dev/periskop/config"
 	"github.com/periskop-dev/periskop/metrics"
 )
 
 func NewMemoryRepository() ErrorsRepository {
 	return &memoryRepository{
 		AggregatedError: sync.Map{},
-		ResolvedErrors:  sync.Map{},
+		ErrorStatuses:   sync.Map{},
+		ScraperStates:   sync.Map{},
+		Occurrences:     make(map[string]map[string]occurrenceSeries),
 	}
 }
 
 type memoryRepository struct {
 	// map service name -> list of errors
 	AggregatedError sync.Map
-	// map service name -> set of resolved errors
-	ResolvedErrors sync.Map
+	// map service name -> error key -> status of the error
+	ErrorStatuses sync.Map
+	// errorsMutex serializes the writes of errors and statuses, which are copied on write
+	errorsMutex sync.Mutex
+	// map service name -> scraper state
+	ScraperStates sync.Map
+	// map service name -> error key -> occurrences series
+	Occurrences      map[string]map[string]occurrenceSeries
+	occurrencesMutex sync.RWMutex
 	targetsRepository
 }
 
-// GetErrors fetches the last numberOfErrors of each aggregation of errors for the given service
-func (r *memoryRepository) GetErrors(serviceName string, numberOfErrors int) ([]ErrorAggregate, error) {
+// GetErrors fetches the last numberOfErrors of each aggregation of errors for the given service.
+// Resolved, ignored and snoozed errors are not listed.
+func (r *memoryRepository) GetErrors(ctx context.Context, serviceName string,
+	numberOfErrors int) ([]ErrorAggregate, error) {
 	if value, ok := r.AggregatedError.Load(serviceName); ok {
 		prevErrors, _ := value.([]ErrorAggregate)
 		errors := make([]ErrorAggregate, 0, len(prevErrors))
 		for _, errorAggregate := range prevErrors {
+			errorAggregate.ErrorStatus = r.errorStatus(serviceName, errorAggregate.AggregationKey)
+			if !errorAggregate.IsVisible() {
+				continue
+			}
 			maxErrors := len(errorAggregate.LatestErrors)
 			if numberOfErrors < maxErrors {
 				maxErrors = numberOfErrors
@@ -39,67 +58,349 @@ func (r *memoryRepository) GetErrors(serviceName string, numberOfErrors int) ([]
 		return errors, nil
 	}
 	metrics.ServiceErrors.WithLabelValues("service_not_found").Inc()
-	return nil, fmt.Errorf("service %s not found", serviceName)
+	return nil, fmt.Errorf("service %s %w", serviceName, ErrNotFound)
+}
+
+// QueryErrors lists the errors of a service like GetErrors, filtered, sorted and paginated by the query
+func (r *memoryRepository) QueryErrors(ctx context.Context, serviceName string,
+	query ErrorsQuery) (ErrorsPage, error) {
+	errors, err := r.ExportErrors(ctx, serviceName)
+	if err != nil {
+		metrics.ServiceErrors.WithLabelValues("service_not_found").Inc()
+		return ErrorsPage{}, err
+	}
+	return queryErrors(errors, query)
+}
+
+// GetError fetches an error of a service whatever its status, with its last numberOfErrors occurrences
+func (r *memoryRepository) GetError(ctx context.Context, serviceName string, key string,
+	numberOfErrors int) (ErrorAggregate, error) {
+	errorAggregate, err := r.findError(serviceName, key)
+	if err != nil {
+		return ErrorAggregate{}, err
+	}
+	if len(errorAggregate.LatestErrors) > numberOfErrors {
+		errorAggregate.LatestErrors = errorAggregate.LatestErrors[:numberOfErrors]
+	}
+	return errorAggregate, nil
+}
+
+// GetOccurrences lists the stored occurrences of an error sorted by timestamp, newest first, paginated by the query
+func (r *memoryRepository) GetOccurrences(ctx context.Context, serviceName string, key string,
+	query OccurrencesQuery) (OccurrencesPage, error) {
+	errorAggregate, err := r.findError(serviceName, key)
+	if err != nil {
+		return OccurrencesPage{}, err
+	}
+	return queryOccurrences(errorAggregate.LatestErrors, query)
+}
+
+// findError fetches an error of a service with its status
+func (r *memoryRepository) findError(serviceName string, key string) (ErrorAggregate, error) {
+	if value, ok := r.AggregatedError.Load(serviceName); ok {
+		for _, errorAggregate := range value.([]ErrorAggregate) {
+			if errorAggregate.AggregationKey == key {
+				errorAggregate.ErrorStatus = r.errorStatus(serviceName, key)
+				return errorAggregate, nil
+			}
+		}
+	}
+	return ErrorAggregate{}, fmt.Errorf("error %s of service %s %w", key, serviceName, ErrNotFound)
 }
 
-// ReplaceErrors replaces a lists of aggregated errors for the given service
-func (r *memoryRepository) ReplaceErrors(serviceName string, errors []ErrorAggregate) {
-	r.AggregatedError.Store(serviceName, errors)
+// ReplaceErrors stores errors of a service, replacing the stored errors with the same aggregation key.
+// Only errors that are new or have more occurrences than before are replaced.
+func (r *memoryRepository) ReplaceErrors(ctx context.Context, serviceName string, errors []ErrorAggregate) error {
+	r.errorsMutex.Lock()
+	defer r.errorsMutex.Unlock()
+
+	totalCounts := make(map[string]int)
+	if value, ok := r.AggregatedError.Load(serviceName); ok {
+		for _, errorAggregate := range value.([]ErrorAggregate) {
+			totalCounts[errorAggregate.AggregationKey] = errorAggregate.TotalCount
+		}
+	}
+	changed := make([]ErrorAggregate, 0, len(errors))
+	for _, errorAggregate := range errors {
+		if totalCount, exists := totalCounts[errorAggregate.AggregationKey]; exists &&
+			errorAggregate.TotalCount <= totalCount {
+			continue
+		}
+		changed = append(changed, errorAggregate)
+	}
+	r.storeErrors(serviceName, changed)
+	return nil
 }
 
-// GetServices fetches the list of unique services
-func (r *memoryRepository) GetServices() []string {
+// storeErrors replaces the stored errors of a service with the same aggregation key and adds the new ones.
+// It must be called holding the errors mutex.
+func (r *memoryRepository) storeErrors(serviceName string, errors []ErrorAggregate) {
+	replaced := make(map[string]ErrorAggregate, len(errors))
+	for _, errorAggregate := range errors {
+		replaced[errorAggregate.AggregationKey] = errorAggregate
+	}
+	// errors are copied on write, so concurrent readers never see a list being modified
+	stored := make([]ErrorAggregate, 0, len(errors))
+	if value, ok := r.AggregatedError.Load(serviceName); ok {
+		for _, errorAggregate := range value.([]ErrorAggregate) {
+			if replacement, exists := replaced[errorAggregate.AggregationKey]; exists {
+				errorAggregate = replacement
+				delete(replaced, errorAggregate.AggregationKey)
+			}
+			stored = append(stored, errorAggregate)
+		}
+	}
+	for _, errorAggregate := range errors {
+		if _, isNew := replaced[errorAggregate.AggregationKey]; isNew {
+			stored = append(stored, errorAggregate)
+		}
+	}
+	r.AggregatedError.Store(serviceName, stored)
+}
+
+// ExportErrors fetches every error of a service with its status and all its stored occurrences
+func (r *memoryRepository) ExportErrors(ctx context.Context, serviceName string) ([]ErrorAggregate, error) {
+	value, ok := r.AggregatedError.Load(serviceName)
+	if !ok {
+		return nil, fmt.Errorf("service %s %w", serviceName, ErrNotFound)
+	}
+	stored := value.([]ErrorAggregate)
+	errors := make([]ErrorAggregate, 0, len(stored))
+	for _, errorAggregate := range stored {
+		errorAggregate.ErrorStatus = r.errorStatus(serviceName, errorAggregate.AggregationKey)
+		errors = append(errors, errorAggregate)
+	}
+	return errors, nil
+}
+
+// ImportErrors stores errors of a service with their status, replacing the stored errors with the same
+// aggregation key
+func (r *memoryRepository) ImportErrors(ctx context.Context, serviceName string, errors []ErrorAggregate) error {
+	r.errorsMutex.Lock()
+	defer r.errorsMutex.Unlock()
+
+	statuses := make(map[string]ErrorStatus)
+	if value, ok := r.ErrorStatuses.Load(serviceName); ok {
+		for k, status := range value.(map[string]ErrorStatus) {
+			statuses[k] = status
+		}
+	}
+	for _, errorAggregate := range errors {
+		statuses[errorAggregate.AggregationKey] = errorAggregate.ErrorStatus
+	}
+	r.storeErrors(serviceName, errors)
+	r.ErrorStatuses.Store(serviceName, statuses)
+	return nil
+}
+
+// GetServices fetches the list of unique services, sorted by name
+func (r *memoryRepository) GetServices(ctx context.Context) ([]string, error) {
 	keys := make([]string, 0)
 	r.AggregatedError.Range(func(key, value interface{}) bool {
 		k, _ := key.(string)
 		keys = append(keys, k)
 		return true
 	})
-	return keys
+	sort.Strings(keys)
+	return keys, nil
 }
 
-// ResolveError removes the error from list of errors and adds to the set of resolved errors
-func (r *memoryRepository) ResolveError(serviceName string, key string) error {
-	if value, ok := r.AggregatedError.Load(serviceName); ok {
-		prevErrors, _ := value.([]ErrorAggregate)
-		errors := []ErrorAggregate{}
-		for _, errorAggregate := range prevErrors {
-			if errorAggregate.AggregationKey != key {
-				errors = append(errors, errorAggregate)
+// ResolveError changes the status of the error to resolved
+func (r *memoryRepository) ResolveError(ctx context.Context, serviceName string, key string) error {
+	return r.SetErrorStatus(ctx, serviceName, key, StatusChange{Status: StatusResolved})
+}
+
+// RemoveResolved reopens a resolved error
+func (r *memoryRepository) RemoveResolved(ctx context.Context, serviceName string, key string) error {
+	if r.errorStatus(serviceName, key).Status != StatusResolved {
+		return nil
+	}
+	return r.SetErrorStatus(ctx, serviceName, key, StatusChange{Status: StatusOpen})
+}
+
+// SearchResolved searches if an error is resolved
+func (r *memoryRepository) SearchResolved(ctx context.Context, serviceName string, key string) (bool, error) {
+	return r.errorStatus(serviceName, key).Status == StatusResolved, nil
+}
+
+// GetErrorStatus fetches the status of an error, errors are open until their status changes
+func (r *memoryRepository) GetErrorStatus(ctx context.Context, serviceName string, key string) (ErrorStatus, error) {
+	return r.errorStatus(serviceName, key), nil
+}
+
+// GetErrorStatuses fetches the statuses of the errors of a service that aren't open, by aggregation key
+func (r *memoryRepository) GetErrorStatuses(ctx context.Context, serviceName string) (map[string]ErrorStatus, error) {
+	statuses := make(map[string]ErrorStatus)
+	if value, ok := r.ErrorStatuses.Load(serviceName); ok {
+		for key, status := range value.(map[string]ErrorStatus) {
+			if status.Status != StatusOpen {
+				statuses[key] = status
 			}
 		}
-		r.ReplaceErrors(serviceName, errors)
-		r.addToResolved(serviceName, key)
-		return nil
 	}
-	return fmt.Errorf("service %s not found", serviceName)
+	return statuses, nil
+}
+
+func (r *memoryRepository) errorStatus(serviceName string, key string) ErrorStatus {
+	if value, ok := r.ErrorStatuses.Load(serviceName); ok {
+		if status, exists := value.(map[string]ErrorStatus)[key]; exists {
+			return status
+		}
+	}
+	return NewErrorStatus()
+}
+
+// SetErrorStatus changes the status of an error, recording the transition in its history
+func (r *memoryRepository) SetErrorStatus(ctx context.Context, serviceName string, key string,
+	change StatusChange) error {
+	r.errorsMutex.Lock()
+	defer r.errorsMutex.Unlock()
+
+	value, ok := r.AggregatedError.Load(serviceName)
+	if !ok {
+		return fmt.Errorf("service %s %w", serviceName, ErrNotFound)
+	}
+	totalCount, exists := 0, false
+	for _, errorAggregate := range value.([]ErrorAggregate) {
+		if errorAggregate.AggregationKey == key {
+			totalCount, exists = errorAggregate.TotalCount, true
+		}
+	}
+	if !exists {
+		return fmt.Errorf("error %s of service %s %w", key, serviceName, ErrNotFound)
+	}
+
+	// statuses are copied on write, so concurrent readers never see a map being modified
+	statuses := make(map[string]ErrorStatus)
+	if value, ok := r.ErrorStatuses.Load(serviceName); ok {
+		for k, status := range value.(map[string]ErrorStatus) {
+			statuses[k] = status
+		}
+	}
+	statuses[key] = r.errorStatus(serviceName, key).Apply(change, totalCount, time.Now())
+	r.ErrorStatuses.Store(serviceName, statuses)
+	return nil
 }
 
-// addToResolved saves the error to resolved error set
-func (r *memoryRepository) addToResolved(serviceName string, key string) {
-	if resolvedSet, ok := r.ResolvedErrors.Load(serviceName); ok {
-		resolvedSet := resolvedSet.(map[string]bool)
-		resolvedSet[key] = true
-		r.ResolvedErrors.Store(serviceName, resolvedSet)
-	} else {
-		r.ResolvedErrors.Store(serviceName, map[string]bool{key: true})
+// StoreScraperState stores the aggregation state of the scraper of a service
+func (r *memoryRepository) StoreScraperState(ctx context.Context, serviceName string, state ScraperState) error {
+	r.ScraperStates.Store(serviceName, state)
+	return nil
+}
+
+// GetScraperState fetches the aggregation state of the scraper of a service
+func (r *memoryRepository) GetScraperState(ctx context.Context, serviceName string) (ScraperState, error) {
+	if value, ok := r.ScraperStates.Load(serviceName); ok {
+		return value.(ScraperState), nil
 	}
+	return ScraperState{}, fmt.Errorf("scraper state for service %s %w", serviceName, ErrNotFound)
 }
 
-// RemoveResolved removes a resolved error from resolved error set
-func (r *memoryRepository) RemoveResolved(serviceName string, key string) {
-	if resolvedSet, ok := r.ResolvedErrors.Load(serviceName); ok {
-		resolvedSet := resolvedSet.(map[string]bool)
-		delete(resolvedSet, key)
-		r.ResolvedErrors.Store(serviceName, resolvedSet)
+// AddOccurrences records the new occurrences of the errors of a service in minute buckets
+func (r *memoryRepository) AddOccurrences(ctx context.Context, serviceName string, occurrences map[string]int,
+	at time.Time) error {
+	r.occurrencesMutex.Lock()
+	defer r.occurrencesMutex.Unlock()
+
+	if r.Occurrences == nil {
+		r.Occurrences = make(map[string]map[string]occurrenceSeries)
+	}
+	if _, exists := r.Occurrences[serviceName]; !exists {
+		r.Occurrences[serviceName] = make(map[string]occurrenceSeries)
+	}
+	for key, count := range occurrences {
+		series, exists := r.Occurrences[serviceName][key]
+		if !exists {
+			series = make(occurrenceSeries)
+			r.Occurrences[serviceName][key] = series
+		}
+		series.add(MinuteBucket, bucketStartOf(at, MinuteBucket), count)
+	}
+	for _, series := range r.Occurrences[serviceName] {
+		series.rollup(at)
 	}
+	return nil
 }
 
-// SearchResolved searches if an error is inside the set of resolved errors
-func (r *memoryRepository) SearchResolved(serviceName string, key string) bool {
-	if resolvedSet, ok := r.ResolvedErrors.Load(serviceName); ok {
-		resolvedSet := resolvedSet.(map[string]bool)
-		return resolvedSet[key]
+// GetOccurrencesHistogram fetches the occurrences of an error between from and to, in buckets of step duration
+func (r *memoryRepository) GetOccurrencesHistogram(ctx context.Context, serviceName string, key string, from time.Time,
+	to time.Time, step time.Duration) ([]OccurrenceBucket, error) {
+	r.occurrencesMutex.RLock()
+	defer r.occurrencesMutex.RUnlock()
+
+	return histogram(r.Occurrences[serviceName][key].buckets(from, to), from, to, step), nil
+}
+
+// Prune removes the errors and occurrences exceeding the retention policies
+func (r *memoryRepository) Prune(ctx context.Context, retention config.Retention, now time.Time) (PruneResult, error) {
+	r.errorsMutex.Lock()
+	defer r.errorsMutex.Unlock()
+
+	result := PruneResult{}
+	r.AggregatedError.Range(func(key, value interface{}) bool {
+		serviceName := key.(string)
+		stored := value.([]ErrorAggregate)
+		withStatus := make([]ErrorAggregate, 0, len(stored))
+		for _, errorAggregate := range stored {
+			errorAggregate.ErrorStatus = r.errorStatus(serviceName, errorAggregate.AggregationKey)
+			withStatus = append(withStatus, errorAggregate)
+		}
+		pruned, serviceResult := prunedErrors(withStatus, retention, now)
+
+		kept := make([]ErrorAggregate, 0, len(stored)-len(pruned))
+		for _, errorAggregate := range stored {
+			if pruned[errorAggregate.AggregationKey] {
+				continue
+			}
+			if max := retention.MaxOccurrences; max > 0 && len(errorAggregate.LatestErrors) > max {
+				serviceResult.Occurrences += len(errorAggregate.LatestErrors) - max
+				errorAggregate.LatestErrors = errorAggregate.LatestErrors[:max:max]
+			}
+			kept = append(kept, errorAggregate)
+		}
+		r.AggregatedError.Store(serviceName, kept)
+		r.removeErrors(serviceName, pruned)
+		if state, ok := r.ScraperStates.Load(serviceName); ok && len(pruned) > 0 {
+			r.ScraperStates.Store(serviceName, withoutErrors(state.(ScraperState), pruned))
+		}
+		result.add(serviceName, serviceResult, pruned)
+		return true
+	})
+	if retention.MaxAge > 0 {
+		r.expireOccurrences(now.Add(-retention.MaxAge))
+	}
+	return result, nil
+}
+
+// expireOccurrences removes the occurrences buckets started before the cutoff
+func (r *memoryRepository) expireOccurrences(cutoff time.Time) {
+	r.occurrencesMutex.Lock()
+	defer r.occurrencesMutex.Unlock()
+	for _, serviceOccurrences := range r.Occurrences {
+		for _, series := range serviceOccurrences {
+			series.expire(cutoff)
+		}
+	}
+}
+
+// removeErrors removes the statuses and occurrences of the given errors of a service
+func (r *memoryRepository) removeErrors(serviceName string, keys map[string]bool) {
+	if len(keys) == 0 {
+		return
+	}
+	if value, ok := r.ErrorStatuses.Load(serviceName); ok {
+		statuses := make(map[string]ErrorStatus)
+		for key, status := range value.(map[string]ErrorStatus) {
+			if !keys[key] {
+				statuses[key] = status
+			}
+		}
+		r.ErrorStatuses.Store(serviceName, statuses)
+	}
+
+	r.occurrencesMutex.Lock()
+	defer r.occurrencesMutex.Unlock()
+	for key := range keys {
+		delete(r.Occurrences[serviceName], key)
 	}
-	return false
 }
@@ -1,74 +1,192 @@
 package repository
 
 import (
+	"context"
+	"reflect"
 	"testing"
+	"time"
+
+	"github.com/periskop-dev/periskop/config"
 )
 
 const serviceName = "test-service"
 
-func TestMemoryAddToResolved(t *testing.T) {
-	er := &memoryRepository{}
-
-	// service has empty list of resolved errors
-	er.addToResolved(serviceName, "test-error-0")
-	if value, ok := er.ResolvedErrors.Load(serviceName); ok {
-		value, _ := value.(map[string]bool)
-		if len(value) != 1 {
-			t.Errorf("Expected 1 element, Found %d", len(value))
-		}
-	}
-
-	// service has a resolved error
-	er.addToResolved(serviceName, "test-error-1")
-	if value, ok := er.ResolvedErrors.Load(serviceName); ok {
-		value, _ := value.(map[string]bool)
-		if len(value) != 2 {
-			t.Errorf("Expected 2 element, Found %d", len(value))
-		}
-	}
-}
-
 func TestMemoryRemoveResolved(t *testing.T) {
+	ctx := context.Background()
 	er := &memoryRepository{}
+	er.AggregatedError.Store(serviceName, []ErrorAggregate{{AggregationKey: "test-error-0"}})
 
-	er.ResolvedErrors.Store(serviceName, map[string]bool{"test-error-0": true})
-	er.RemoveResolved(serviceName, "test-error-0")
+	er.ResolveError(ctx, serviceName, "test-error-0") // nolint[errcheck]
+	er.RemoveResolved(ctx, serviceName, "test-error-0")
 
-	if value, ok := er.ResolvedErrors.Load(serviceName); ok {
-		value, _ := value.(map[string]bool)
-		if len(value) != 0 {
-			t.Errorf("Expected 0 element, Found %d", len(value))
-		}
+	if status, _ := er.GetErrorStatus(ctx, serviceName, "test-error-0"); status.Status != StatusOpen {
+		t.Errorf("Expected %s status, Found %s", StatusOpen, status.Status)
 	}
 }
 
 func TestMemorySearchResolved(t *testing.T) {
+	ctx := context.Background()
 	er := &memoryRepository{}
-	er.ResolvedErrors.Store(serviceName, map[string]bool{"test-error-0": true})
+	er.AggregatedError.Store(serviceName, []ErrorAggregate{{AggregationKey: "test-error-0"}})
+	er.ResolveError(ctx, serviceName, "test-error-0") // nolint[errcheck]
 
-	if !er.SearchResolved(serviceName, "test-error-0") {
+	if resolved, _ := er.SearchResolved(ctx, serviceName, "test-error-0"); !resolved {
 		t.Errorf("Error should be found in resolved errors")
 	}
 
-	if er.SearchResolved(serviceName, "test-error-1") {
+	if resolved, _ := er.SearchResolved(ctx, serviceName, "test-error-1"); resolved {
 		t.Errorf("Error shouldn't be found in resolved errors")
 	}
 }
 
 func TestMemoryResolveError(t *testing.T) {
+	ctx := context.Background()
 	er := &memoryRepository{}
 	er.AggregatedError.Store(serviceName, []ErrorAggregate{
 		{AggregationKey: "test-error-0"},
 		{AggregationKey: "test-error-1"},
 	})
-	err := er.ResolveError(serviceName, "test-error-0")
+	err := er.ResolveError(ctx, serviceName, "test-error-0")
 	if err != nil {
 		t.Errorf("deleting the error")
 	}
-	if value, ok := er.AggregatedError.Load(serviceName); ok {
-		value, _ := value.([]ErrorAggregate)
-		if len(value) != 1 {
-			t.Errorf("Expected 1 element, Found %d", len(value))
-		}
+	errors, _ := er.GetErrors(ctx, serviceName, 10)
+	if len(errors) != 1 {
+		t.Errorf("Expected 1 element, Found %d", len(errors))
+	}
+
+	if err := er.ResolveError(ctx, "unknown-service", "test-error-0"); err == nil {
+		t.Errorf("Expected an error resolving an error of an unknown service")
+	}
+}
+
+func TestMemoryErrorStatus(t *testing.T) {
+	ctx := context.Background()
+	er := &memoryRepository{}
+	er.AggregatedError.Store(serviceName, []ErrorAggregate{
+		{AggregationKey: "test-error-0", TotalCount: 3},
+		{AggregationKey: "test-error-1", TotalCount: 5},
+	})
+
+	er.SetErrorStatus(ctx, serviceName, "test-error-0", StatusChange{Status: StatusIgnored}) // nolint[errcheck]
+	snooze := StatusChange{Status: StatusSnoozed, SnoozeCount: 10}
+	er.SetErrorStatus(ctx, serviceName, "test-error-1", snooze) // nolint[errcheck]
+
+	errors, _ := er.GetErrors(ctx, serviceName, 10)
+	if len(errors) != 0 {
+		t.Errorf("Expected 0 element, Found %d", len(errors))
+	}
+
+	status, _ := er.GetErrorStatus(ctx, serviceName, "test-error-1")
+	if status.Status != StatusSnoozed || status.SnoozedUntilCount != 15 {
+		t.Errorf("Expected error snoozed until 15 occurrences, Found %+v", status)
+	}
+	if len(status.StatusHistory) != 1 || status.StatusHistory[0].From != StatusOpen ||
+		status.StatusHistory[0].TotalCount != 5 {
+		t.Errorf("Unexpected status history %+v", status.StatusHistory)
+	}
+
+	er.SetErrorStatus(ctx, serviceName, "test-error-1", StatusChange{Status: StatusOpen}) // nolint[errcheck]
+	errors, _ = er.GetErrors(ctx, serviceName, 10)
+	if len(errors) != 1 || errors[0].Status != StatusOpen || len(errors[0].StatusHistory) != 2 {
+		t.Errorf("Expected the reopened error to be listed with its history, Found %+v", errors)
+	}
+}
+
+func TestMemoryScraperState(t *testing.T) {
+	ctx := context.Background()
+	er := &memoryRepository{}
+	if _, err := er.GetScraperState(ctx, serviceName); err == nil {
+		t.Errorf("Expected an error fetching an unknown scraper state")
+	}
+
+	state := ScraperState{TargetErrorsCount: map[string]map[string]int{"target": {"test-error-0": 1}}}
+	er.StoreScraperState(ctx, serviceName, state)
+	storedState, err := er.GetScraperState(ctx, serviceName)
+	if err != nil || storedState.TargetErrorsCount["target"]["test-error-0"] != 1 {
+		t.Errorf("Error fetching scraper state, got %+v", storedState)
+	}
+}
+
+func TestMemoryOccurrencesHistogram(t *testing.T) {
+	ctx := context.Background()
+	er := NewMemoryRepository()
+	now := time.Unix(1600000200, 0)
+	er.AddOccurrences(ctx, serviceName, map[string]int{"test-error-0": 2, "test-error-1": 1},
+		now.Add(-2*time.Minute))
+	er.AddOccurrences(ctx, serviceName, map[string]int{"test-error-0": 3}, now.Add(-time.Minute))
+	er.AddOccurrences(ctx, serviceName, map[string]int{"test-error-0": 4}, now)
+
+	histogram, _ := er.GetOccurrencesHistogram(ctx, serviceName, "test-error-0", now.Add(-3*time.Minute),
+		now.Add(time.Minute), 2*time.Minute)
+	expected := []OccurrenceBucket{
+		{Timestamp: now.Add(-3 * time.Minute).Unix(), Count: 2},
+		{Timestamp: now.Add(-time.Minute).Unix(), Count: 7},
+	}
+	if !reflect.DeepEqual(histogram, expected) {
+		t.Errorf("Expected histogram %+v, Found %+v", expected, histogram)
+	}
+
+	// minute buckets are rolled up to hour buckets after a day
+	er.AddOccurrences(ctx, serviceName, map[string]int{"test-error-1": 1},
+		now.Add(minuteBucketsRetention+time.Hour))
+	series := er.(*memoryRepository).Occurrences[serviceName]["test-error-0"]
+	if len(series[MinuteBucket]) != 0 || series[HourBucket][bucketStartOf(now, HourBucket)] != 9 {
+		t.Errorf("Expected occurrences rolled up to hour buckets, Found %+v", series)
+	}
+	histogram, _ = er.GetOccurrencesHistogram(ctx, serviceName, "test-error-0", now.Add(-time.Hour),
+		now.Add(time.Hour), time.Hour)
+	if len(histogram) != 2 || histogram[0].Count+histogram[1].Count != 9 {
+		t.Errorf("Expected 9 occurrences, Found %+v", histogram)
+	}
+}
+
+func TestMemoryReplaceErrors(t *testing.T) {
+	ctx := context.Background()
+	er := NewMemoryRepository()
+	er.ReplaceErrors(ctx, serviceName, []ErrorAggregate{ // nolint[errcheck]
+		{AggregationKey: "test-error-0", TotalCount: 1},
+		{AggregationKey: "test-error-1", TotalCount: 1},
+	})
+	er.ReplaceErrors(ctx, serviceName, []ErrorAggregate{{AggregationKey: "test-error-1", TotalCount: 2}}) // nolint[errcheck]
+
+	// errors not replaced are kept
+	errors, _ := er.GetErrors(ctx, serviceName, 10)
+	if len(errors) != 2 || errors[0].TotalCount != 1 || errors[1].TotalCount != 2 {
+		t.Errorf("Unexpected errors %+v", errors)
+	}
+}
+
+func TestMemoryPrune(t *testing.T) {
+	ctx := context.Background()
+	er := NewMemoryRepository()
+	now := time.Unix(1600000200, 0)
+	day := int64(24 * time.Hour / time.Second)
+	occurrences := []ErrorWithContext{{UUID: "uuid2"}, {UUID: "uuid1"}, {UUID: "uuid0"}}
+	er.ReplaceErrors(ctx, serviceName, []ErrorAggregate{ // nolint[errcheck]
+		{AggregationKey: "expired", LastSeen: now.Unix() - 10*day},
+		{AggregationKey: "resolved", LastSeen: now.Unix() - 3*day},
+		{AggregationKey: "old", LastSeen: now.Unix() - 2*day, LatestErrors: occurrences},
+		{AggregationKey: "recent", LastSeen: now.Unix() - day, LatestErrors: occurrences},
+	})
+	er.AddOccurrences(ctx, serviceName, map[string]int{"expired": 1}, now) // nolint[errcheck]
+	er.ResolveError(ctx, serviceName, "resolved")                          // nolint[errcheck]
+
+	retention := config.Retention{MaxAge: 7 * 24 * time.Hour, ResolvedMaxAge: time.Hour, MaxOccurrences: 2,
+		MaxErrorsPerService: 1}
+	// the error was resolved later than now, so it's within the resolved max age
+	result, err := er.Prune(ctx, retention, now)
+	expected := PruneResult{ExpiredErrors: 1, ExcessErrors: 2, Occurrences: 1,
+		Keys: map[string][]string{serviceName: {"expired", "old", "resolved"}}}
+	if err != nil || !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected %+v pruned, Found %+v, %v", expected, result, err)
+	}
+	errors, _ := er.GetErrors(ctx, serviceName, 10)
+	if len(errors) != 1 || errors[0].AggregationKey != "recent" || len(errors[0].LatestErrors) != 2 ||
+		errors[0].LatestErrors[0].UUID != "uuid2" {
+		t.Errorf("Expected the most recently seen error with its newest occurrences, Found %+v", errors)
+	}
+	if _, exists := er.(*memoryRepository).Occurrences[serviceName]["expired"]; exists {
+		t.Errorf("Expected the occurrences of pruned errors to be removed")
 	}
 }
@@ -0,0 +1,100 @@
+package repository
+
+import (
+	"context"
+	"time"
+)
+
+// Occurrences of errors are recorded in minute buckets, which are rolled up to hour buckets after a day
+const (
+	MinuteBucket           = time.Minute
+	HourBucket             = time.Hour
+	minuteBucketsRetention = 24 * time.Hour
+)
+
+// OccurrenceBucket is the number of occurrences of an error during a time interval
+type OccurrenceBucket struct {
+	// Timestamp is the unix time of the start of the interval
+	Timestamp int64 `json:"timestamp"`
+	Count     int   `json:"count"`
+}
+
+type OccurrencesRepository interface {
+	// AddOccurrences records the new occurrences of the errors of a service, by error key, at the given time
+	AddOccurrences(ctx context.Context, serviceName string, occurrences map[string]int, at time.Time) error
+	// GetOccurrencesHistogram fetches the occurrences of an error between from and to, in buckets of step duration
+	GetOccurrencesHistogram(ctx context.Context, serviceName string, key string, from time.Time, to time.Time,
+		step time.Duration) ([]OccurrenceBucket, error)
+}
+
+// occurrenceSeries holds the occurrences of an error by bucket resolution and bucket start
+type occurrenceSeries map[time.Duration]map[int64]int
+
+// add records occurrences in the bucket of the given resolution starting at bucketStart
+func (s occurrenceSeries) add(resolution time.Duration, bucketStart int64, count int) {
+	if _, exists := s[resolution]; !exists {
+		s[resolution] = make(map[int64]int)
+	}
+	s[resolution][bucketStart] += count
+}
+
+// rollup moves the minute buckets older than the minute buckets retention to hour buckets
+func (s occurrenceSeries) rollup(now time.Time) {
+	cutoff := now.Add(-minuteBucketsRetention).Unix()
+	for bucketStart, count := range s[MinuteBucket] {
+		if bucketStart < cutoff {
+			s.add(HourBucket, bucketStartOf(time.Unix(bucketStart, 0), HourBucket), count)
+			delete(s[MinuteBucket], bucketStart)
+		}
+	}
+}
+
+// expire removes the buckets started before the cutoff
+func (s occurrenceSeries) expire(cutoff time.Time) {
+	for _, resolutionBuckets := range s {
+		for bucketStart := range resolutionBuckets {
+			if bucketStart < cutoff.Unix() {
+				delete(resolutionBuckets, bucketStart)
+			}
+		}
+	}
+}
+
+// buckets returns the buckets of every resolution starting between from and to
+func (s occurrenceSeries) buckets(from time.Time, to time.Time) []OccurrenceBucket {
+	buckets := []OccurrenceBucket{}
+	for _, resolutionBuckets := range s {
+		for bucketStart, count := range resolutionBuckets {
+			if bucketStart >= from.Unix() && bucketStart < to.Unix() {
+				buckets = append(buckets, OccurrenceBucket{Timestamp: bucketStart, Count: count})
+			}
+		}
+	}
+	return buckets
+}
+
+// bucketStartOf returns the unix time of the start of the bucket of the given resolution containing t
+func bucketStartOf(t time.Time, resolution time.Duration) int64 {
+	return t.Truncate(resolution).Unix()
+}
+
+// histogram sums the stored buckets into consecutive buckets of step duration between from and to.
+// Every bucket of the histogram is returned, even if there were no occurrences.
+func histogram(buckets []OccurrenceBucket, from time.Time, to time.Time, step time.Duration) []OccurrenceBucket {
+	stepSeconds := int64(step.Seconds())
+	if stepSeconds <= 0 || !from.Before(to) {
+		return []OccurrenceBucket{}
+	}
+	length := (to.Unix() - from.Unix() + stepSeconds - 1) / stepSeconds
+	result := make([]OccurrenceBucket, length)
+	for i := range result {
+		result[i].Timestamp = from.Unix() + int64(i)*stepSeconds
+	}
+	for _, bucket := range buckets {
+		i := (bucket.Timestamp - from.Unix()) / stepSeconds
+		if bucket.Timestamp >= from.Unix() && i < length {
+			result[i].Count += bucket.Count
+		}
+	}
+	return result
+}
@@ -1,12 +1,29 @@
 package repository
 
 import (
+	"context"
 	"database/sql/driver"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
 
+	"github.com/periskop-dev/periskop/config"
 	"github.com/periskop-dev/periskop/metrics"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// batchSize is the maximum number of rows written, or ids queried, in a single statement
+const batchSize = 100
+
+// Failed database operations are attempted up to maxAttempts times, doubling the backoff between attempts
+const (
+	maxAttempts  = 3
+	retryBackoff = 100 * time.Millisecond
 )
 
 type ormRepository struct {
@@ -15,7 +32,7 @@ type ormRepository struct {
 }
 
 func (e *ErrorAggregate) Scan(src interface{}) error {
-	return json.Unmarshal([]byte(src.(string)), &e)
+	return scanJSON(src, e)
 }
 
 func (e ErrorAggregate) Value() (driver.Value, error) {
@@ -25,109 +42,1082 @@ func (e ErrorAggregate) Value() (driver.Value, error) {
 
 type AggregatedError struct {
 	gorm.Model
-	ServiceName    string `gorm:"index"`
-	AggregationKey string `gorm:"index"`
-	Errors         ErrorAggregate
+	ServiceName    string `gorm:"index;uniqueIndex:idx_service_aggregation_key"`
+	AggregationKey string `gorm:"index;uniqueIndex:idx_service_aggregation_key"`
+	// Errors is the whole aggregated error in json format, as stored by previous versions.
+	// It's migrated to the normalized tables when the repository is created.
+	Errors         *ErrorAggregate
 	TotalCount     int
+	Severity       string
+	ErrorCreatedAt int64
+	FirstSeen      int64
+	LastSeen       int64
+	// Status is also stored in its own column to filter errors by status
+	Status        string `gorm:"index"`
+	StatusDetails ErrorStatus
+}
+
+// toErrorAggregate returns the aggregated error without its occurrences
+func (e AggregatedError) toErrorAggregate() ErrorAggregate {
+	return ErrorAggregate{
+		AggregationKey: e.AggregationKey,
+		TotalCount:     e.TotalCount,
+		Severity:       e.Severity,
+		LatestErrors:   []ErrorWithContext{},
+		CreatedAt:      e.ErrorCreatedAt,
+		FirstSeen:      e.FirstSeen,
+		LastSeen:       e.LastSeen,
+		ErrorStatus:    e.errorStatus(),
+	}
+}
+
+// errorStatus returns the status of the error, errors stored before having a status are open
+func (e AggregatedError) errorStatus() ErrorStatus {
+	status := e.StatusDetails
+	status.Status = e.Status
+	if status.Status == "" {
+		status.Status = StatusOpen
+	}
+	return status
+}
+
+func (s *ScraperState) Scan(src interface{}) error {
+	switch value := src.(type) {
+	case []byte:
+		return json.Unmarshal(value, &s)
+	case string:
+		return json.Unmarshal([]byte(value), &s)
+	}
+	return fmt.Errorf("unsupported type %T for scraper state", src)
+}
+
+func (s ScraperState) Value() (driver.Value, error) {
+	val, err := json.Marshal(s)
+	return string(val), err
+}
+
+// ServiceScraperState holds the aggregation state of the scraper of a service
+type ServiceScraperState struct {
+	gorm.Model
+	ServiceName string `gorm:"size:191;uniqueIndex"`
+	State       ScraperState
+}
+
+// ErrorOccurrencesBucket holds the number of occurrences of an error during a time interval
+type ErrorOccurrencesBucket struct {
+	ID             uint   `gorm:"primarykey"`
+	ServiceName    string `gorm:"size:191;uniqueIndex:idx_occurrences_bucket_unique"`
+	AggregationKey string `gorm:"size:191;uniqueIndex:idx_occurrences_bucket_unique"`
+	// Resolution is the duration of the bucket in seconds
+	Resolution  int64 `gorm:"uniqueIndex:idx_occurrences_bucket_unique"`
+	BucketStart int64 `gorm:"uniqueIndex:idx_occurrences_bucket_unique"`
+	Occurrences int
+}
+
+// bucketColumns identify an occurrences bucket
+var bucketColumns = []clause.Column{
+	{Name: "service_name"}, {Name: "aggregation_key"}, {Name: "resolution"}, {Name: "bucket_start"},
 }
 
-func NewORMRepository(db *gorm.DB) ErrorsRepository {
-	err := db.AutoMigrate(&AggregatedError{})
+func NewORMRepository(db *gorm.DB) (ErrorsRepository, error) {
+	if err := removeDuplicatedErrors(db); err != nil {
+		return nil, fmt.Errorf("failed to remove duplicated errors: %w", err)
+	}
+	if err := mergeDuplicatedBuckets(db); err != nil {
+		return nil, fmt.Errorf("failed to merge duplicated occurrences buckets: %w", err)
+	}
+	if err := sizeIndexedColumns(db); err != nil {
+		return nil, fmt.Errorf("failed to size indexed columns: %w", err)
+	}
+	err := db.AutoMigrate(&AggregatedError{}, &ErrorOccurrence{}, &ErrorCause{}, &OccurrenceHTTPContext{},
+		&ServiceScraperState{}, &ErrorOccurrencesBucket{})
 	if err != nil {
-		panic("failed to create database migration")
+		return nil, fmt.Errorf("failed to create database migration: %w", err)
+	}
+	if err := migrateResolvedErrors(db); err != nil {
+		return nil, fmt.Errorf("failed to migrate resolved errors: %w", err)
+	}
+	if err := migrateErrorsColumn(db); err != nil {
+		return nil, fmt.Errorf("failed to migrate errors to the normalized tables: %w", err)
+	}
+	return &ormRepository{DB: db}, nil
+}
+
+// withRetry runs an operation on the database, retrying it with exponential backoff when it fails, so a blip of
+// the database doesn't fail the operation. Not found errors and cancelled operations aren't retried.
+func (r *ormRepository) withRetry(ctx context.Context, operation func(db *gorm.DB) error) error {
+	backoff := retryBackoff
+	for attempt := 1; ; attempt++ {
+		err := operation(r.DB.WithContext(ctx))
+		if err == nil || errors.Is(err, ErrNotFound) || attempt == maxAttempts || ctx.Err() != nil {
+			return err
+		}
+		log.Printf("Database operation failed (attempt %d of %d), retrying in %s: %s", attempt, maxAttempts,
+			backoff, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		r.reconnect(ctx)
 	}
-	return &ormRepository{DB: db}
 }
 
-func (r *ormRepository) GetErrors(serviceName string, numberOfErrors int) ([]ErrorAggregate, error) {
+// reconnect checks the connection to the database, so broken connections are discarded from the pool and
+// replaced by new ones
+func (r *ormRepository) reconnect(ctx context.Context) {
+	sqlDB, err := r.DB.DB()
+	if err != nil {
+		return
+	}
+	if err := sqlDB.PingContext(ctx); err != nil {
+		log.Printf("Failed to reconnect to the database: %s", err)
+	}
+}
+
+// removeDuplicatedErrors keeps only the last stored row of every aggregated error, previous versions could store
+// duplicated rows which prevent creating the unique index on service and aggregation key
+func removeDuplicatedErrors(db *gorm.DB) error {
+	if !db.Migrator().HasTable(&AggregatedError{}) {
+		return nil
+	}
 	aggregatedErrors := []AggregatedError{}
-	r.DB.
-		Where(&AggregatedError{ServiceName: serviceName}).
-		Find(&aggregatedErrors)
+	err := db.Unscoped().
+		Select("id", "service_name", "aggregation_key").
+		Order("id desc").
+		Find(&aggregatedErrors).Error
+	if err != nil {
+		return err
+	}
+	seen := make(map[[2]string]bool, len(aggregatedErrors))
+	duplicatedIDs := []uint{}
+	for _, aggregatedError := range aggregatedErrors {
+		key := [2]string{aggregatedError.ServiceName, aggregatedError.AggregationKey}
+		if seen[key] {
+			duplicatedIDs = append(duplicatedIDs, aggregatedError.ID)
+		}
+		seen[key] = true
+	}
+	for _, ids := range chunkIDs(duplicatedIDs) {
+		if err := db.Unscoped().Where("id IN ?", ids).Delete(&AggregatedError{}).Error; err != nil {
+			return err
+		}
+	}
+	if len(duplicatedIDs) > 0 {
+		log.Printf("Removed %d duplicated errors", len(duplicatedIDs))
+	}
+	return nil
+}
+
+// indexedColumns are the string columns of unique indexes, which MySQL can only index when they are sized
+var indexedColumns = []struct {
+	model  interface{}
+	index  string
+	fields []string
+}{
+	{&ErrorOccurrencesBucket{}, "idx_occurrences_bucket_unique", []string{"ServiceName", "AggregationKey"}},
+	{&ServiceScraperState{}, "idx_service_scraper_states_service_name", []string{"ServiceName"}},
+}
 
-	errors := []ErrorAggregate{}
+// sizeIndexedColumns sizes the string columns of unique indexes in tables of previous versions, which MySQL stored
+// as longtext, so their unique indexes can be created
+func sizeIndexedColumns(db *gorm.DB) error {
+	if db.Dialector.Name() != "mysql" {
+		return nil
+	}
+	migrator := db.Migrator()
+	for _, columns := range indexedColumns {
+		if !migrator.HasTable(columns.model) || migrator.HasIndex(columns.model, columns.index) {
+			continue
+		}
+		for _, field := range columns.fields {
+			if err := migrator.AlterColumn(columns.model, field); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// mergeDuplicatedBuckets merges the occurrences buckets of the same error and interval into the first stored one,
+// previous versions could store them before the unique index on buckets was created
+func mergeDuplicatedBuckets(db *gorm.DB) error {
+	migrator := db.Migrator()
+	if !migrator.HasTable(&ErrorOccurrencesBucket{}) ||
+		migrator.HasIndex(&ErrorOccurrencesBucket{}, "idx_occurrences_bucket_unique") {
+		return nil
+	}
+	// the unique index supersedes the index of previous versions
+	if migrator.HasIndex(&ErrorOccurrencesBucket{}, "idx_occurrences_bucket") {
+		if err := migrator.DropIndex(&ErrorOccurrencesBucket{}, "idx_occurrences_bucket"); err != nil {
+			return err
+		}
+	}
+	buckets := []ErrorOccurrencesBucket{}
+	if err := db.Order("id").Find(&buckets).Error; err != nil {
+		return err
+	}
+	type bucketID struct {
+		serviceName, key        string
+		resolution, bucketStart int64
+	}
+	merged := make(map[bucketID]ErrorOccurrencesBucket, len(buckets))
+	duplicatedIDs := []uint{}
+	for _, bucket := range buckets {
+		id := bucketID{bucket.ServiceName, bucket.AggregationKey, bucket.Resolution, bucket.BucketStart}
+		if first, seen := merged[id]; seen {
+			first.Occurrences += bucket.Occurrences
+			merged[id] = first
+			duplicatedIDs = append(duplicatedIDs, bucket.ID)
+			continue
+		}
+		merged[id] = bucket
+	}
+	if len(duplicatedIDs) == 0 {
+		return nil
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, bucket := range merged {
+			err := tx.Model(&ErrorOccurrencesBucket{}).
+				Where("id = ?", bucket.ID).
+				Update("occurrences", bucket.Occurrences).Error
+			if err != nil {
+				return err
+			}
+		}
+		for _, ids := range chunkIDs(duplicatedIDs) {
+			if err := tx.Where("id IN ?", ids).Delete(&ErrorOccurrencesBucket{}).Error; err != nil {
+				return err
+			}
+		}
+		log.Printf("Merged %d duplicated occurrences buckets", len(duplicatedIDs))
+		return nil
+	})
+}
+
+// migrateResolvedErrors converts the errors resolved by previous versions, which were soft-deleted,
+// into errors with resolved status, and opens the rest of errors stored without status
+func migrateResolvedErrors(db *gorm.DB) error {
+	resolvedErrors := []AggregatedError{}
+	err := db.Unscoped().
+		Where("deleted_at IS NOT NULL").
+		Find(&resolvedErrors).Error
+	if err != nil {
+		return err
+	}
+	for _, resolvedError := range resolvedErrors {
+		status := NewErrorStatus().Apply(StatusChange{Status: StatusResolved}, resolvedError.TotalCount,
+			resolvedError.DeletedAt.Time)
+		err := db.Model(&AggregatedError{}).
+			Unscoped().
+			Where("id = ?", resolvedError.ID).
+			Updates(map[string]interface{}{
+				"deleted_at":     nil,
+				"status":         status.Status,
+				"status_details": status,
+			}).Error
+		if err != nil {
+			return err
+		}
+	}
+	// errors stored before having a status are open
+	return db.Model(&AggregatedError{}).
+		Where("status IS NULL").
+		Update("status", StatusOpen).Error
+}
+
+// migrateErrorsColumn moves the aggregated errors stored in json format by previous versions
+// to the normalized tables
+func migrateErrorsColumn(db *gorm.DB) error {
+	aggregatedErrors := []AggregatedError{}
+	if err := db.Where("errors IS NOT NULL").Find(&aggregatedErrors).Error; err != nil {
+		return err
+	}
 	for _, aggregatedError := range aggregatedErrors {
-		errorObj := aggregatedError.Errors
-		maxErrors := len(errorObj.LatestErrors)
-		if numberOfErrors < maxErrors {
-			maxErrors = numberOfErrors
+		errorAggregate := aggregatedError.Errors
+		err := db.Transaction(func(tx *gorm.DB) error {
+			err := syncOccurrences(tx, map[uint][]ErrorWithContext{aggregatedError.ID: errorAggregate.LatestErrors})
+			if err != nil {
+				return err
+			}
+			return tx.Model(&AggregatedError{}).
+				Where("id = ?", aggregatedError.ID).
+				Updates(map[string]interface{}{
+					"severity":         errorAggregate.Severity,
+					"error_created_at": errorAggregate.CreatedAt,
+					"first_seen":       errorAggregate.CreatedAt,
+					"last_seen":        lastOccurrenceTime(*errorAggregate),
+					"errors":           nil,
+				}).Error
+		})
+		if err != nil {
+			log.Printf("Failed to migrate error %s of service %s: %s", aggregatedError.AggregationKey,
+				aggregatedError.ServiceName, err)
+		}
+	}
+	if len(aggregatedErrors) > 0 {
+		log.Printf("Migrated %d errors to the normalized tables", len(aggregatedErrors))
+	}
+	return nil
+}
+
+// lastOccurrenceTime returns the time of the newest occurrence of an error, or its creation time if it has none
+func lastOccurrenceTime(errorAggregate ErrorAggregate) int64 {
+	lastSeen := errorAggregate.CreatedAt
+	for _, occurrence := range errorAggregate.LatestErrors {
+		if occurrence.Timestamp > lastSeen {
+			lastSeen = occurrence.Timestamp
+		}
+	}
+	return lastSeen
+}
+
+// aggregatedErrorIDs returns the ids of aggregated errors
+func aggregatedErrorIDs(aggregatedErrors []AggregatedError) []uint {
+	ids := make([]uint, 0, len(aggregatedErrors))
+	for _, aggregatedError := range aggregatedErrors {
+		ids = append(ids, aggregatedError.ID)
+	}
+	return ids
+}
+
+// GetErrors fetches the last numberOfErrors of each aggregation of errors for the given service.
+// Resolved, ignored and snoozed errors are not listed.
+func (r *ormRepository) GetErrors(ctx context.Context, serviceName string,
+	numberOfErrors int) ([]ErrorAggregate, error) {
+	errorAggregates := []ErrorAggregate{}
+	err := r.withRetry(ctx, func(db *gorm.DB) error {
+		aggregatedErrors := []AggregatedError{}
+		err := db.
+			Where(&AggregatedError{ServiceName: serviceName}).
+			Where("status IN ?", visibleStatuses).
+			Find(&aggregatedErrors).Error
+		if err != nil {
+			return err
+		}
+		if len(aggregatedErrors) == 0 {
+			return findService(db, serviceName)
+		}
+
+		latestErrors, err := latestOccurrences(db, aggregatedErrorIDs(aggregatedErrors), numberOfErrors)
+		if err != nil {
+			return err
+		}
+		errorAggregates = make([]ErrorAggregate, 0, len(aggregatedErrors))
+		for _, aggregatedError := range aggregatedErrors {
+			errorObj := aggregatedError.toErrorAggregate()
+			errorObj.LatestErrors = latestErrors[aggregatedError.ID]
+			errorAggregates = append(errorAggregates, errorObj)
+		}
+		return nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		metrics.ServiceErrors.WithLabelValues("service_not_found").Inc()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return errorAggregates, nil
+}
+
+// visibleStatuses are the statuses of the listed errors, errors stored before having a status are open
+var visibleStatuses = []string{"", StatusOpen, StatusRegressed}
+
+// sortColumns are the columns errors are sorted by for each sort of a query
+var sortColumns = map[string]string{
+	SortByCount:     "total_count",
+	SortByLastSeen:  "last_seen",
+	SortByCreatedAt: "error_created_at",
+}
+
+// findService returns a not found error if the service doesn't exist. Services exist as long as they have errors,
+// even if none of them is listed.
+func findService(db *gorm.DB, serviceName string) error {
+	var count int64
+	err := db.Model(&AggregatedError{}).Where("service_name = ?", serviceName).Count(&count).Error
+	if err == nil && count == 0 {
+		err = fmt.Errorf("service %s %w", serviceName, ErrNotFound)
+	}
+	return err
+}
+
+// QueryErrors lists the errors of a service like GetErrors, filtered, sorted and paginated by the query
+func (r *ormRepository) QueryErrors(ctx context.Context, serviceName string, query ErrorsQuery) (ErrorsPage, error) {
+	cursor, err := query.cursor()
+	if err != nil {
+		return ErrorsPage{}, err
+	}
+	sortBy := query.GetSort()
+	column := sortColumns[sortBy]
+
+	page := ErrorsPage{}
+	err = r.withRetry(ctx, func(db *gorm.DB) error {
+		tx := db.
+			Where(&AggregatedError{ServiceName: serviceName}).
+			Where("status IN ?", visibleStatuses)
+		if query.Severity != "" {
+			tx = tx.Where("severity = ?", query.Severity)
+		}
+		if query.Search != "" {
+			pattern := likePattern(query.Search)
+			matchingOccurrences := db.Model(&ErrorOccurrence{}).
+				Select("1").
+				Where("error_occurrences.aggregated_error_id = aggregated_errors.id").
+				Where("(LOWER(class) LIKE ? ESCAPE '!' OR LOWER(message) LIKE ? ESCAPE '!')", pattern, pattern)
+			tx = tx.Where("(LOWER(aggregation_key) LIKE ? ESCAPE '!' OR EXISTS (?))", pattern, matchingOccurrences)
+		}
+		if cursor != nil {
+			tx = tx.Where(fmt.Sprintf("(%s < ? OR (%s = ? AND aggregation_key > ?))", column, column),
+				cursor.value, cursor.value, cursor.key)
 		}
-		errorObj.LatestErrors = errorObj.LatestErrors[0:maxErrors]
-		errors = append(errors, errorObj)
+		tx = tx.Order(column + " desc").Order("aggregation_key")
+		if query.Limit > 0 {
+			// an extra error is fetched to know if there is a next page
+			tx = tx.Limit(query.Limit + 1)
+		}
+		aggregatedErrors := []AggregatedError{}
+		if err := tx.Find(&aggregatedErrors).Error; err != nil {
+			return err
+		}
+		if len(aggregatedErrors) == 0 {
+			page = ErrorsPage{Errors: []ErrorAggregate{}}
+			return findService(db, serviceName)
+		}
+
+		page = ErrorsPage{Errors: make([]ErrorAggregate, 0, len(aggregatedErrors))}
+		if query.Limit > 0 && len(aggregatedErrors) > query.Limit {
+			aggregatedErrors = aggregatedErrors[:query.Limit]
+			last := aggregatedErrors[query.Limit-1].toErrorAggregate()
+			page.NextCursor = errorsCursor{sort: sortBy, value: sortValue(last, sortBy), key: last.AggregationKey}.encode()
+		}
+		latestErrors, err := latestOccurrences(db, aggregatedErrorIDs(aggregatedErrors), query.NumberOfErrors)
+		if err != nil {
+			return err
+		}
+		for _, aggregatedError := range aggregatedErrors {
+			errorObj := aggregatedError.toErrorAggregate()
+			errorObj.LatestErrors = latestErrors[aggregatedError.ID]
+			page.Errors = append(page.Errors, errorObj)
+		}
+		return nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		metrics.ServiceErrors.WithLabelValues("service_not_found").Inc()
+	}
+	if err != nil {
+		return ErrorsPage{}, err
 	}
-	if len(errors) > 0 {
-		return errors, nil
+	return page, nil
+}
+
+// likePattern returns a LIKE pattern, escaped with !, matching the values containing the text ignoring case
+func likePattern(text string) string {
+	escaped := strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(strings.ToLower(text))
+	return "%" + escaped + "%"
+}
+
+// ReplaceErrors stores the new list of errors for a service name, along with their latest occurrences.
+// All the errors are written in a single transaction, so a failure doesn't leave them partially stored.
+func (r *ormRepository) ReplaceErrors(ctx context.Context, serviceName string, errors []ErrorAggregate) error {
+	err := r.withRetry(ctx, func(db *gorm.DB) error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			return replaceErrors(tx, serviceName, errors)
+		})
+	})
+	if err != nil {
+		metrics.ServiceErrors.WithLabelValues("replace_errors").Inc()
+		return fmt.Errorf("failed to store errors of service %s: %w", serviceName, err)
 	}
-	metrics.ServiceErrors.WithLabelValues("service_not_found").Inc()
-	return nil, fmt.Errorf("service %s not found", serviceName)
+	return nil
 }
 
-// ReplaceErrors deletes previous stored errors for a service name and stores the new list of errors in json format
-func (r *ormRepository) ReplaceErrors(serviceName string, errors []ErrorAggregate) {
+// replaceErrors upserts in batches the errors that are new or have more occurrences than before
+func replaceErrors(tx *gorm.DB, serviceName string, errors []ErrorAggregate) error {
+	storedByKey, err := storedErrors(tx, serviceName)
+	if err != nil {
+		return err
+	}
+
+	changedErrors := []AggregatedError{}
+	latestErrors := make(map[string][]ErrorWithContext)
 	for _, errorAggregate := range errors {
-		errObj := AggregatedError{}
 		key := errorAggregate.AggregationKey
-		result := r.DB.Model(&AggregatedError{}).
-			Where("service_name = ?", serviceName).
-			Where("aggregation_key = ?", key).
-			First(&errObj)
+		// only update if there are more errors than before
+		if stored, exists := storedByKey[key]; exists && errorAggregate.TotalCount <= stored.TotalCount {
+			continue
+		}
+		changedErrors = append(changedErrors, AggregatedError{
+			ServiceName:    serviceName,
+			AggregationKey: key,
+			TotalCount:     errorAggregate.TotalCount,
+			Severity:       errorAggregate.Severity,
+			ErrorCreatedAt: errorAggregate.CreatedAt,
+			FirstSeen:      errorAggregate.FirstSeen,
+			LastSeen:       errorAggregate.LastSeen,
+			Status:         StatusOpen,
+			StatusDetails:  NewErrorStatus(),
+		})
+		latestErrors[key] = errorAggregate.LatestErrors
+	}
+	// the status of existing errors is kept
+	return upsertErrors(tx, serviceName, changedErrors, latestErrors, []string{"updated_at", "total_count", "severity",
+		"error_created_at", "first_seen", "last_seen"})
+}
+
+// upsertErrors creates in batches the given errors, updating the given columns of the existing ones,
+// and stores their latest occurrences
+func upsertErrors(tx *gorm.DB, serviceName string, aggregatedErrors []AggregatedError,
+	latestErrors map[string][]ErrorWithContext, updatedColumns []string) error {
+	if len(aggregatedErrors) == 0 {
+		return nil
+	}
+	err := tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "service_name"}, {Name: "aggregation_key"}},
+		DoUpdates: clause.AssignmentColumns(updatedColumns),
+	}).CreateInBatches(&aggregatedErrors, batchSize).Error
+	if err != nil {
+		return err
+	}
+
+	storedByKey, err := storedErrors(tx, serviceName)
+	if err != nil {
+		return err
+	}
+	occurrences := make(map[uint][]ErrorWithContext, len(latestErrors))
+	for key, latest := range latestErrors {
+		occurrences[storedByKey[key].ID] = latest
+	}
+	return syncOccurrences(tx, occurrences)
+}
+
+// ExportErrors fetches every error of a service with its status and all its stored occurrences
+func (r *ormRepository) ExportErrors(ctx context.Context, serviceName string) ([]ErrorAggregate, error) {
+	errorAggregates := []ErrorAggregate{}
+	err := r.withRetry(ctx, func(db *gorm.DB) error {
+		aggregatedErrors := []AggregatedError{}
+		result := db.Where(&AggregatedError{ServiceName: serviceName}).Find(&aggregatedErrors)
+		if result.Error != nil {
+			return result.Error
+		}
 		if result.RowsAffected == 0 {
-			r.DB.Create(&AggregatedError{
+			return fmt.Errorf("service %s %w", serviceName, ErrNotFound)
+		}
+
+		latestErrors, err := latestOccurrences(db, aggregatedErrorIDs(aggregatedErrors), math.MaxInt32)
+		if err != nil {
+			return err
+		}
+		errorAggregates = make([]ErrorAggregate, 0, len(aggregatedErrors))
+		for _, aggregatedError := range aggregatedErrors {
+			errorObj := aggregatedError.toErrorAggregate()
+			errorObj.LatestErrors = latestErrors[aggregatedError.ID]
+			errorAggregates = append(errorAggregates, errorObj)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return errorAggregates, nil
+}
+
+// ImportErrors stores errors of a service with their status, replacing the stored errors with the same
+// aggregation key. All the errors are written in a single transaction.
+func (r *ormRepository) ImportErrors(ctx context.Context, serviceName string, errors []ErrorAggregate) error {
+	err := r.withRetry(ctx, func(db *gorm.DB) error {
+		aggregatedErrors := make([]AggregatedError, 0, len(errors))
+		latestErrors := make(map[string][]ErrorWithContext, len(errors))
+		for _, errorAggregate := range errors {
+			aggregatedErrors = append(aggregatedErrors, AggregatedError{
 				ServiceName:    serviceName,
-				Errors:         errorAggregate,
-				AggregationKey: key,
+				AggregationKey: errorAggregate.AggregationKey,
 				TotalCount:     errorAggregate.TotalCount,
+				Severity:       errorAggregate.Severity,
+				ErrorCreatedAt: errorAggregate.CreatedAt,
+				FirstSeen:      errorAggregate.FirstSeen,
+				LastSeen:       errorAggregate.LastSeen,
+				Status:         errorAggregate.Status,
+				StatusDetails:  errorAggregate.ErrorStatus,
 			})
-		} else if errorAggregate.TotalCount > errObj.TotalCount { // only update if there are more errors than before
-			r.DB.Model(&AggregatedError{}).
-				Where("service_name = ?", serviceName).
-				Where("aggregation_key = ?", key).
-				Update("total_count", errorAggregate.TotalCount).
-				Update("errors", errorAggregate)
+			latestErrors[errorAggregate.AggregationKey] = errorAggregate.LatestErrors
 		}
+		return db.Transaction(func(tx *gorm.DB) error {
+			return upsertErrors(tx, serviceName, aggregatedErrors, latestErrors, []string{"updated_at", "total_count",
+				"severity", "error_created_at", "first_seen", "last_seen", "status", "status_details"})
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to import errors of service %s: %w", serviceName, err)
 	}
+	return nil
 }
 
-// GetServices fetches the list of unique services
-func (r *ormRepository) GetServices() []string {
+// storedErrors fetches the id and total count of the stored errors of a service by aggregation key
+func storedErrors(tx *gorm.DB, serviceName string) (map[string]AggregatedError, error) {
 	aggregatedErrors := []AggregatedError{}
-	keys := make([]string, 0)
-	r.DB.
-		Distinct("service_name").
-		Find(&aggregatedErrors)
+	err := tx.
+		Select("id", "aggregation_key", "total_count").
+		Where("service_name = ?", serviceName).
+		Find(&aggregatedErrors).Error
+	stored := make(map[string]AggregatedError, len(aggregatedErrors))
 	for _, aggregatedError := range aggregatedErrors {
-		keys = append(keys, aggregatedError.ServiceName)
+		stored[aggregatedError.AggregationKey] = aggregatedError
 	}
-	return keys
+	return stored, err
 }
 
-// ResolveError marks the given error as soft-deleted (updating deleted_at)
-func (r *ormRepository) ResolveError(serviceName string, key string) error {
-	r.DB.
-		Where("service_name = ?", serviceName).
-		Where("aggregation_key = ?", key).
-		Delete(&AggregatedError{})
-	return nil
+// GetServices fetches the list of unique services, sorted by name
+func (r *ormRepository) GetServices(ctx context.Context) ([]string, error) {
+	keys := make([]string, 0)
+	err := r.withRetry(ctx, func(db *gorm.DB) error {
+		return db.Model(&AggregatedError{}).
+			Distinct().
+			Order("service_name").
+			Pluck("service_name", &keys).Error
+	})
+	return keys, err
 }
 
-// RemoveResolved removes a soft-deletion of the given error
-func (r *ormRepository) RemoveResolved(serviceName string, key string) {
-	r.DB.Model(&AggregatedError{}).
-		Where("service_name = ?", serviceName).
-		Where("aggregation_key = ?", key).
-		Unscoped().
-		Update("deleted_at", nil)
+// ResolveError changes the status of the error to resolved
+func (r *ormRepository) ResolveError(ctx context.Context, serviceName string, key string) error {
+	return r.SetErrorStatus(ctx, serviceName, key, StatusChange{Status: StatusResolved})
+}
+
+// RemoveResolved reopens a resolved error
+func (r *ormRepository) RemoveResolved(ctx context.Context, serviceName string, key string) error {
+	resolved, err := r.SearchResolved(ctx, serviceName, key)
+	if err != nil || !resolved {
+		return err
+	}
+	return r.SetErrorStatus(ctx, serviceName, key, StatusChange{Status: StatusOpen})
 }
 
 // SearchResolved returns true if the given error was marked previously as resolved
-func (r *ormRepository) SearchResolved(serviceName string, key string) bool {
+func (r *ormRepository) SearchResolved(ctx context.Context, serviceName string, key string) (bool, error) {
 	var count int64
-	r.DB.
-		Model(&AggregatedError{}).
+	err := r.withRetry(ctx, func(db *gorm.DB) error {
+		return db.
+			Model(&AggregatedError{}).
+			Where("service_name = ?", serviceName).
+			Where("aggregation_key = ?", key).
+			Where("status = ?", StatusResolved).
+			Count(&count).Error
+	})
+	return count >= 1, err
+}
+
+// GetErrorStatus fetches the status of an error, errors are open until their status changes
+func (r *ormRepository) GetErrorStatus(ctx context.Context, serviceName string, key string) (ErrorStatus, error) {
+	status := NewErrorStatus()
+	err := r.withRetry(ctx, func(db *gorm.DB) error {
+		aggregatedError, err := findError(db, serviceName, key)
+		if err == nil {
+			status = aggregatedError.errorStatus()
+		}
+		return err
+	})
+	if errors.Is(err, ErrNotFound) {
+		return status, nil
+	}
+	return status, err
+}
+
+// GetErrorStatuses fetches the statuses of the errors of a service that aren't open, by aggregation key
+func (r *ormRepository) GetErrorStatuses(ctx context.Context, serviceName string) (map[string]ErrorStatus, error) {
+	statuses := make(map[string]ErrorStatus)
+	err := r.withRetry(ctx, func(db *gorm.DB) error {
+		aggregatedErrors := []AggregatedError{}
+		err := db.
+			Select("aggregation_key", "status", "status_details").
+			Where("service_name = ?", serviceName).
+			Where("status NOT IN ?", []string{"", StatusOpen}).
+			Find(&aggregatedErrors).Error
+		if err != nil {
+			return err
+		}
+		for _, aggregatedError := range aggregatedErrors {
+			statuses[aggregatedError.AggregationKey] = aggregatedError.errorStatus()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+// SetErrorStatus changes the status of an error, recording the transition in its history
+func (r *ormRepository) SetErrorStatus(ctx context.Context, serviceName string, key string,
+	change StatusChange) error {
+	return r.withRetry(ctx, func(db *gorm.DB) error {
+		aggregatedError, err := findError(db, serviceName, key)
+		if err != nil {
+			return err
+		}
+		status := aggregatedError.errorStatus().Apply(change, aggregatedError.TotalCount, time.Now())
+		return db.Model(&AggregatedError{}).
+			Where("id = ?", aggregatedError.ID).
+			Updates(map[string]interface{}{
+				"status":         status.Status,
+				"status_details": status,
+			}).Error
+	})
+}
+
+// GetError fetches an error of a service whatever its status, with its last numberOfErrors occurrences
+func (r *ormRepository) GetError(ctx context.Context, serviceName string, key string,
+	numberOfErrors int) (ErrorAggregate, error) {
+	errorAggregate := ErrorAggregate{}
+	err := r.withRetry(ctx, func(db *gorm.DB) error {
+		aggregatedError, err := findError(db, serviceName, key)
+		if err != nil {
+			return err
+		}
+		latestErrors, err := latestOccurrences(db, []uint{aggregatedError.ID}, numberOfErrors)
+		if err != nil {
+			return err
+		}
+		errorAggregate = aggregatedError.toErrorAggregate()
+		errorAggregate.LatestErrors = latestErrors[aggregatedError.ID]
+		return nil
+	})
+	return errorAggregate, err
+}
+
+// findError fetches an aggregated error by service and aggregation key
+func findError(db *gorm.DB, serviceName string, key string) (AggregatedError, error) {
+	aggregatedError := AggregatedError{}
+	result := db.
 		Where("service_name = ?", serviceName).
 		Where("aggregation_key = ?", key).
-		Where("deleted_at is NOT NULL").
-		Unscoped().
-		Count(&count)
-	return count >= 1
+		Limit(1).
+		Find(&aggregatedError)
+	if result.Error != nil {
+		return aggregatedError, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return aggregatedError, fmt.Errorf("error %s of service %s %w", key, serviceName, ErrNotFound)
+	}
+	return aggregatedError, nil
+}
+
+// StoreScraperState stores the aggregation state of the scraper of a service in json format
+func (r *ormRepository) StoreScraperState(ctx context.Context, serviceName string, state ScraperState) error {
+	return r.withRetry(ctx, func(db *gorm.DB) error {
+		var count int64
+		err := db.Model(&ServiceScraperState{}).
+			Where("service_name = ?", serviceName).
+			Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return db.Create(&ServiceScraperState{
+				ServiceName: serviceName,
+				State:       state,
+			}).Error
+		}
+		return db.Model(&ServiceScraperState{}).
+			Where("service_name = ?", serviceName).
+			Update("state", state).Error
+	})
+}
+
+// GetScraperState fetches the aggregation state of the scraper of a service
+func (r *ormRepository) GetScraperState(ctx context.Context, serviceName string) (ScraperState, error) {
+	scraperState := ServiceScraperState{}
+	err := r.withRetry(ctx, func(db *gorm.DB) error {
+		result := db.
+			Where("service_name = ?", serviceName).
+			Limit(1).
+			Find(&scraperState)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("scraper state for service %s %w", serviceName, ErrNotFound)
+		}
+		return nil
+	})
+	return scraperState.State, err
+}
+
+// AddOccurrences records the new occurrences of the errors of a service in minute buckets.
+// The occurrences are added in a single transaction, so retries don't count them twice.
+func (r *ormRepository) AddOccurrences(ctx context.Context, serviceName string, occurrences map[string]int,
+	at time.Time) error {
+	buckets := make([]ErrorOccurrencesBucket, 0, len(occurrences))
+	for key, count := range occurrences {
+		buckets = append(buckets, ErrorOccurrencesBucket{
+			ServiceName:    serviceName,
+			AggregationKey: key,
+			Resolution:     int64(MinuteBucket.Seconds()),
+			BucketStart:    bucketStartOf(at, MinuteBucket),
+			Occurrences:    count,
+		})
+	}
+	return r.withRetry(ctx, func(db *gorm.DB) error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			if err := addToBuckets(tx, buckets); err != nil {
+				return err
+			}
+			return rollupOccurrences(tx, serviceName, at)
+		})
+	})
+}
+
+// addToBuckets adds occurrences to buckets in batches, creating the missing buckets.
+// Every bucket must be unique, as a batch can't update the same bucket twice.
+func addToBuckets(tx *gorm.DB, buckets []ErrorOccurrencesBucket) error {
+	if len(buckets) == 0 {
+		return nil
+	}
+	added := gorm.Expr("error_occurrences_buckets.occurrences + excluded.occurrences")
+	if tx.Dialector.Name() == "mysql" {
+		added = gorm.Expr("occurrences + VALUES(occurrences)")
+	}
+	return tx.Clauses(clause.OnConflict{
+		Columns:   bucketColumns,
+		DoUpdates: clause.Assignments(map[string]interface{}{"occurrences": added}),
+	}).CreateInBatches(&buckets, batchSize).Error
+}
+
+// rollupOccurrences moves the minute buckets older than the minute buckets retention to hour buckets
+func rollupOccurrences(tx *gorm.DB, serviceName string, now time.Time) error {
+	buckets := []ErrorOccurrencesBucket{}
+	err := tx.
+		Where("service_name = ?", serviceName).
+		Where("resolution = ?", int64(MinuteBucket.Seconds())).
+		Where("bucket_start < ?", now.Add(-minuteBucketsRetention).Unix()).
+		Find(&buckets).Error
+	if err != nil {
+		return err
+	}
+	// the minute buckets are summed by hour first, so every hour bucket is added once
+	type hourBucket struct {
+		key         string
+		bucketStart int64
+	}
+	hours := make(map[hourBucket]int)
+	expiredIDs := make([]uint, 0, len(buckets))
+	for _, bucket := range buckets {
+		hours[hourBucket{bucket.AggregationKey, bucketStartOf(time.Unix(bucket.BucketStart, 0), HourBucket)}] +=
+			bucket.Occurrences
+		expiredIDs = append(expiredIDs, bucket.ID)
+	}
+	hourBuckets := make([]ErrorOccurrencesBucket, 0, len(hours))
+	for hour, count := range hours {
+		hourBuckets = append(hourBuckets, ErrorOccurrencesBucket{
+			ServiceName:    serviceName,
+			AggregationKey: hour.key,
+			Resolution:     int64(HourBucket.Seconds()),
+			BucketStart:    hour.bucketStart,
+			Occurrences:    count,
+		})
+	}
+	if err := addToBuckets(tx, hourBuckets); err != nil {
+		return err
+	}
+	for _, ids := range chunkIDs(expiredIDs) {
+		if err := tx.Where("id IN ?", ids).Delete(&ErrorOccurrencesBucket{}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetOccurrencesHistogram fetches the occurrences of an error between from and to, in buckets of step duration
+func (r *ormRepository) GetOccurrencesHistogram(ctx context.Context, serviceName string, key string,
+	from time.Time, to time.Time, step time.Duration) ([]OccurrenceBucket, error) {
+	stored := []ErrorOccurrencesBucket{}
+	err := r.withRetry(ctx, func(db *gorm.DB) error {
+		return db.
+			Where("service_name = ?", serviceName).
+			Where("aggregation_key = ?", key).
+			Where("bucket_start >= ?", from.Unix()).
+			Where("bucket_start < ?", to.Unix()).
+			Find(&stored).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := make([]OccurrenceBucket, 0, len(stored))
+	for _, bucket := range stored {
+		buckets = append(buckets, OccurrenceBucket{Timestamp: bucket.BucketStart, Count: bucket.Occurrences})
+	}
+	return histogram(buckets, from, to, step), nil
+}
+
+// Prune removes the errors and occurrences exceeding the retention policies, service by service
+func (r *ormRepository) Prune(ctx context.Context, retention config.Retention, now time.Time) (PruneResult, error) {
+	result := PruneResult{}
+	services, err := r.GetServices(ctx)
+	if err != nil {
+		return result, err
+	}
+	for _, serviceName := range services {
+		pruned, serviceResult, err := r.pruneService(ctx, serviceName, retention, now)
+		if err != nil {
+			return result, fmt.Errorf("failed to prune errors of service %s: %w", serviceName, err)
+		}
+		result.add(serviceName, serviceResult, pruned)
+	}
+	return result, nil
+}
+
+// pruneService removes the errors and occurrences of a service exceeding the retention policies
+// in a single transaction, returning the pruned errors by aggregation key
+func (r *ormRepository) pruneService(ctx context.Context, serviceName string, retention config.Retention,
+	now time.Time) (map[string]bool, PruneResult, error) {
+	var pruned map[string]bool
+	result := PruneResult{}
+	err := r.withRetry(ctx, func(db *gorm.DB) error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			aggregatedErrors := []AggregatedError{}
+			err := tx.
+				Select("id", "aggregation_key", "error_created_at", "last_seen", "status", "status_details").
+				Where("service_name = ?", serviceName).
+				Find(&aggregatedErrors).Error
+			if err != nil {
+				return err
+			}
+			errorAggregates := make([]ErrorAggregate, 0, len(aggregatedErrors))
+			for _, aggregatedError := range aggregatedErrors {
+				errorAggregates = append(errorAggregates, aggregatedError.toErrorAggregate())
+			}
+			var serviceResult PruneResult
+			pruned, serviceResult = prunedErrors(errorAggregates, retention, now)
+
+			prunedIDs := []uint{}
+			keptIDs := []uint{}
+			for _, aggregatedError := range aggregatedErrors {
+				if pruned[aggregatedError.AggregationKey] {
+					prunedIDs = append(prunedIDs, aggregatedError.ID)
+				} else {
+					keptIDs = append(keptIDs, aggregatedError.ID)
+				}
+			}
+			if err := deleteErrors(tx, serviceName, prunedIDs, pruned); err != nil {
+				return err
+			}
+			if retention.MaxOccurrences > 0 {
+				serviceResult.Occurrences, err = capOccurrences(tx, keptIDs, retention.MaxOccurrences)
+				if err != nil {
+					return err
+				}
+			}
+			if retention.MaxAge > 0 {
+				err := tx.
+					Where("service_name = ?", serviceName).
+					Where("bucket_start < ?", now.Add(-retention.MaxAge).Unix()).
+					Delete(&ErrorOccurrencesBucket{}).Error
+				if err != nil {
+					return err
+				}
+			}
+			if err := pruneScraperState(tx, serviceName, pruned); err != nil {
+				return err
+			}
+			result = serviceResult
+			return nil
+		})
+	})
+	return pruned, result, err
+}
+
+// pruneScraperState removes the pruned errors from the scraper state of a service
+func pruneScraperState(tx *gorm.DB, serviceName string, pruned map[string]bool) error {
+	if len(pruned) == 0 {
+		return nil
+	}
+	scraperState := ServiceScraperState{}
+	result := tx.Where("service_name = ?", serviceName).Limit(1).Find(&scraperState)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return result.Error
+	}
+	return tx.Model(&ServiceScraperState{}).
+		Where("id = ?", scraperState.ID).
+		Update("state", withoutErrors(scraperState.State, pruned)).Error
+}
+
+// deleteErrors deletes aggregated errors of a service along with their occurrences and occurrences buckets
+func deleteErrors(tx *gorm.DB, serviceName string, ids []uint, keys map[string]bool) error {
+	for _, chunk := range chunkIDs(ids) {
+		occurrenceIDs := []uint{}
+		err := tx.Model(&ErrorOccurrence{}).
+			Where("aggregated_error_id IN ?", chunk).
+			Pluck("id", &occurrenceIDs).Error
+		if err != nil {
+			return err
+		}
+		if err := deleteOccurrences(tx, occurrenceIDs); err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("id IN ?", chunk).Delete(&AggregatedError{}).Error; err != nil {
+			return err
+		}
+	}
+
+	aggregationKeys := make([]string, 0, len(keys))
+	for key := range keys {
+		aggregationKeys = append(aggregationKeys, key)
+	}
+	for len(aggregationKeys) > 0 {
+		chunk := aggregationKeys
+		if len(chunk) > batchSize {
+			chunk = chunk[:batchSize]
+		}
+		aggregationKeys = aggregationKeys[len(chunk):]
+		err := tx.
+			Where("service_name = ?", serviceName).
+			Where("aggregation_key IN ?", chunk).
+			Delete(&ErrorOccurrencesBucket{}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// capOccurrences deletes the oldest occurrences of the aggregated errors having more than maxOccurrences,
+// returning the number of occurrences deleted
+func capOccurrences(tx *gorm.DB, aggregatedErrorIDs []uint, maxOccurrences int) (int, error) {
+	type occurrencesCount struct {
+		AggregatedErrorID uint
+		Count             int
+	}
+	deleted := 0
+	for _, chunk := range chunkIDs(aggregatedErrorIDs) {
+		counts := []occurrencesCount{}
+		err := tx.Model(&ErrorOccurrence{}).
+			Select("aggregated_error_id, count(*) AS count").
+			Where("aggregated_error_id IN ?", chunk).
+			Group("aggregated_error_id").
+			Having("count(*) > ?", maxOccurrences).
+			Scan(&counts).Error
+		if err != nil {
+			return deleted, err
+		}
+		for _, count := range counts {
+			// the same order as latestOccurrences, so the listed occurrences are kept
+			obsoleteIDs := []uint{}
+			err := tx.Model(&ErrorOccurrence{}).
+				Where("aggregated_error_id = ?", count.AggregatedErrorID).
+				Order("occurred_at desc").
+				Order("id").
+				Offset(maxOccurrences).
+				Limit(count.Count-maxOccurrences).
+				Pluck("id", &obsoleteIDs).Error
+			if err != nil {
+				return deleted, err
+			}
+			if err := deleteOccurrences(tx, obsoleteIDs); err != nil {
+				return deleted, err
+			}
+			deleted += len(obsoleteIDs)
+		}
+	}
+	return deleted, nil
 }
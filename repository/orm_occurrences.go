@@ -0,0 +1,358 @@
+package repository
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+// ErrorOccurrence is an occurrence of an aggregated error
+type ErrorOccurrence struct {
+	ID                uint   `gorm:"primarykey"`
+	AggregatedErrorID uint   `gorm:"index:idx_occurrence_error_time"`
+	OccurredAt        int64  `gorm:"index:idx_occurrence_error_time"`
+	UUID              string `gorm:"index"`
+	Severity          string
+	Class             string
+	Message           string
+	Stacktrace        jsonStrings
+	Causes            []ErrorCause
+	HTTPContext       *OccurrenceHTTPContext
+}
+
+// ErrorCause is a cause of an occurrence, the direct cause having depth 1, its cause depth 2 and so on
+type ErrorCause struct {
+	ID                uint `gorm:"primarykey"`
+	ErrorOccurrenceID uint `gorm:"index"`
+	Depth             int
+	Class             string
+	Message           string
+	Stacktrace        jsonStrings
+}
+
+// OccurrenceHTTPContext is the HTTP request during which an occurrence happened
+type OccurrenceHTTPContext struct {
+	ID                uint `gorm:"primarykey"`
+	ErrorOccurrenceID uint `gorm:"uniqueIndex"`
+	RequestMethod     string
+	RequestURL        string
+	RequestHeaders    jsonStringMap
+	RequestBody       string
+}
+
+// jsonStrings stores a list of strings, like stacktraces, in json format
+type jsonStrings []string
+
+func (s *jsonStrings) Scan(src interface{}) error {
+	return scanJSON(src, s)
+}
+
+func (s jsonStrings) Value() (driver.Value, error) {
+	val, err := json.Marshal(s)
+	return string(val), err
+}
+
+// jsonStringMap stores a map of strings, like HTTP headers, in json format
+type jsonStringMap map[string]string
+
+func (m *jsonStringMap) Scan(src interface{}) error {
+	return scanJSON(src, m)
+}
+
+func (m jsonStringMap) Value() (driver.Value, error) {
+	val, err := json.Marshal(m)
+	return string(val), err
+}
+
+func scanJSON(src interface{}, dest interface{}) error {
+	switch value := src.(type) {
+	case nil:
+		return nil
+	case []byte:
+		return json.Unmarshal(value, dest)
+	case string:
+		return json.Unmarshal([]byte(value), dest)
+	}
+	return fmt.Errorf("unsupported type %T for json column", src)
+}
+
+func newErrorOccurrence(aggregatedErrorID uint, occurrence ErrorWithContext) ErrorOccurrence {
+	errorOccurrence := ErrorOccurrence{
+		AggregatedErrorID: aggregatedErrorID,
+		OccurredAt:        occurrence.Timestamp,
+		UUID:              occurrence.UUID,
+		Severity:          occurrence.Severity,
+		Class:             occurrence.Error.Class,
+		Message:           occurrence.Error.Message,
+		Stacktrace:        occurrence.Error.Stacktrace,
+	}
+	depth := 1
+	for cause := occurrence.Error.Cause; cause != nil; cause = cause.Cause {
+		errorOccurrence.Causes = append(errorOccurrence.Causes, ErrorCause{
+			Depth:      depth,
+			Class:      cause.Class,
+			Message:    cause.Message,
+			Stacktrace: cause.Stacktrace,
+		})
+		depth++
+	}
+	if context := occurrence.HTTPContext; context != nil {
+		errorOccurrence.HTTPContext = &OccurrenceHTTPContext{
+			RequestMethod:  context.RequestMethod,
+			RequestURL:     context.RequestURL,
+			RequestHeaders: context.RequestHeaders,
+			RequestBody:    context.RequestBody,
+		}
+	}
+	return errorOccurrence
+}
+
+func (o ErrorOccurrence) toErrorWithContext() ErrorWithContext {
+	occurrence := ErrorWithContext{
+		Error: ErrorInstance{
+			Class:      o.Class,
+			Message:    o.Message,
+			Stacktrace: o.Stacktrace,
+		},
+		UUID:      o.UUID,
+		Timestamp: o.OccurredAt,
+		Severity:  o.Severity,
+	}
+
+	// the chain of causes is built from the deepest one
+	causes := append([]ErrorCause(nil), o.Causes...)
+	sort.Slice(causes, func(i, j int) bool {
+		return causes[i].Depth > causes[j].Depth
+	})
+	for _, cause := range causes {
+		occurrence.Error.Cause = &ErrorInstance{
+			Class:      cause.Class,
+			Message:    cause.Message,
+			Stacktrace: cause.Stacktrace,
+			Cause:      occurrence.Error.Cause,
+		}
+	}
+
+	if context := o.HTTPContext; context != nil {
+		occurrence.HTTPContext = &HTTPContext{
+			RequestMethod:  context.RequestMethod,
+			RequestURL:     context.RequestURL,
+			RequestHeaders: context.RequestHeaders,
+			RequestBody:    context.RequestBody,
+		}
+	}
+	return occurrence
+}
+
+// latestOccurrences fetches the last numberOfErrors occurrences of aggregated errors, by aggregated error id.
+// The occurrences of every error are listed first, to only load the causes and HTTP contexts of the latest ones.
+func latestOccurrences(db *gorm.DB, aggregatedErrorIDs []uint,
+	numberOfErrors int) (map[uint][]ErrorWithContext, error) {
+	latestErrors := make(map[uint][]ErrorWithContext, len(aggregatedErrorIDs))
+	for _, id := range aggregatedErrorIDs {
+		latestErrors[id] = []ErrorWithContext{}
+	}
+	if numberOfErrors <= 0 {
+		return latestErrors, nil
+	}
+
+	latestIDs := []uint{}
+	for _, ids := range chunkIDs(aggregatedErrorIDs) {
+		listed := []ErrorOccurrence{}
+		err := db.
+			Select("id", "aggregated_error_id").
+			Where("aggregated_error_id IN ?", ids).
+			Order("aggregated_error_id").
+			Order("occurred_at desc").
+			Order("id").
+			Find(&listed).Error
+		if err != nil {
+			return nil, err
+		}
+		count := make(map[uint]int, len(ids))
+		for _, occurrence := range listed {
+			if count[occurrence.AggregatedErrorID] < numberOfErrors {
+				count[occurrence.AggregatedErrorID]++
+				latestIDs = append(latestIDs, occurrence.ID)
+			}
+		}
+	}
+
+	occurrences := make(map[uint]ErrorOccurrence, len(latestIDs))
+	for _, ids := range chunkIDs(latestIDs) {
+		chunk := []ErrorOccurrence{}
+		err := db.
+			Where("id IN ?", ids).
+			Preload("Causes").
+			Preload("HTTPContext").
+			Find(&chunk).Error
+		if err != nil {
+			return nil, err
+		}
+		for _, occurrence := range chunk {
+			occurrences[occurrence.ID] = occurrence
+		}
+	}
+	// latestIDs are sorted by error and time, the order the occurrences are listed
+	for _, id := range latestIDs {
+		occurrence := occurrences[id]
+		latestErrors[occurrence.AggregatedErrorID] = append(latestErrors[occurrence.AggregatedErrorID],
+			occurrence.toErrorWithContext())
+	}
+	return latestErrors, nil
+}
+
+// syncOccurrences stores the latest occurrences of aggregated errors, by aggregated error id.
+// Occurrences already stored are kept, the ones that aren't part of the latest occurrences anymore are deleted.
+// Occurrences without UUID can't be identified, so they are always replaced.
+func syncOccurrences(db *gorm.DB, latestErrors map[uint][]ErrorWithContext) error {
+	aggregatedErrorIDs := make([]uint, 0, len(latestErrors))
+	for id := range latestErrors {
+		aggregatedErrorIDs = append(aggregatedErrorIDs, id)
+	}
+	stored := []ErrorOccurrence{}
+	for _, ids := range chunkIDs(aggregatedErrorIDs) {
+		chunk := []ErrorOccurrence{}
+		err := db.
+			Select("id", "uuid", "aggregated_error_id").
+			Where("aggregated_error_id IN ?", ids).
+			Find(&chunk).Error
+		if err != nil {
+			return err
+		}
+		stored = append(stored, chunk...)
+	}
+
+	// map aggregated error id -> UUIDs of its stored occurrences that are kept
+	storedUUIDs := make(map[uint]map[string]bool, len(latestErrors))
+	latestUUIDs := make(map[uint]map[string]bool, len(latestErrors))
+	for id, occurrences := range latestErrors {
+		storedUUIDs[id] = make(map[string]bool)
+		latestUUIDs[id] = make(map[string]bool, len(occurrences))
+		for _, occurrence := range occurrences {
+			if occurrence.UUID != "" {
+				latestUUIDs[id][occurrence.UUID] = true
+			}
+		}
+	}
+	obsoleteIDs := []uint{}
+	for _, occurrence := range stored {
+		id := occurrence.AggregatedErrorID
+		if latestUUIDs[id][occurrence.UUID] && !storedUUIDs[id][occurrence.UUID] {
+			storedUUIDs[id][occurrence.UUID] = true
+		} else {
+			obsoleteIDs = append(obsoleteIDs, occurrence.ID)
+		}
+	}
+	if err := deleteOccurrences(db, obsoleteIDs); err != nil {
+		return err
+	}
+
+	newOccurrences := []ErrorOccurrence{}
+	for _, id := range aggregatedErrorIDs {
+		for _, occurrence := range latestErrors[id] {
+			if occurrence.UUID == "" || !storedUUIDs[id][occurrence.UUID] {
+				newOccurrences = append(newOccurrences, newErrorOccurrence(id, occurrence))
+				if occurrence.UUID != "" {
+					storedUUIDs[id][occurrence.UUID] = true
+				}
+			}
+		}
+	}
+	if len(newOccurrences) == 0 {
+		return nil
+	}
+	return db.CreateInBatches(&newOccurrences, batchSize).Error
+}
+
+// deleteOccurrences deletes occurrences along with their causes and HTTP contexts
+func deleteOccurrences(db *gorm.DB, ids []uint) error {
+	for _, chunk := range chunkIDs(ids) {
+		if err := db.Where("error_occurrence_id IN ?", chunk).Delete(&ErrorCause{}).Error; err != nil {
+			return err
+		}
+		if err := db.Where("error_occurrence_id IN ?", chunk).Delete(&OccurrenceHTTPContext{}).Error; err != nil {
+			return err
+		}
+		if err := db.Where("id IN ?", chunk).Delete(&ErrorOccurrence{}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunkIDs splits a list of ids to query them in batches
+func chunkIDs(ids []uint) [][]uint {
+	chunks := [][]uint{}
+	for len(ids) > batchSize {
+		chunks = append(chunks, ids[:batchSize])
+		ids = ids[batchSize:]
+	}
+	if len(ids) > 0 {
+		chunks = append(chunks, ids)
+	}
+	return chunks
+}
+
+// GetOccurrences lists the stored occurrences of an error sorted by timestamp, newest first, paginated by the query.
+// Ties are broken by id like the latest occurrences of the errors, since occurrences may have no uuid.
+func (r *ormRepository) GetOccurrences(ctx context.Context, serviceName string, key string,
+	query OccurrencesQuery) (OccurrencesPage, error) {
+	cursor, err := query.cursor()
+	if err != nil {
+		return OccurrencesPage{}, err
+	}
+	var cursorID uint64
+	if cursor != nil {
+		if cursorID, err = strconv.ParseUint(cursor.key, 10, 64); err != nil {
+			return OccurrencesPage{}, fmt.Errorf("invalid cursor: %w", err)
+		}
+	}
+	page := OccurrencesPage{}
+	err = r.withRetry(ctx, func(db *gorm.DB) error {
+		aggregatedError, err := findError(db, serviceName, key)
+		if err != nil {
+			return err
+		}
+		tx := db.Where("aggregated_error_id = ?", aggregatedError.ID)
+		if cursor != nil {
+			tx = tx.Where("(occurred_at < ? OR (occurred_at = ? AND id > ?))", cursor.timestamp, cursor.timestamp,
+				cursorID)
+		}
+		if query.Limit > 0 {
+			// an extra occurrence is fetched to know if there is a next page
+			tx = tx.Limit(query.Limit + 1)
+		}
+		occurrences := []ErrorOccurrence{}
+		err = tx.
+			Order("occurred_at desc").
+			Order("id").
+			Preload("Causes").
+			Preload("HTTPContext").
+			Find(&occurrences).Error
+		if err != nil {
+			return err
+		}
+
+		page = OccurrencesPage{Occurrences: make([]ErrorWithContext, 0, len(occurrences))}
+		if query.Limit > 0 && len(occurrences) > query.Limit {
+			occurrences = occurrences[:query.Limit]
+			last := occurrences[query.Limit-1]
+			next := occurrencesCursor{timestamp: last.OccurredAt, key: strconv.FormatUint(uint64(last.ID), 10)}
+			page.NextCursor = next.encode()
+		}
+		for _, occurrence := range occurrences {
+			page.Occurrences = append(page.Occurrences, occurrence.toErrorWithContext())
+		}
+		return nil
+	})
+	if err != nil {
+		return OccurrencesPage{}, err
+	}
+	return page, nil
+}
@@ -1,10 +1,14 @@
 package repository
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"reflect"
 	"testing"
 	"time"
 
+	"github.com/periskop-dev/periskop/config"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
@@ -23,9 +27,18 @@ func newSQLiteMemory() *gorm.DB {
 	return db
 }
 
+func newORMTestRepository(t *testing.T, db *gorm.DB) ErrorsRepository {
+	r, err := NewORMRepository(db)
+	if err != nil {
+		t.Fatalf("Fail to create repository: %s", err)
+	}
+	return r
+}
+
 func TestORMReplaceErrors(t *testing.T) {
+	ctx := context.Background()
 	db := newSQLiteMemory()
-	r := NewORMRepository(db)
+	r := newORMTestRepository(t, db)
 	key := "errorKey"
 	serviceName := "test_replace"
 
@@ -44,7 +57,7 @@ func TestORMReplaceErrors(t *testing.T) {
 				},
 			},
 		}}
-	r.ReplaceErrors(serviceName, errors)
+	r.ReplaceErrors(ctx, serviceName, errors)
 	if countErrors(db, serviceName) != 1 {
 		t.Errorf("Found %d errors, expected 1", countErrors(db, serviceName))
 	}
@@ -64,7 +77,7 @@ func TestORMReplaceErrors(t *testing.T) {
 				},
 			},
 		}}
-	r.ReplaceErrors(serviceName, errors)
+	r.ReplaceErrors(ctx, serviceName, errors)
 	if countErrors(db, serviceName) != 1 {
 		t.Errorf("Found %d errors, expected 1", countErrors(db, serviceName))
 	}
@@ -77,14 +90,15 @@ func TestORMReplaceErrors(t *testing.T) {
 	if errObj.TotalCount != 2 {
 		t.Errorf("Found %d error instances, expected 2", errObj.TotalCount)
 	}
-	if errObj.Errors.Severity != "warning" {
-		t.Errorf("Wrong data from Errors Severity field, found '%s', expected 'warning'", errObj.Errors.Severity)
+	if errObj.Severity != "warning" {
+		t.Errorf("Wrong data from Severity field, found '%s', expected 'warning'", errObj.Severity)
 	}
 }
 
 func TestORMGetErrors(t *testing.T) {
+	ctx := context.Background()
 	db := newSQLiteMemory()
-	r := NewORMRepository(db)
+	r := newORMTestRepository(t, db)
 	err0 := ErrorAggregate{
 		AggregationKey: "key0",
 		Severity:       "error",
@@ -115,9 +129,9 @@ func TestORMGetErrors(t *testing.T) {
 	}
 	errors := []ErrorAggregate{err0, err1}
 
-	r.ReplaceErrors("test_get", errors)
+	r.ReplaceErrors(ctx, "test_get", errors)
 
-	aggregatedErrors, err := r.GetErrors("test_get", 5)
+	aggregatedErrors, err := r.GetErrors(ctx, "test_get", 5)
 	if err != nil {
 		t.Errorf("Fail to fetch errors: %s", err)
 	}
@@ -126,6 +140,9 @@ func TestORMGetErrors(t *testing.T) {
 		t.Errorf("Found %d errors, expected 2", len(aggregatedErrors))
 	}
 
+	// errors are listed along with their status
+	err0.ErrorStatus = NewErrorStatus()
+	err1.ErrorStatus = NewErrorStatus()
 	if !reflect.DeepEqual(aggregatedErrors[0], err0) {
 		t.Errorf("Error fetching errors, got %+v errors, expected %+v", &aggregatedErrors[0], &err0)
 	}
@@ -136,8 +153,9 @@ func TestORMGetErrors(t *testing.T) {
 }
 
 func TestORMGetServices(t *testing.T) {
+	ctx := context.Background()
 	db := newSQLiteMemory()
-	r := NewORMRepository(db)
+	r := newORMTestRepository(t, db)
 	errors := []ErrorAggregate{
 		{
 			AggregationKey: "key",
@@ -151,17 +169,21 @@ func TestORMGetServices(t *testing.T) {
 				},
 			},
 		}}
-	r.ReplaceErrors("test_services0", errors)
-	r.ReplaceErrors("test_services1", errors)
-	services := r.GetServices()
+	r.ReplaceErrors(ctx, "test_services0", errors)
+	r.ReplaceErrors(ctx, "test_services1", errors)
+	services, err := r.GetServices(ctx)
+	if err != nil {
+		t.Errorf("Fail to fetch services: %s", err)
+	}
 	if !reflect.DeepEqual(services, []string{"test_services0", "test_services1"}) {
 		t.Errorf("Error fetching services,  got %v", services)
 	}
 }
 
 func TestORMResolvedErrors(t *testing.T) {
+	ctx := context.Background()
 	db := newSQLiteMemory()
-	r := NewORMRepository(db)
+	r := newORMTestRepository(t, db)
 	errors := []ErrorAggregate{
 		{
 			AggregationKey: "key",
@@ -175,16 +197,17 @@ func TestORMResolvedErrors(t *testing.T) {
 				},
 			},
 		}}
-	r.ReplaceErrors("test_resolved", errors)
-	r.ResolveError("test_resolved", "key")
-	if countErrors(db, "test_resolved") != 0 {
-		t.Errorf("Found %d errors, expected 0", countErrors(db, "test_resolved"))
+	r.ReplaceErrors(ctx, "test_resolved", errors)
+	r.ResolveError(ctx, "test_resolved", "key")
+	if errors, _ := r.GetErrors(ctx, "test_resolved", 10); len(errors) != 0 {
+		t.Errorf("Found %d errors, expected 0", len(errors))
 	}
 }
 
 func TestORMRemoveResolved(t *testing.T) {
+	ctx := context.Background()
 	db := newSQLiteMemory()
-	r := NewORMRepository(db)
+	r := newORMTestRepository(t, db)
 	errors := []ErrorAggregate{
 		{
 			AggregationKey: "key",
@@ -198,17 +221,18 @@ func TestORMRemoveResolved(t *testing.T) {
 				},
 			},
 		}}
-	r.ReplaceErrors("test_remove_resolved", errors)
-	r.ResolveError("test_remove_resolved", "key")
-	r.RemoveResolved("test_remove_resolved", "key")
+	r.ReplaceErrors(ctx, "test_remove_resolved", errors)
+	r.ResolveError(ctx, "test_remove_resolved", "key")
+	r.RemoveResolved(ctx, "test_remove_resolved", "key")
 	if countErrors(db, "test_remove_resolved") != 1 {
 		t.Errorf("Found %d errors, expected 1", countErrors(db, "test_remove_resolved"))
 	}
 }
 
 func TestORMSearchResolved(t *testing.T) {
+	ctx := context.Background()
 	db := newSQLiteMemory()
-	r := NewORMRepository(db)
+	r := newORMTestRepository(t, db)
 	errors := []ErrorAggregate{
 		{
 			AggregationKey: "key",
@@ -222,15 +246,547 @@ func TestORMSearchResolved(t *testing.T) {
 				},
 			},
 		}}
-	r.ReplaceErrors("test_search", errors)
-	r.ReplaceErrors("test_search_other", errors)
-	r.ResolveError("test_search", "key")
+	r.ReplaceErrors(ctx, "test_search", errors)
+	r.ReplaceErrors(ctx, "test_search_other", errors)
+	r.ResolveError(ctx, "test_search", "key")
 
-	if !r.SearchResolved("test_search", "key") {
+	if resolved, _ := r.SearchResolved(ctx, "test_search", "key"); !resolved {
 		t.Errorf("Error should be mark as resolved")
 	}
 
-	if r.SearchResolved("test_search_other", "key") {
+	if resolved, _ := r.SearchResolved(ctx, "test_search_other", "key"); resolved {
 		t.Errorf("Error shouldn't be mark as resolved")
 	}
 }
+
+func TestORMErrorStatus(t *testing.T) {
+	ctx := context.Background()
+	db := newSQLiteMemory()
+	r := newORMTestRepository(t, db)
+	errors := []ErrorAggregate{
+		{
+			AggregationKey: "key",
+			Severity:       "error",
+			TotalCount:     3,
+			CreatedAt:      time.Unix(0, 0).Unix(),
+		}}
+	r.ReplaceErrors(ctx, "test_status", errors)
+
+	if status, _ := r.GetErrorStatus(ctx, "test_status", "key"); status.Status != StatusOpen {
+		t.Errorf("Expected %s status, Found %s", StatusOpen, status.Status)
+	}
+
+	snooze := StatusChange{Status: StatusSnoozed, SnoozeUntil: 100}
+	if err := r.SetErrorStatus(ctx, "test_status", "key", snooze); err != nil {
+		t.Errorf("Error changing status: %s", err)
+	}
+	status, _ := r.GetErrorStatus(ctx, "test_status", "key")
+	if status.Status != StatusSnoozed || status.SnoozedUntil != 100 || len(status.StatusHistory) != 1 ||
+		status.StatusHistory[0].TotalCount != 3 {
+		t.Errorf("Unexpected status %+v", status)
+	}
+	if listed, err := r.GetErrors(ctx, "test_status", 10); err != nil || len(listed) != 0 {
+		t.Errorf("Snoozed errors shouldn't be listed, Found %+v, %v", listed, err)
+	}
+
+	r.SetErrorStatus(ctx, "test_status", "key", StatusChange{Status: StatusRegressed}) // nolint[errcheck]
+	listed, _ := r.GetErrors(ctx, "test_status", 10)
+	if len(listed) != 1 || listed[0].Status != StatusRegressed || len(listed[0].StatusHistory) != 2 {
+		t.Errorf("Expected the regressed error to be listed with its history, Found %+v", listed)
+	}
+}
+
+func TestORMMigrateResolvedErrors(t *testing.T) {
+	ctx := context.Background()
+	db := newSQLiteMemory()
+	r := newORMTestRepository(t, db)
+	errors := []ErrorAggregate{{AggregationKey: "key", TotalCount: 2}}
+	r.ReplaceErrors(ctx, "test_migrate", errors)
+	// errors were soft-deleted when resolved by previous versions
+	db.Where("service_name = ?", "test_migrate").Delete(&AggregatedError{})
+
+	r = newORMTestRepository(t, db)
+	if resolved, _ := r.SearchResolved(ctx, "test_migrate", "key"); !resolved {
+		t.Errorf("Soft-deleted error should be migrated as resolved")
+	}
+	if countErrors(db, "test_migrate") != 1 {
+		t.Errorf("Found %d errors, expected 1", countErrors(db, "test_migrate"))
+	}
+}
+
+func TestORMScraperState(t *testing.T) {
+	ctx := context.Background()
+	db := newSQLiteMemory()
+	r := newORMTestRepository(t, db)
+
+	if _, err := r.GetScraperState(ctx, "test_state"); err == nil {
+		t.Errorf("Expected an error fetching an unknown scraper state")
+	}
+
+	state := ScraperState{
+		TargetErrorsCount: map[string]map[string]int{"target": {"key": 1}},
+		ErrorAggregates:   []ErrorAggregate{{AggregationKey: "key", TotalCount: 1}},
+	}
+	r.StoreScraperState(ctx, "test_state", state)
+	state.TargetErrorsCount["target"]["key"] = 2
+	state.ErrorAggregates[0].TotalCount = 2
+	r.StoreScraperState(ctx, "test_state", state)
+
+	storedState, err := r.GetScraperState(ctx, "test_state")
+	if err != nil {
+		t.Errorf("Fail to fetch scraper state: %s", err)
+	}
+	if !reflect.DeepEqual(storedState, state) {
+		t.Errorf("Error fetching scraper state, got %+v, expected %+v", storedState, state)
+	}
+}
+
+func TestORMOccurrencesHistogram(t *testing.T) {
+	ctx := context.Background()
+	db := newSQLiteMemory()
+	r := newORMTestRepository(t, db)
+	now := time.Unix(1600000200, 0)
+	r.AddOccurrences(ctx, "test_occurrences", map[string]int{"key": 2, "other": 1}, now.Add(-time.Minute))
+	r.AddOccurrences(ctx, "test_occurrences", map[string]int{"key": 3}, now.Add(-time.Minute))
+	r.AddOccurrences(ctx, "test_occurrences", map[string]int{"key": 4}, now)
+
+	histogram, _ := r.GetOccurrencesHistogram(ctx, "test_occurrences", "key", now.Add(-time.Minute),
+		now.Add(time.Minute), time.Minute)
+	expected := []OccurrenceBucket{
+		{Timestamp: now.Add(-time.Minute).Unix(), Count: 5},
+		{Timestamp: now.Unix(), Count: 4},
+	}
+	if !reflect.DeepEqual(histogram, expected) {
+		t.Errorf("Expected histogram %+v, Found %+v", expected, histogram)
+	}
+
+	// minute buckets are rolled up to hour buckets after a day
+	r.AddOccurrences(ctx, "test_occurrences", map[string]int{}, now.Add(minuteBucketsRetention+time.Hour))
+	var count int64
+	db.Model(&ErrorOccurrencesBucket{}).Where("resolution = ?", int64(MinuteBucket.Seconds())).Count(&count)
+	if count != 0 {
+		t.Errorf("Found %d minute buckets, expected 0", count)
+	}
+	histogram, _ = r.GetOccurrencesHistogram(ctx, "test_occurrences", "key", now.Add(-time.Hour),
+		now.Add(time.Hour), 2*time.Hour)
+	if len(histogram) != 1 || histogram[0].Count != 9 {
+		t.Errorf("Expected 9 occurrences, Found %+v", histogram)
+	}
+}
+
+func TestORMOccurrences(t *testing.T) {
+	ctx := context.Background()
+	db := newSQLiteMemory()
+	r := newORMTestRepository(t, db)
+	occurrence := func(uuid string, timestamp int64) ErrorWithContext {
+		return ErrorWithContext{
+			Error: ErrorInstance{
+				Class:      "ErrorString",
+				Message:    "Failed when parsing",
+				Stacktrace: []string{"0:", "error"},
+				Cause: &ErrorInstance{
+					Class:   "IOError",
+					Message: "Connection reset",
+					Cause:   &ErrorInstance{Class: "SocketError"},
+				},
+			},
+			UUID:      uuid,
+			Timestamp: timestamp,
+			Severity:  "error",
+			HTTPContext: &HTTPContext{
+				RequestMethod:  "GET",
+				RequestURL:     "http://example.com",
+				RequestHeaders: map[string]string{"Accept": "*/*"},
+			},
+		}
+	}
+	errors := []ErrorAggregate{{
+		AggregationKey: "key",
+		TotalCount:     2,
+		LatestErrors:   []ErrorWithContext{occurrence("uuid2", 2), occurrence("uuid1", 1)},
+	}}
+	r.ReplaceErrors(ctx, "test_occurrences", errors)
+
+	listed, _ := r.GetErrors(ctx, "test_occurrences", 10)
+	if len(listed) != 1 || !reflect.DeepEqual(listed[0].LatestErrors, errors[0].LatestErrors) {
+		t.Errorf("Expected occurrences %+v, Found %+v", errors[0].LatestErrors, listed)
+	}
+	listed, _ = r.GetErrors(ctx, "test_occurrences", 1)
+	if len(listed[0].LatestErrors) != 1 || listed[0].LatestErrors[0].UUID != "uuid2" {
+		t.Errorf("Expected only the newest occurrence, Found %+v", listed[0].LatestErrors)
+	}
+
+	// kept occurrences aren't stored again and the ones not in the latest occurrences are deleted
+	storedOccurrence := ErrorOccurrence{}
+	db.Where("uuid = ?", "uuid2").First(&storedOccurrence)
+	errors[0].TotalCount = 3
+	errors[0].LatestErrors = []ErrorWithContext{occurrence("uuid3", 3), occurrence("uuid2", 2)}
+	r.ReplaceErrors(ctx, "test_occurrences", errors)
+
+	var count int64
+	db.Model(&ErrorOccurrence{}).Count(&count)
+	if count != 2 {
+		t.Errorf("Found %d occurrences, expected 2", count)
+	}
+	db.Model(&ErrorCause{}).Count(&count)
+	if count != 4 {
+		t.Errorf("Found %d causes, expected 4", count)
+	}
+	updatedOccurrence := ErrorOccurrence{}
+	db.Where("uuid = ?", "uuid2").First(&updatedOccurrence)
+	if updatedOccurrence.ID != storedOccurrence.ID {
+		t.Errorf("Expected occurrence %d to be kept, Found %d", storedOccurrence.ID, updatedOccurrence.ID)
+	}
+}
+
+func TestORMOccurrencesWithoutUUIDArePaginated(t *testing.T) {
+	ctx := context.Background()
+	r := newORMTestRepository(t, newSQLiteMemory())
+	occurrences := []ErrorWithContext{}
+	for _, message := range []string{"first", "second", "third"} {
+		occurrences = append(occurrences, ErrorWithContext{Error: ErrorInstance{Message: message}, Timestamp: 1})
+	}
+	r.ReplaceErrors(ctx, "test", []ErrorAggregate{{AggregationKey: "key", TotalCount: 3, LatestErrors: occurrences}})
+
+	paginated := []string{}
+	query := OccurrencesQuery{Limit: 1}
+	for {
+		page, err := r.GetOccurrences(ctx, "test", "key", query)
+		if err != nil {
+			t.Fatalf("Fail to get occurrences: %s", err)
+		}
+		for _, occurrence := range page.Occurrences {
+			paginated = append(paginated, occurrence.Error.Message)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+	errorAggregate, _ := r.GetError(ctx, "test", "key", 10)
+	latest := []string{}
+	for _, occurrence := range errorAggregate.LatestErrors {
+		latest = append(latest, occurrence.Error.Message)
+	}
+	if len(paginated) != 3 || !reflect.DeepEqual(paginated, latest) {
+		t.Errorf("Expected the 3 occurrences in the order of the latest occurrences %v, Found %v", latest, paginated)
+	}
+}
+
+func TestORMMigrateErrorsColumn(t *testing.T) {
+	ctx := context.Background()
+	db := newSQLiteMemory()
+	newORMTestRepository(t, db)
+	// previous versions stored the whole aggregated error in json format
+	errorAggregate := ErrorAggregate{
+		AggregationKey: "key",
+		TotalCount:     1,
+		Severity:       "warning",
+		CreatedAt:      10,
+		LatestErrors:   []ErrorWithContext{{UUID: "uuid1", Timestamp: 20, Severity: "warning"}},
+	}
+	db.Create(&AggregatedError{
+		ServiceName:    "test_migrate",
+		AggregationKey: "key",
+		Errors:         &errorAggregate,
+		TotalCount:     1,
+	})
+
+	r := newORMTestRepository(t, db)
+	listed, err := r.GetErrors(ctx, "test_migrate", 10)
+	if err != nil || len(listed) != 1 {
+		t.Fatalf("Expected the migrated error, Found %+v, %v", listed, err)
+	}
+	if listed[0].Severity != "warning" || listed[0].CreatedAt != 10 || listed[0].LastSeen != 20 ||
+		len(listed[0].LatestErrors) != 1 || listed[0].LatestErrors[0].UUID != "uuid1" {
+		t.Errorf("Unexpected migrated error %+v", listed[0])
+	}
+	var count int64
+	db.Model(&AggregatedError{}).Where("errors IS NOT NULL").Count(&count)
+	if count != 0 {
+		t.Errorf("Found %d errors in json format, expected 0", count)
+	}
+}
+
+func TestORMReplaceErrorsInBatches(t *testing.T) {
+	ctx := context.Background()
+	db := newSQLiteMemory()
+	r := newORMTestRepository(t, db)
+	errors := make([]ErrorAggregate, 0, 2*batchSize+10)
+	for i := 0; i < cap(errors); i++ {
+		errors = append(errors, ErrorAggregate{
+			AggregationKey: fmt.Sprintf("key%d", i),
+			TotalCount:     1,
+			LatestErrors:   []ErrorWithContext{{UUID: fmt.Sprintf("uuid%d", i)}},
+		})
+	}
+	r.ReplaceErrors(ctx, "test_batches", errors)
+	if countErrors(db, "test_batches") != int64(len(errors)) {
+		t.Errorf("Found %d errors, expected %d", countErrors(db, "test_batches"), len(errors))
+	}
+
+	// updating errors keeps their status
+	r.ResolveError(ctx, "test_batches", "key0") // nolint[errcheck]
+	errors[0].TotalCount = 2
+	errors[0].LatestErrors = append(errors[0].LatestErrors, ErrorWithContext{UUID: "uuid-new"})
+	r.ReplaceErrors(ctx, "test_batches", errors)
+	if countErrors(db, "test_batches") != int64(len(errors)) {
+		t.Errorf("Found %d errors, expected %d", countErrors(db, "test_batches"), len(errors))
+	}
+	if resolved, _ := r.SearchResolved(ctx, "test_batches", "key0"); !resolved {
+		t.Errorf("Error should be kept as resolved")
+	}
+	var count int64
+	db.Model(&ErrorOccurrence{}).Count(&count)
+	if count != int64(len(errors)+1) {
+		t.Errorf("Found %d occurrences, expected %d", count, len(errors)+1)
+	}
+}
+
+func TestORMGetErrorsLoadsOccurrencesInBatches(t *testing.T) {
+	ctx := context.Background()
+	db := newSQLiteMemory()
+	r := newORMTestRepository(t, db)
+	errors := make([]ErrorAggregate, 0, batchSize+50)
+	for i := 0; i < cap(errors); i++ {
+		latestErrors := []ErrorWithContext{}
+		for j := 0; j < 3; j++ {
+			latestErrors = append(latestErrors, ErrorWithContext{
+				UUID:      fmt.Sprintf("uuid%d-%d", i, j),
+				Timestamp: int64(j),
+				Error:     ErrorInstance{Class: "Error", Cause: &ErrorInstance{Class: "Cause"}},
+			})
+		}
+		errors = append(errors, ErrorAggregate{AggregationKey: fmt.Sprintf("key%d", i), TotalCount: 3,
+			LatestErrors: latestErrors})
+	}
+	r.ReplaceErrors(ctx, "test_batches", errors) // nolint[errcheck]
+
+	queries := 0
+	err := db.Callback().Query().After("gorm:query").Register("test:count", func(db *gorm.DB) {
+		queries++
+	})
+	if err != nil {
+		t.Fatalf("Fail to register callback: %s", err)
+	}
+	stored, err := r.GetErrors(ctx, "test_batches", 2)
+	if err != nil || len(stored) != len(errors) {
+		t.Fatalf("Expected %d errors, Found %d, %v", len(errors), len(stored), err)
+	}
+	// the occurrences are loaded by batches of errors, not error by error
+	if queries > 20 {
+		t.Errorf("Expected the occurrences to be loaded in batches, Found %d queries", queries)
+	}
+	for _, errorAggregate := range stored {
+		i := 0
+		fmt.Sscanf(errorAggregate.AggregationKey, "key%d", &i) // nolint[errcheck]
+		latestErrors := errorAggregate.LatestErrors
+		if len(latestErrors) != 2 || latestErrors[0].UUID != fmt.Sprintf("uuid%d-2", i) ||
+			latestErrors[1].UUID != fmt.Sprintf("uuid%d-1", i) || latestErrors[0].Error.Cause == nil {
+			t.Fatalf("Expected the 2 latest occurrences of %s, Found %+v", errorAggregate.AggregationKey, latestErrors)
+		}
+	}
+}
+
+// legacyAggregatedError is the table of aggregated errors before having a unique index
+type legacyAggregatedError struct {
+	gorm.Model
+	ServiceName    string `gorm:"index"`
+	AggregationKey string `gorm:"index"`
+	TotalCount     int
+}
+
+func (legacyAggregatedError) TableName() string {
+	return "aggregated_errors"
+}
+
+func TestORMRemoveDuplicatedErrors(t *testing.T) {
+	ctx := context.Background()
+	db := newSQLiteMemory()
+	db.AutoMigrate(&legacyAggregatedError{}) // nolint[errcheck]
+	db.Create(&legacyAggregatedError{ServiceName: "test_duplicated", AggregationKey: "key", TotalCount: 1})
+	db.Create(&legacyAggregatedError{ServiceName: "test_duplicated", AggregationKey: "key", TotalCount: 2})
+
+	r := newORMTestRepository(t, db)
+	if countErrors(db, "test_duplicated") != 1 {
+		t.Errorf("Found %d errors, expected 1", countErrors(db, "test_duplicated"))
+	}
+	listed, _ := r.GetErrors(ctx, "test_duplicated", 10)
+	if len(listed) != 1 || listed[0].TotalCount != 2 {
+		t.Errorf("Expected the last stored error to be kept, Found %+v", listed)
+	}
+}
+
+// legacyOccurrencesBucket is the table of occurrences buckets before having a unique index
+type legacyOccurrencesBucket struct {
+	ID             uint   `gorm:"primarykey"`
+	ServiceName    string `gorm:"index:idx_occurrences_bucket"`
+	AggregationKey string `gorm:"index:idx_occurrences_bucket"`
+	Resolution     int64  `gorm:"index:idx_occurrences_bucket"`
+	BucketStart    int64  `gorm:"index:idx_occurrences_bucket"`
+	Occurrences    int
+}
+
+func (legacyOccurrencesBucket) TableName() string {
+	return "error_occurrences_buckets"
+}
+
+func TestORMMergeDuplicatedBuckets(t *testing.T) {
+	ctx := context.Background()
+	db := newSQLiteMemory()
+	now := time.Unix(1600000200, 0)
+	db.AutoMigrate(&legacyOccurrencesBucket{}) // nolint[errcheck]
+	for _, count := range []int{2, 3} {
+		db.Create(&legacyOccurrencesBucket{ServiceName: "test_duplicated", AggregationKey: "key",
+			Resolution: int64(MinuteBucket.Seconds()), BucketStart: now.Unix(), Occurrences: count})
+	}
+
+	r := newORMTestRepository(t, db)
+	if db.Migrator().HasIndex(&ErrorOccurrencesBucket{}, "idx_occurrences_bucket") {
+		t.Errorf("Expected the previous index to be dropped")
+	}
+	r.AddOccurrences(ctx, "test_duplicated", map[string]int{"key": 1}, now) // nolint[errcheck]
+	histogram, _ := r.GetOccurrencesHistogram(ctx, "test_duplicated", "key", now, now.Add(time.Minute), time.Minute)
+	if len(histogram) != 1 || histogram[0].Count != 6 {
+		t.Errorf("Expected the duplicated buckets to be merged, Found %+v", histogram)
+	}
+}
+
+func TestORMIndexedColumnsAreSized(t *testing.T) {
+	db := newSQLiteMemory()
+	for _, columns := range indexedColumns {
+		statement := &gorm.Statement{DB: db}
+		if err := statement.Parse(columns.model); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range columns.fields {
+			if field := statement.Schema.LookUpField(name); field == nil || field.Size != 191 {
+				t.Errorf("Expected %s of %s to be sized for MySQL indexes, Found %+v", name, columns.index, field)
+			}
+		}
+	}
+}
+
+func TestORMAddOccurrencesInBatches(t *testing.T) {
+	ctx := context.Background()
+	db := newSQLiteMemory()
+	r := newORMTestRepository(t, db)
+	now := time.Unix(1600000200, 0)
+	occurrences := make(map[string]int, 2*batchSize+10)
+	for i := 0; i < 2*batchSize+10; i++ {
+		occurrences[fmt.Sprintf("key%d", i)] = 1
+	}
+	r.AddOccurrences(ctx, "test_batches", occurrences, now) // nolint[errcheck]
+
+	statements := 0
+	count := func(db *gorm.DB) {
+		statements++
+	}
+	db.Callback().Create().After("gorm:create").Register("test:count", count)                     // nolint[errcheck]
+	db.Callback().Query().After("gorm:query").Register("test:count", count)                       // nolint[errcheck]
+	db.Callback().Update().After("gorm:update").Register("test:count", count)                     // nolint[errcheck]
+	r.AddOccurrences(ctx, "test_batches", occurrences, now)                                       // nolint[errcheck]
+	r.AddOccurrences(ctx, "test_batches", occurrences, now.Add(minuteBucketsRetention+time.Hour)) // nolint[errcheck]
+	// the buckets are added and rolled up in batches of buckets, not bucket by bucket
+	if statements > 12 {
+		t.Errorf("Expected the buckets to be added in batches, Found %d statements", statements)
+	}
+
+	histogram, _ := r.GetOccurrencesHistogram(ctx, "test_batches", "key0", now.Add(-time.Hour), now.Add(time.Hour),
+		2*time.Hour)
+	if len(histogram) != 1 || histogram[0].Count != 2 {
+		t.Errorf("Expected 2 occurrences rolled up, Found %+v", histogram)
+	}
+}
+
+func TestORMRetriesFailedOperations(t *testing.T) {
+	ctx := context.Background()
+	db := newSQLiteMemory()
+	r := newORMTestRepository(t, db)
+	r.ReplaceErrors(ctx, "test_retries", []ErrorAggregate{{AggregationKey: "key", TotalCount: 1}}) // nolint[errcheck]
+
+	// the database fails the next query, as when a connection is dropped
+	failures := 1
+	err := db.Callback().Query().Before("gorm:query").Register("test:fail", func(db *gorm.DB) {
+		if failures > 0 {
+			failures--
+			db.AddError(fmt.Errorf("connection reset"))
+		}
+	})
+	if err != nil {
+		t.Fatalf("Fail to register callback: %s", err)
+	}
+	services, err := r.GetServices(ctx)
+	if err != nil || !reflect.DeepEqual(services, []string{"test_retries"}) {
+		t.Errorf("Expected the query to be retried, Found %v, %v", services, err)
+	}
+
+	// errors persisting after every attempt are returned
+	failures = maxAttempts
+	if _, err := r.GetServices(ctx); err == nil {
+		t.Errorf("Expected an error after %d failed attempts", maxAttempts)
+	}
+}
+
+func TestORMReturnsDatabaseErrors(t *testing.T) {
+	ctx := context.Background()
+	db := newSQLiteMemory()
+	r := newORMTestRepository(t, db)
+	sqlDB, _ := db.DB()
+	sqlDB.Close()
+
+	if err := r.ReplaceErrors(ctx, "test_closed", []ErrorAggregate{{AggregationKey: "key"}}); err == nil {
+		t.Errorf("Expected an error storing errors")
+	}
+	if _, err := r.GetErrors(ctx, "test_closed", 10); err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected a database error fetching errors, Found %v", err)
+	}
+	if _, err := r.GetErrorStatus(ctx, "test_closed", "key"); err == nil {
+		t.Errorf("Expected an error fetching the status")
+	}
+}
+
+func TestORMPrune(t *testing.T) {
+	ctx := context.Background()
+	db := newSQLiteMemory()
+	r := newORMTestRepository(t, db)
+	now := time.Now().Add(2 * time.Hour)
+	day := int64(24 * time.Hour / time.Second)
+	occurrences := []ErrorWithContext{{UUID: "uuid2", Timestamp: 2}, {UUID: "uuid1", Timestamp: 1},
+		{UUID: "uuid0", Timestamp: 0}}
+	r.ReplaceErrors(ctx, "test_prune", []ErrorAggregate{ // nolint[errcheck]
+		{AggregationKey: "expired", TotalCount: 1, LastSeen: now.Unix() - 10*day, LatestErrors: occurrences},
+		{AggregationKey: "resolved", TotalCount: 1, LastSeen: now.Unix()},
+		{AggregationKey: "old", TotalCount: 1, LastSeen: now.Unix() - 2*day},
+		{AggregationKey: "recent", TotalCount: 1, LastSeen: now.Unix() - day, LatestErrors: occurrences},
+	})
+	r.AddOccurrences(ctx, "test_prune", map[string]int{"expired": 1, "recent": 1}, now) // nolint[errcheck]
+	r.ResolveError(ctx, "test_prune", "resolved")                                       // nolint[errcheck]
+
+	retention := config.Retention{MaxAge: 7 * 24 * time.Hour, ResolvedMaxAge: time.Hour, MaxOccurrences: 2,
+		MaxErrorsPerService: 1}
+	result, err := r.Prune(ctx, retention, now)
+	expected := PruneResult{ExpiredErrors: 1, ResolvedErrors: 1, ExcessErrors: 1, Occurrences: 1,
+		Keys: map[string][]string{"test_prune": {"expired", "old", "resolved"}}}
+	if err != nil || !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected %+v pruned, Found %+v, %v", expected, result, err)
+	}
+	var count int64
+	db.Unscoped().Model(&AggregatedError{}).Count(&count)
+	if count != 1 {
+		t.Errorf("Found %d errors, expected 1", count)
+	}
+	listed, _ := r.GetErrors(ctx, "test_prune", 10)
+	if len(listed) != 1 || listed[0].AggregationKey != "recent" || len(listed[0].LatestErrors) != 2 ||
+		listed[0].LatestErrors[0].UUID != "uuid2" {
+		t.Errorf("Expected the most recently seen error with its newest occurrences, Found %+v", listed)
+	}
+	db.Model(&ErrorOccurrence{}).Count(&count)
+	if count != 2 {
+		t.Errorf("Found %d occurrences, expected 2", count)
+	}
+	db.Model(&ErrorOccurrencesBucket{}).Count(&count)
+	if count != 1 {
+		t.Errorf("Found %d occurrences buckets, expected 1", count)
+	}
+}
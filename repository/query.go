@@ -0,0 +1,256 @@
+package repository
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Orders of the errors listed by QueryErrors, errors are listed in descending order
+const (
+	SortByCount     = "count"
+	SortByLastSeen  = "last_seen"
+	SortByCreatedAt = "created_at"
+)
+
+// ErrorsQuery filters, sorts and paginates the listed errors of a service
+type ErrorsQuery struct {
+	// Severity lists only the errors of the given severity
+	Severity string
+	// Search lists only the errors whose aggregation key, or the class or message of any of their stored
+	// occurrences, contains the given text, ignoring case
+	Search string
+	// Sort is the order of the errors, by last seen when empty
+	Sort string
+	// Limit is the maximum number of errors listed, all of them when zero
+	Limit int
+	// Cursor lists the errors after the ones of a previous page, it's the NextCursor of the previous page
+	Cursor string
+	// NumberOfErrors is the maximum number of occurrences listed per error
+	NumberOfErrors int
+}
+
+// ErrorsPage is a page of errors listed by QueryErrors
+type ErrorsPage struct {
+	Errors []ErrorAggregate
+	// NextCursor fetches the next page, it's empty on the last page
+	NextCursor string
+}
+
+// errorsCursor is the position of the last error of a page: its sort value and aggregation key
+type errorsCursor struct {
+	sort  string
+	value int64
+	key   string
+}
+
+// GetSort returns the configured order of the errors or last seen if not configured
+func (q ErrorsQuery) GetSort() string {
+	if q.Sort == "" {
+		return SortByLastSeen
+	}
+	return q.Sort
+}
+
+// Validate checks the query settings are consistent
+func (q ErrorsQuery) Validate() error {
+	if sort := q.GetSort(); sort != SortByCount && sort != SortByLastSeen && sort != SortByCreatedAt {
+		return fmt.Errorf("invalid sort %s, expected %s, %s or %s", sort, SortByCount, SortByLastSeen,
+			SortByCreatedAt)
+	}
+	if q.Limit < 0 || q.NumberOfErrors < 0 {
+		return fmt.Errorf("limit and number of occurrences can't be negative")
+	}
+	_, err := q.cursor()
+	return err
+}
+
+// cursor decodes the cursor of the query, it's nil for the first page
+func (q ErrorsQuery) cursor() (*errorsCursor, error) {
+	if q.Cursor == "" {
+		return nil, nil
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+	parts := strings.SplitN(string(decoded), ":", 3)
+	if len(parts) != 3 || parts[0] != q.GetSort() {
+		return nil, fmt.Errorf("invalid cursor for sort %s", q.GetSort())
+	}
+	value, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+	return &errorsCursor{sort: parts[0], value: value, key: parts[2]}, nil
+}
+
+// encode returns the cursor of the page after the given error
+func (c errorsCursor) encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%d:%s", c.sort, c.value, c.key)))
+}
+
+// sortValue returns the value of an error the errors are sorted by
+func sortValue(errorAggregate ErrorAggregate, sort string) int64 {
+	switch sort {
+	case SortByCount:
+		return int64(errorAggregate.TotalCount)
+	case SortByCreatedAt:
+		return errorAggregate.CreatedAt
+	default:
+		return errorAggregate.LastSeen
+	}
+}
+
+// after returns whether an error is listed after the cursor
+func (c errorsCursor) after(errorAggregate ErrorAggregate) bool {
+	value := sortValue(errorAggregate, c.sort)
+	return value < c.value || (value == c.value && errorAggregate.AggregationKey > c.key)
+}
+
+// matches returns whether an error matches the severity and search filters of the query
+func (q ErrorsQuery) matches(errorAggregate ErrorAggregate) bool {
+	if q.Severity != "" && errorAggregate.Severity != q.Severity {
+		return false
+	}
+	if q.Search == "" {
+		return true
+	}
+	search := strings.ToLower(q.Search)
+	if strings.Contains(strings.ToLower(errorAggregate.AggregationKey), search) {
+		return true
+	}
+	for _, occurrence := range errorAggregate.LatestErrors {
+		if strings.Contains(strings.ToLower(occurrence.Error.Class), search) ||
+			strings.Contains(strings.ToLower(occurrence.Error.Message), search) {
+			return true
+		}
+	}
+	return false
+}
+
+// queryErrors lists the visible errors matching a query, for repositories that filter errors in memory.
+// The errors must include their status.
+func queryErrors(errorAggregates []ErrorAggregate, query ErrorsQuery) (ErrorsPage, error) {
+	cursor, err := query.cursor()
+	if err != nil {
+		return ErrorsPage{}, err
+	}
+	sortBy := query.GetSort()
+	listed := make([]ErrorAggregate, 0, len(errorAggregates))
+	for _, errorAggregate := range errorAggregates {
+		if errorAggregate.IsVisible() && query.matches(errorAggregate) &&
+			(cursor == nil || cursor.after(errorAggregate)) {
+			listed = append(listed, errorAggregate)
+		}
+	}
+	sort.Slice(listed, func(i, j int) bool {
+		vi, vj := sortValue(listed[i], sortBy), sortValue(listed[j], sortBy)
+		return vi > vj || (vi == vj && listed[i].AggregationKey < listed[j].AggregationKey)
+	})
+
+	page := ErrorsPage{}
+	if query.Limit > 0 && len(listed) > query.Limit {
+		listed = listed[:query.Limit]
+		last := listed[query.Limit-1]
+		page.NextCursor = errorsCursor{sort: sortBy, value: sortValue(last, sortBy), key: last.AggregationKey}.encode()
+	}
+	for i := range listed {
+		if len(listed[i].LatestErrors) > query.NumberOfErrors {
+			listed[i].LatestErrors = listed[i].LatestErrors[:query.NumberOfErrors]
+		}
+	}
+	page.Errors = listed
+	return page, nil
+}
+
+// OccurrencesQuery paginates the stored occurrences of an error, newest first
+type OccurrencesQuery struct {
+	// Limit is the maximum number of occurrences listed, all of them when zero
+	Limit int
+	// Cursor lists the occurrences after the ones of a previous page, it's the NextCursor of the previous page
+	Cursor string
+}
+
+// OccurrencesPage is a page of occurrences listed by GetOccurrences
+type OccurrencesPage struct {
+	Occurrences []ErrorWithContext
+	// NextCursor fetches the next page, it's empty on the last page
+	NextCursor string
+}
+
+// occurrencesCursor is the position of the last occurrence of a page: its timestamp and the key breaking ties
+// between occurrences of the same timestamp, their uuid in memory or their id in the ORM repository
+type occurrencesCursor struct {
+	timestamp int64
+	key       string
+}
+
+// Validate checks the query settings are consistent
+func (q OccurrencesQuery) Validate() error {
+	if q.Limit < 0 {
+		return fmt.Errorf("limit can't be negative")
+	}
+	_, err := q.cursor()
+	return err
+}
+
+// cursor decodes the cursor of the query, it's nil for the first page
+func (q OccurrencesQuery) cursor() (*occurrencesCursor, error) {
+	if q.Cursor == "" {
+		return nil, nil
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	timestamp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+	return &occurrencesCursor{timestamp: timestamp, key: parts[1]}, nil
+}
+
+// encode returns the cursor of the page after the given occurrence
+func (c occurrencesCursor) encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%s", c.timestamp, c.key)))
+}
+
+// after returns whether an occurrence is listed after the cursor
+func (c occurrencesCursor) after(occurrence ErrorWithContext) bool {
+	return occurrence.Timestamp < c.timestamp || (occurrence.Timestamp == c.timestamp && occurrence.UUID > c.key)
+}
+
+// queryOccurrences lists a page of occurrences sorted by timestamp, newest first, and uuid,
+// for repositories that paginate occurrences in memory
+func queryOccurrences(occurrences []ErrorWithContext, query OccurrencesQuery) (OccurrencesPage, error) {
+	cursor, err := query.cursor()
+	if err != nil {
+		return OccurrencesPage{}, err
+	}
+	listed := make([]ErrorWithContext, 0, len(occurrences))
+	for _, occurrence := range occurrences {
+		if cursor == nil || cursor.after(occurrence) {
+			listed = append(listed, occurrence)
+		}
+	}
+	sort.SliceStable(listed, func(i, j int) bool {
+		return listed[i].Timestamp > listed[j].Timestamp ||
+			(listed[i].Timestamp == listed[j].Timestamp && listed[i].UUID < listed[j].UUID)
+	})
+
+	page := OccurrencesPage{}
+	if query.Limit > 0 && len(listed) > query.Limit {
+		listed = listed[:query.Limit]
+		last := listed[query.Limit-1]
+		page.NextCursor = occurrencesCursor{timestamp: last.Timestamp, key: last.UUID}.encode()
+	}
+	page.Occurrences = listed
+	return page, nil
+}
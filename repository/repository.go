@@ -1,8 +1,12 @@
 package repository
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"sync"
+	"time"
 
 	"github.com/periskop-dev/periskop/config"
 	"gorm.io/driver/mysql"
@@ -17,6 +21,10 @@ type ErrorAggregate struct {
 	Severity       string             `json:"severity"`
 	LatestErrors   []ErrorWithContext `json:"latest_errors"`
 	CreatedAt      int64              `json:"created_at"`
+	// FirstSeen and LastSeen are the unix times of the oldest and newest occurrences of the error
+	FirstSeen int64 `json:"first_seen"`
+	LastSeen  int64 `json:"last_seen"`
+	ErrorStatus
 }
 
 type ErrorWithContext struct {
@@ -41,23 +49,88 @@ type HTTPContext struct {
 	RequestBody    string            `json:"request_body"`
 }
 
+// Results of the last scrape of a target
+const (
+	ScrapeResultOK          = "ok"
+	ScrapeResultHTTPError   = "http_error"
+	ScrapeResultDecodeError = "decode_error"
+	ScrapeResultTimeout     = "timeout"
+)
+
 type Target struct {
 	Endpoint string `json:"endpoint"`
+	// TargetUUID is the target_uuid reported by the target in its last scrape
+	TargetUUID string `json:"target_uuid,omitempty"`
+	// LastScrape is the unix time of the last scrape
+	LastScrape int64 `json:"last_scrape,omitempty"`
+	// LastScrapeDuration is the duration of the last scrape in seconds
+	LastScrapeDuration float64 `json:"last_scrape_duration,omitempty"`
+	LastScrapeResult   string  `json:"last_scrape_result,omitempty"`
+	LastError          string  `json:"last_error,omitempty"`
+}
+
+// ScraperState is the aggregation state of the scraper of a service.
+// It's persisted so counters keep being consistent after a restart of Periskop.
+type ScraperState struct {
+	// map target -> error key -> error total occurrences
+	TargetErrorsCount map[string]map[string]int `json:"target_errors_count"`
+	// ErrorAggregates holds the counters and metadata of the errors, without their occurrences
+	ErrorAggregates []ErrorAggregate `json:"error_aggregates"`
+}
+
+// ErrNotFound is returned, wrapped, when the requested service, error or scraper state doesn't exist
+var ErrNotFound = errors.New("not found")
+
+type ScraperStateRepository interface {
+	StoreScraperState(ctx context.Context, serviceName string, state ScraperState) error
+	GetScraperState(ctx context.Context, serviceName string) (ScraperState, error)
 }
 
 type TargetsRepository interface {
-	StoreTargets(serviceName string, targets []Target)
-	GetTargets() map[string][]Target
+	StoreTargets(ctx context.Context, serviceName string, targets []Target) error
+	GetTargets(ctx context.Context) (map[string][]Target, error)
 }
 
+// ErrorsRepository stores the errors scraped from services.
+// Every method returns an error when the storage fails, a failure storing errors doesn't lose the errors already
+// stored. Implementations are checked by repositorytest.RunConformance.
 type ErrorsRepository interface {
-	GetErrors(serviceName string, numberOfErrors int) ([]ErrorAggregate, error)
-	ReplaceErrors(serviceName string, errors []ErrorAggregate)
-	GetServices() []string
-	ResolveError(serviceName string, key string) error
-	SearchResolved(serviceName string, key string) bool
-	RemoveResolved(serviceName string, key string)
+	GetErrors(ctx context.Context, serviceName string, numberOfErrors int) ([]ErrorAggregate, error)
+	// QueryErrors lists the errors of a service like GetErrors, filtered, sorted and paginated by the query
+	QueryErrors(ctx context.Context, serviceName string, query ErrorsQuery) (ErrorsPage, error)
+	// GetError fetches an error of a service whatever its status, with its last numberOfErrors occurrences
+	GetError(ctx context.Context, serviceName string, key string, numberOfErrors int) (ErrorAggregate, error)
+	// GetOccurrences lists the stored occurrences of an error sorted by timestamp, newest first, paginated by
+	// the query
+	GetOccurrences(ctx context.Context, serviceName string, key string, query OccurrencesQuery) (OccurrencesPage,
+		error)
+	// ReplaceErrors stores errors of a service, replacing the stored errors with the same aggregation key
+	ReplaceErrors(ctx context.Context, serviceName string, errors []ErrorAggregate) error
+	GetServices(ctx context.Context) ([]string, error)
+	ResolveError(ctx context.Context, serviceName string, key string) error
+	SearchResolved(ctx context.Context, serviceName string, key string) (bool, error)
+	RemoveResolved(ctx context.Context, serviceName string, key string) error
+	GetErrorStatus(ctx context.Context, serviceName string, key string) (ErrorStatus, error)
+	// GetErrorStatuses fetches the statuses of the errors of a service that aren't open, by aggregation key.
+	// Errors that aren't listed are open.
+	GetErrorStatuses(ctx context.Context, serviceName string) (map[string]ErrorStatus, error)
+	SetErrorStatus(ctx context.Context, serviceName string, key string, change StatusChange) error
+	// Prune removes the errors and occurrences exceeding the retention policies
+	Prune(ctx context.Context, retention config.Retention, now time.Time) (PruneResult, error)
 	TargetsRepository
+	ScraperStateRepository
+	OccurrencesRepository
+	ArchiveRepository
+}
+
+// ArchiveRepository exports and imports every error of a service regardless of its status,
+// to move errors between repositories
+type ArchiveRepository interface {
+	// ExportErrors fetches every error of a service with its status and all its stored occurrences
+	ExportErrors(ctx context.Context, serviceName string) ([]ErrorAggregate, error)
+	// ImportErrors stores errors of a service with their status, replacing the stored errors with the same
+	// aggregation key
+	ImportErrors(ctx context.Context, serviceName string, errors []ErrorAggregate) error
 }
 
 type targetsRepository struct {
@@ -66,53 +139,55 @@ type targetsRepository struct {
 }
 
 // StoreTargets stores a list of scrapped targets (hosts) for a service
-func (r *targetsRepository) StoreTargets(serviceName string, targets []Target) {
+func (r *targetsRepository) StoreTargets(ctx context.Context, serviceName string, targets []Target) error {
 	r.Targets.Store(serviceName, targets)
+	return nil
 }
 
 // GetTargets gets a list of scrapped targets (hosts) for a service
-func (r *targetsRepository) GetTargets() map[string][]Target {
+func (r *targetsRepository) GetTargets(ctx context.Context) (map[string][]Target, error) {
 	targets := make(map[string][]Target)
 	r.Targets.Range(func(key, value interface{}) bool {
 		targets[key.(string)] = value.([]Target)
 		return true
 	})
-	return targets
+	return targets, nil
 }
 
 // NewRepository is a factory function for ErrorRepository interfaces.
 // It creates a repository based on the configured repository.
-func NewRepository(repositoryConfig config.Repository) ErrorsRepository {
+func NewRepository(repositoryConfig config.Repository) (ErrorsRepository, error) {
 	// default config for gorm
 	gormConfig := &gorm.Config{SkipDefaultTransaction: true, PrepareStmt: true}
 
+	var dialector gorm.Dialector
 	switch repositoryConfig.Type {
 	case "sqlite":
 		log.Printf("Using SQLite %s repository", repositoryConfig.Path)
-		db, err := gorm.Open(sqlite.Open(repositoryConfig.Path), gormConfig)
-		if err != nil {
-			panic("failed to connect database")
-		}
-		return NewORMRepository(db)
+		dialector = sqlite.Open(repositoryConfig.Path)
 	case "mysql":
 		log.Printf("Using MySQL repository")
-		db, err := gorm.Open(mysql.Open(repositoryConfig.Dsn), gormConfig)
-		if err != nil {
-			panic("failed to connect database")
-		}
-		return NewORMRepository(db)
+		dialector = mysql.Open(repositoryConfig.Dsn)
 	case "postgres":
 		log.Printf("Using PostgresSQL repository")
-		db, err := gorm.Open(postgres.Open(repositoryConfig.Dsn), gormConfig)
-		if err != nil {
-			panic("failed to connect database")
-		}
-		return NewORMRepository(db)
-	case "memory":
-		log.Printf("Using in memory repository")
-		return NewMemoryRepository()
+		dialector = postgres.Open(repositoryConfig.Dsn)
+	case "bolt":
+		log.Printf("Using bolt %s repository", repositoryConfig.Path)
+		return NewBoltRepository(repositoryConfig.Path)
 	default:
 		log.Printf("Using in memory repository")
-		return NewMemoryRepository()
+		r := NewMemoryRepository()
+		if snapshot := repositoryConfig.Snapshot; snapshot.Enabled() {
+			if err := LoadSnapshot(r.(Snapshotable), snapshot.Path); err != nil {
+				return nil, err
+			}
+		}
+		return r, nil
+	}
+
+	db, err := gorm.Open(dialector, gormConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect database: %w", err)
 	}
+	return NewORMRepository(db)
 }
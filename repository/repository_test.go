@@ -1,19 +1,36 @@
 package repository
 
 import (
+	"context"
 	"testing"
+	"time"
 )
 
 func TestSetAndRetrieveTargets(t *testing.T) {
+	ctx := context.Background()
 	er := &targetsRepository{}
-	er.StoreTargets(serviceName, []Target{
+	er.StoreTargets(ctx, serviceName, []Target{
 		{Endpoint: "localhost:3000/-/exceptions"},
 		{Endpoint: "localhost:3001/-/exceptions"},
 	})
 
-	retrievedTargets := er.GetTargets()
+	retrievedTargets, _ := er.GetTargets(ctx)
 	if retrievedTargets[serviceName][0].Endpoint != "localhost:3000/-/exceptions" ||
 		retrievedTargets[serviceName][1].Endpoint != "localhost:3001/-/exceptions" {
 		t.Errorf("Inconsistent target fetch and retrieval")
 	}
 }
+
+func TestErrorStatusHistoryIsCapped(t *testing.T) {
+	status := NewErrorStatus()
+	now := time.Now()
+	for i := 0; i < MaxStatusHistory+10; i++ {
+		status = status.Apply(StatusChange{Status: StatusResolved}, i, now)
+	}
+	if len(status.StatusHistory) != MaxStatusHistory {
+		t.Errorf("Expected %d transitions, Found %d", MaxStatusHistory, len(status.StatusHistory))
+	}
+	if last := status.StatusHistory[MaxStatusHistory-1]; last.TotalCount != MaxStatusHistory+9 {
+		t.Errorf("Expected the newest transitions to be kept, Found %+v", last)
+	}
+}
@@ -0,0 +1,553 @@
+// Package repositorytest provides a conformance suite for implementations of repository.ErrorsRepository
+package repositorytest
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/periskop-dev/periskop/config"
+	"github.com/periskop-dev/periskop/repository"
+)
+
+const serviceName = "test-service"
+
+// RunConformance checks that a repository implementation behaves like the repositories of periskop.
+// newRepository must return a new empty repository on every call.
+func RunConformance(t *testing.T, newRepository func(t *testing.T) repository.ErrorsRepository) {
+	tests := map[string]func(t *testing.T, r repository.ErrorsRepository){
+		"GetErrorsOfUnknownService": testGetErrorsOfUnknownService,
+		"ReplaceErrors":             testReplaceErrors,
+		"ReplaceErrorsKeepsStatus":  testReplaceErrorsKeepsStatus,
+		"HiddenErrors":              testHiddenErrors,
+		"GetServices":               testGetServices,
+		"ErrorStatus":               testErrorStatus,
+		"ResolveError":              testResolveError,
+		"ScraperState":              testScraperState,
+		"Targets":                   testTargets,
+		"OccurrencesHistogram":      testOccurrencesHistogram,
+		"Prune":                     testPrune,
+		"ExportImportErrors":        testExportImportErrors,
+		"QueryErrors":               testQueryErrors,
+		"GetError":                  testGetError,
+		"GetOccurrences":            testGetOccurrences,
+	}
+	names := make([]string, 0, len(tests))
+	for name := range tests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		test := tests[name]
+		t.Run(name, func(t *testing.T) {
+			test(t, newRepository(t))
+		})
+	}
+}
+
+// newError returns an error with the given number of occurrences, newest first
+func newError(key string, totalCount int, lastSeen int64) repository.ErrorAggregate {
+	latestErrors := []repository.ErrorWithContext{}
+	for i := totalCount - 1; i >= 0; i-- {
+		latestErrors = append(latestErrors, repository.ErrorWithContext{
+			Error: repository.ErrorInstance{
+				Class:      "Error",
+				Message:    key,
+				Stacktrace: []string{"line 1", "line 2"},
+			},
+			UUID:      key + "-" + string(rune('a'+i)),
+			Timestamp: lastSeen - int64(totalCount-1-i),
+			Severity:  "error",
+		})
+	}
+	return repository.ErrorAggregate{
+		AggregationKey: key,
+		TotalCount:     totalCount,
+		Severity:       "error",
+		LatestErrors:   latestErrors,
+		CreatedAt:      lastSeen - int64(totalCount),
+		FirstSeen:      lastSeen - int64(totalCount-1),
+		LastSeen:       lastSeen,
+	}
+}
+
+// byKey indexes errors by aggregation key, repositories don't guarantee the order of the errors
+func byKey(errorAggregates []repository.ErrorAggregate) map[string]repository.ErrorAggregate {
+	indexed := make(map[string]repository.ErrorAggregate, len(errorAggregates))
+	for _, errorAggregate := range errorAggregates {
+		indexed[errorAggregate.AggregationKey] = errorAggregate
+	}
+	return indexed
+}
+
+func testGetErrorsOfUnknownService(t *testing.T, r repository.ErrorsRepository) {
+	ctx := context.Background()
+	if _, err := r.GetErrors(ctx, serviceName, 10); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("Expected not found fetching errors of an unknown service, Found %v", err)
+	}
+	if _, err := r.ExportErrors(ctx, serviceName); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("Expected not found exporting errors of an unknown service, Found %v", err)
+	}
+}
+
+func testReplaceErrors(t *testing.T, r repository.ErrorsRepository) {
+	ctx := context.Background()
+	if err := r.ReplaceErrors(ctx, serviceName, []repository.ErrorAggregate{
+		newError("test-error-0", 3, 100),
+		newError("test-error-1", 1, 100),
+	}); err != nil {
+		t.Fatalf("Fail to store errors: %s", err)
+	}
+
+	errorAggregates, err := r.GetErrors(ctx, serviceName, 2)
+	if err != nil || len(errorAggregates) != 2 {
+		t.Fatalf("Expected 2 errors, Found %+v, %v", errorAggregates, err)
+	}
+	expected := newError("test-error-0", 3, 100)
+	expected.LatestErrors = expected.LatestErrors[:2]
+	expected.ErrorStatus = repository.NewErrorStatus()
+	if found := byKey(errorAggregates)["test-error-0"]; !reflect.DeepEqual(found, expected) {
+		t.Errorf("Expected the newest occurrences of the error %+v, Found %+v", expected, found)
+	}
+
+	// errors without new occurrences aren't updated, errors not replaced are kept
+	unchanged := newError("test-error-0", 3, 100)
+	unchanged.Severity = "warning"
+	r.ReplaceErrors(ctx, serviceName, []repository.ErrorAggregate{ // nolint[errcheck]
+		unchanged,
+		newError("test-error-2", 1, 100),
+	})
+	errorAggregates, _ = r.GetErrors(ctx, serviceName, 10)
+	indexed := byKey(errorAggregates)
+	if len(indexed) != 3 || indexed["test-error-0"].Severity != "error" {
+		t.Errorf("Unexpected errors %+v", errorAggregates)
+	}
+}
+
+func testReplaceErrorsKeepsStatus(t *testing.T, r repository.ErrorsRepository) {
+	ctx := context.Background()
+	r.ReplaceErrors(ctx, serviceName, []repository.ErrorAggregate{newError("test-error-0", 1, 100)}) // nolint[errcheck]
+	r.ResolveError(ctx, serviceName, "test-error-0")                                                 // nolint[errcheck]
+	r.ReplaceErrors(ctx, serviceName, []repository.ErrorAggregate{newError("test-error-0", 2, 200)}) // nolint[errcheck]
+
+	status, err := r.GetErrorStatus(ctx, serviceName, "test-error-0")
+	if err != nil || status.Status != repository.StatusResolved {
+		t.Errorf("Expected the error to be kept as resolved, Found %+v, %v", status, err)
+	}
+	exported, _ := r.ExportErrors(ctx, serviceName)
+	if len(exported) != 1 || exported[0].TotalCount != 2 || len(exported[0].LatestErrors) != 2 {
+		t.Errorf("Expected the error to be updated, Found %+v", exported)
+	}
+}
+
+func testHiddenErrors(t *testing.T, r repository.ErrorsRepository) {
+	ctx := context.Background()
+	r.ReplaceErrors(ctx, serviceName, []repository.ErrorAggregate{ // nolint[errcheck]
+		newError("test-error-0", 1, 100),
+		newError("test-error-1", 1, 100),
+		newError("test-error-2", 1, 100),
+	})
+	changes := map[string]repository.StatusChange{
+		"test-error-0": {Status: repository.StatusResolved},
+		"test-error-1": {Status: repository.StatusIgnored},
+		"test-error-2": {Status: repository.StatusSnoozed, SnoozeCount: 10},
+	}
+	for key, change := range changes {
+		if err := r.SetErrorStatus(ctx, serviceName, key, change); err != nil {
+			t.Fatalf("Fail to change status of %s: %s", key, err)
+		}
+	}
+
+	// a service whose errors are all hidden still exists
+	errorAggregates, err := r.GetErrors(ctx, serviceName, 10)
+	if err != nil || len(errorAggregates) != 0 {
+		t.Errorf("Expected no errors listed, Found %+v, %v", errorAggregates, err)
+	}
+	if services, _ := r.GetServices(ctx); !reflect.DeepEqual(services, []string{serviceName}) {
+		t.Errorf("Expected service %s, Found %v", serviceName, services)
+	}
+}
+
+func testGetServices(t *testing.T, r repository.ErrorsRepository) {
+	ctx := context.Background()
+	if services, err := r.GetServices(ctx); err != nil || len(services) != 0 {
+		t.Errorf("Expected no services, Found %v, %v", services, err)
+	}
+	for _, name := range []string{"service-b", "service-c", "service-a"} {
+		r.ReplaceErrors(ctx, name, []repository.ErrorAggregate{newError("test-error-0", 1, 100)}) // nolint[errcheck]
+	}
+	services, err := r.GetServices(ctx)
+	if err != nil || !reflect.DeepEqual(services, []string{"service-a", "service-b", "service-c"}) {
+		t.Errorf("Expected services sorted by name, Found %v, %v", services, err)
+	}
+}
+
+func testErrorStatus(t *testing.T, r repository.ErrorsRepository) {
+	ctx := context.Background()
+	r.ReplaceErrors(ctx, serviceName, []repository.ErrorAggregate{newError("test-error-0", 3, 100)}) // nolint[errcheck]
+
+	for _, key := range []string{"test-error-0", "unknown"} {
+		if status, err := r.GetErrorStatus(ctx, serviceName, key); err != nil || status.Status != repository.StatusOpen {
+			t.Errorf("Expected %s to be open, Found %+v, %v", key, status, err)
+		}
+	}
+
+	snooze := repository.StatusChange{Status: repository.StatusSnoozed, SnoozeCount: 10, Actor: "alice"}
+	if err := r.SetErrorStatus(ctx, serviceName, "test-error-0", snooze); err != nil {
+		t.Fatalf("Fail to change status: %s", err)
+	}
+	status, _ := r.GetErrorStatus(ctx, serviceName, "test-error-0")
+	if status.Status != repository.StatusSnoozed || status.SnoozedUntilCount != 13 || len(status.StatusHistory) != 1 ||
+		status.StatusHistory[0].Actor != "alice" || status.StatusHistory[0].TotalCount != 3 {
+		t.Errorf("Unexpected status %+v", status)
+	}
+
+	statuses, err := r.GetErrorStatuses(ctx, serviceName)
+	if err != nil || len(statuses) != 1 || statuses["test-error-0"].SnoozedUntilCount != 13 {
+		t.Errorf("Expected the status of the snoozed error, Found %+v, %v", statuses, err)
+	}
+
+	regress := repository.StatusChange{Status: repository.StatusRegressed}
+	r.SetErrorStatus(ctx, serviceName, "test-error-0", regress) // nolint[errcheck]
+	listed, _ := r.GetErrors(ctx, serviceName, 10)
+	if len(listed) != 1 || listed[0].Status != repository.StatusRegressed || len(listed[0].StatusHistory) != 2 {
+		t.Errorf("Expected the regressed error to be listed with its history, Found %+v", listed)
+	}
+
+	// open errors aren't listed by GetErrorStatuses
+	reopen := repository.StatusChange{Status: repository.StatusOpen}
+	r.SetErrorStatus(ctx, serviceName, "test-error-0", reopen) // nolint[errcheck]
+	if statuses, err := r.GetErrorStatuses(ctx, serviceName); err != nil || len(statuses) != 0 {
+		t.Errorf("Expected no statuses of open errors, Found %+v, %v", statuses, err)
+	}
+	if statuses, err := r.GetErrorStatuses(ctx, "unknown"); err != nil || len(statuses) != 0 {
+		t.Errorf("Expected no statuses for an unknown service, Found %+v, %v", statuses, err)
+	}
+
+	if err := r.SetErrorStatus(ctx, serviceName, "unknown", snooze); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("Expected not found changing the status of an unknown error, Found %v", err)
+	}
+	if err := r.SetErrorStatus(ctx, "unknown", "test-error-0", snooze); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("Expected not found changing the status of an error of an unknown service, Found %v", err)
+	}
+}
+
+func testResolveError(t *testing.T, r repository.ErrorsRepository) {
+	ctx := context.Background()
+	r.ReplaceErrors(ctx, serviceName, []repository.ErrorAggregate{ // nolint[errcheck]
+		newError("test-error-0", 1, 100),
+		newError("test-error-1", 1, 100),
+	})
+	if err := r.ResolveError(ctx, serviceName, "test-error-0"); err != nil {
+		t.Fatalf("Fail to resolve error: %s", err)
+	}
+	if resolved, err := r.SearchResolved(ctx, serviceName, "test-error-0"); err != nil || !resolved {
+		t.Errorf("Error should be resolved")
+	}
+	for _, key := range []string{"test-error-1", "unknown"} {
+		if resolved, err := r.SearchResolved(ctx, serviceName, key); err != nil || resolved {
+			t.Errorf("Error %s shouldn't be resolved", key)
+		}
+	}
+	listed, _ := r.GetErrors(ctx, serviceName, 10)
+	if len(listed) != 1 || listed[0].AggregationKey != "test-error-1" {
+		t.Errorf("Expected resolved errors not to be listed, Found %+v", listed)
+	}
+
+	if err := r.RemoveResolved(ctx, serviceName, "test-error-0"); err != nil {
+		t.Fatalf("Fail to reopen error: %s", err)
+	}
+	if status, _ := r.GetErrorStatus(ctx, serviceName, "test-error-0"); status.Status != repository.StatusOpen {
+		t.Errorf("Expected the error to be reopened, Found %+v", status)
+	}
+	// reopening errors that aren't resolved does nothing
+	if err := r.RemoveResolved(ctx, serviceName, "unknown"); err != nil {
+		t.Errorf("Expected no error reopening an unknown error, Found %s", err)
+	}
+	if err := r.ResolveError(ctx, serviceName, "unknown"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("Expected not found resolving an unknown error, Found %v", err)
+	}
+}
+
+func testScraperState(t *testing.T, r repository.ErrorsRepository) {
+	ctx := context.Background()
+	if _, err := r.GetScraperState(ctx, serviceName); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("Expected not found fetching an unknown scraper state, Found %v", err)
+	}
+
+	state := repository.ScraperState{
+		TargetErrorsCount: map[string]map[string]int{"target": {"test-error-0": 1}},
+		ErrorAggregates:   []repository.ErrorAggregate{newError("test-error-0", 1, 100)},
+	}
+	for i := 0; i < 2; i++ {
+		if err := r.StoreScraperState(ctx, serviceName, state); err != nil {
+			t.Fatalf("Fail to store scraper state: %s", err)
+		}
+	}
+	stored, err := r.GetScraperState(ctx, serviceName)
+	if err != nil || !reflect.DeepEqual(stored, state) {
+		t.Errorf("Expected scraper state %+v, Found %+v, %v", state, stored, err)
+	}
+}
+
+func testTargets(t *testing.T, r repository.ErrorsRepository) {
+	ctx := context.Background()
+	targets := []repository.Target{{Endpoint: "10.0.0.1:8080", LastScrapeResult: "success"}}
+	if err := r.StoreTargets(ctx, serviceName, targets); err != nil {
+		t.Fatalf("Fail to store targets: %s", err)
+	}
+	stored, err := r.GetTargets(ctx)
+	if err != nil || !reflect.DeepEqual(stored, map[string][]repository.Target{serviceName: targets}) {
+		t.Errorf("Expected targets %+v, Found %+v, %v", targets, stored, err)
+	}
+}
+
+func testOccurrencesHistogram(t *testing.T, r repository.ErrorsRepository) {
+	ctx := context.Background()
+	now := time.Unix(1600000200, 0)
+	r.AddOccurrences(ctx, serviceName, map[string]int{"test-error-0": 2, "test-error-1": 1}, // nolint[errcheck]
+		now.Add(-2*time.Minute))
+	r.AddOccurrences(ctx, serviceName, map[string]int{"test-error-0": 3}, now.Add(-time.Minute)) // nolint[errcheck]
+	r.AddOccurrences(ctx, serviceName, map[string]int{"test-error-0": 4}, now)                   // nolint[errcheck]
+
+	histogram, err := r.GetOccurrencesHistogram(ctx, serviceName, "test-error-0", now.Add(-3*time.Minute),
+		now.Add(time.Minute), 2*time.Minute)
+	expected := []repository.OccurrenceBucket{
+		{Timestamp: now.Add(-3 * time.Minute).Unix(), Count: 2},
+		{Timestamp: now.Add(-time.Minute).Unix(), Count: 7},
+	}
+	if err != nil || !reflect.DeepEqual(histogram, expected) {
+		t.Errorf("Expected histogram %+v, Found %+v, %v", expected, histogram, err)
+	}
+
+	// unknown errors have empty buckets
+	histogram, _ = r.GetOccurrencesHistogram(ctx, serviceName, "unknown", now, now.Add(time.Minute), time.Minute)
+	if !reflect.DeepEqual(histogram, []repository.OccurrenceBucket{{Timestamp: now.Unix()}}) {
+		t.Errorf("Expected an empty bucket, Found %+v", histogram)
+	}
+
+	// minute buckets are rolled up to hour buckets after a day
+	r.AddOccurrences(ctx, serviceName, map[string]int{}, now.Add(25*time.Hour)) // nolint[errcheck]
+	histogram, _ = r.GetOccurrencesHistogram(ctx, serviceName, "test-error-0", now.Add(-time.Hour),
+		now.Add(time.Hour), 2*time.Hour)
+	if len(histogram) != 1 || histogram[0].Count != 9 {
+		t.Errorf("Expected 9 occurrences, Found %+v", histogram)
+	}
+}
+
+func testPrune(t *testing.T, r repository.ErrorsRepository) {
+	ctx := context.Background()
+	now := time.Unix(1600000200, 0)
+	day := int64(24 * time.Hour / time.Second)
+	r.ReplaceErrors(ctx, serviceName, []repository.ErrorAggregate{ // nolint[errcheck]
+		newError("expired", 1, now.Unix()-10*day),
+		newError("old", 1, now.Unix()-2*day),
+		newError("recent", 3, now.Unix()-day),
+	})
+	// errors are resolved at the current time, so the resolution time is imported
+	resolved := newError("resolved", 1, now.Unix()-day)
+	resolved.ErrorStatus = repository.NewErrorStatus().Apply(repository.StatusChange{Status: repository.StatusResolved},
+		1, now.Add(-48*time.Hour))
+	r.ImportErrors(ctx, serviceName, []repository.ErrorAggregate{resolved})                   // nolint[errcheck]
+	r.AddOccurrences(ctx, serviceName, map[string]int{"recent": 1}, now.Add(-8*24*time.Hour)) // nolint[errcheck]
+	r.AddOccurrences(ctx, serviceName, map[string]int{"expired": 1, "recent": 1}, now)        // nolint[errcheck]
+	state := repository.ScraperState{
+		TargetErrorsCount: map[string]map[string]int{"target": {"expired": 1, "recent": 3}},
+		ErrorAggregates:   []repository.ErrorAggregate{{AggregationKey: "expired"}, {AggregationKey: "recent"}},
+	}
+	r.StoreScraperState(ctx, serviceName, state) // nolint[errcheck]
+
+	retention := config.Retention{MaxAge: 7 * 24 * time.Hour, ResolvedMaxAge: 24 * time.Hour, MaxOccurrences: 2,
+		MaxErrorsPerService: 1}
+	result, err := r.Prune(ctx, retention, now)
+	expected := repository.PruneResult{ExpiredErrors: 1, ResolvedErrors: 1, ExcessErrors: 1, Occurrences: 1,
+		Keys: map[string][]string{serviceName: {"expired", "old", "resolved"}}}
+	if err != nil || !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected %+v pruned, Found %+v, %v", expected, result, err)
+	}
+
+	exported, _ := r.ExportErrors(ctx, serviceName)
+	expectedError := newError("recent", 3, now.Unix()-day)
+	expectedError.LatestErrors = expectedError.LatestErrors[:2]
+	expectedError.ErrorStatus = repository.NewErrorStatus()
+	if len(exported) != 1 || !reflect.DeepEqual(exported[0], expectedError) {
+		t.Errorf("Expected the most recently seen error with its newest occurrences, Found %+v", exported)
+	}
+	if status, _ := r.GetErrorStatus(ctx, serviceName, "resolved"); status.Status != repository.StatusOpen {
+		t.Errorf("Expected the status of pruned errors to be removed, Found %+v", status)
+	}
+	histogram, _ := r.GetOccurrencesHistogram(ctx, serviceName, "expired", now, now.Add(time.Minute), time.Minute)
+	if len(histogram) != 1 || histogram[0].Count != 0 {
+		t.Errorf("Expected the occurrences of pruned errors to be removed, Found %+v", histogram)
+	}
+	// occurrences older than the max age are removed, even for the errors that are kept
+	histogram, _ = r.GetOccurrencesHistogram(ctx, serviceName, "recent", now.Add(-9*24*time.Hour),
+		now.Add(time.Minute), 9*24*time.Hour)
+	if len(histogram) != 2 || histogram[0].Count != 0 || histogram[1].Count != 1 {
+		t.Errorf("Expected the occurrences older than the max age to be removed, Found %+v", histogram)
+	}
+	// the counters of pruned errors are removed from the scraper state, the counts of the targets are kept
+	state.ErrorAggregates = state.ErrorAggregates[1:]
+	if stored, err := r.GetScraperState(ctx, serviceName); err != nil || !reflect.DeepEqual(stored, state) {
+		t.Errorf("Expected scraper state %+v, Found %+v, %v", state, stored, err)
+	}
+}
+
+func testExportImportErrors(t *testing.T, r repository.ErrorsRepository) {
+	ctx := context.Background()
+	resolved := newError("test-error-1", 2, 200)
+	resolved.ErrorStatus = repository.NewErrorStatus().Apply(
+		repository.StatusChange{Status: repository.StatusResolved, Actor: "alice", Note: "fixed"}, 2, time.Unix(300, 0))
+	open := newError("test-error-0", 1, 100)
+	open.ErrorStatus = repository.NewErrorStatus()
+	if err := r.ImportErrors(ctx, serviceName, []repository.ErrorAggregate{open, resolved}); err != nil {
+		t.Fatalf("Fail to import errors: %s", err)
+	}
+
+	exported, err := r.ExportErrors(ctx, serviceName)
+	indexed := byKey(exported)
+	if err != nil || len(indexed) != 2 || !reflect.DeepEqual(indexed["test-error-0"], open) ||
+		!reflect.DeepEqual(indexed["test-error-1"], resolved) {
+		t.Errorf("Expected errors %+v and %+v, Found %+v, %v", open, resolved, exported, err)
+	}
+
+	// imported errors replace the stored ones, including their status
+	reopened := resolved
+	reopened.ErrorStatus = repository.NewErrorStatus()
+	r.ImportErrors(ctx, serviceName, []repository.ErrorAggregate{reopened}) // nolint[errcheck]
+	if status, _ := r.GetErrorStatus(ctx, serviceName, "test-error-1"); status.Status != repository.StatusOpen ||
+		len(status.StatusHistory) != 0 {
+		t.Errorf("Expected the imported status, Found %+v", status)
+	}
+}
+
+func testQueryErrors(t *testing.T, r repository.ErrorsRepository) {
+	ctx := context.Background()
+	if _, err := r.QueryErrors(ctx, serviceName, repository.ErrorsQuery{}); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("Expected not found querying errors of an unknown service, Found %v", err)
+	}
+
+	errorA, errorB, errorC, resolved := newError("error-a", 5, 100), newError("error-b", 3, 300),
+		newError("error-c", 3, 200), newError("error-d", 10, 400)
+	errorA.LatestErrors[1].Error.Class = "NullPointerException"
+	errorB.Severity = "warning"
+	r.ReplaceErrors(ctx, serviceName, []repository.ErrorAggregate{errorA, errorB, errorC, resolved}) // nolint[errcheck]
+	r.ResolveError(ctx, serviceName, "error-d")                                                      // nolint[errcheck]
+
+	queries := []struct {
+		query    repository.ErrorsQuery
+		expected [][]string
+	}{
+		{repository.ErrorsQuery{}, [][]string{{"error-b", "error-c", "error-a"}}},
+		{repository.ErrorsQuery{Sort: repository.SortByCreatedAt}, [][]string{{"error-b", "error-c", "error-a"}}},
+		{repository.ErrorsQuery{Sort: repository.SortByCount, Limit: 2},
+			[][]string{{"error-a", "error-b"}, {"error-c"}}},
+		{repository.ErrorsQuery{Limit: 1}, [][]string{{"error-b"}, {"error-c"}, {"error-a"}}},
+		{repository.ErrorsQuery{Severity: "warning"}, [][]string{{"error-b"}}},
+		{repository.ErrorsQuery{Search: "ERROR-C"}, [][]string{{"error-c"}}},
+		{repository.ErrorsQuery{Search: "nullpointer"}, [][]string{{"error-a"}}},
+		{repository.ErrorsQuery{Search: "%"}, [][]string{{}}},
+		{repository.ErrorsQuery{Severity: "error", Search: "error", Sort: repository.SortByCount, Limit: 1},
+			[][]string{{"error-a"}, {"error-c"}}},
+	}
+	for _, test := range queries {
+		query := test.query
+		query.NumberOfErrors = 1
+		pages := [][]string{}
+		for {
+			page, err := r.QueryErrors(ctx, serviceName, query)
+			if err != nil {
+				t.Fatalf("Fail to query %+v: %s", query, err)
+			}
+			keys := []string{}
+			for _, errorAggregate := range page.Errors {
+				keys = append(keys, errorAggregate.AggregationKey)
+				if len(errorAggregate.LatestErrors) != 1 {
+					t.Errorf("Expected 1 occurrence, Found %+v", errorAggregate.LatestErrors)
+				}
+			}
+			pages = append(pages, keys)
+			if page.NextCursor == "" || len(pages) > len(test.expected) {
+				break
+			}
+			query.Cursor = page.NextCursor
+		}
+		if !reflect.DeepEqual(pages, test.expected) {
+			t.Errorf("Expected pages %v for query %+v, Found %v", test.expected, test.query, pages)
+		}
+	}
+
+	invalid := repository.ErrorsQuery{Sort: repository.SortByCount, Cursor: "invalid"}
+	if _, err := r.QueryErrors(ctx, serviceName, invalid); err == nil {
+		t.Errorf("Expected an error querying with an invalid cursor")
+	}
+}
+
+func testGetError(t *testing.T, r repository.ErrorsRepository) {
+	ctx := context.Background()
+	if _, err := r.GetError(ctx, serviceName, "test-error-0", 10); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("Expected not found fetching an error of an unknown service, Found %v", err)
+	}
+	r.ReplaceErrors(ctx, serviceName, []repository.ErrorAggregate{newError("test-error-0", 3, 100)}) // nolint[errcheck]
+	r.ResolveError(ctx, serviceName, "test-error-0")                                                 // nolint[errcheck]
+
+	// errors are fetched whatever their status
+	errorAggregate, err := r.GetError(ctx, serviceName, "test-error-0", 2)
+	expected := newError("test-error-0", 3, 100)
+	expected.LatestErrors = expected.LatestErrors[:2]
+	if err != nil || errorAggregate.Status != repository.StatusResolved {
+		t.Fatalf("Expected the resolved error, Found %+v, %v", errorAggregate, err)
+	}
+	errorAggregate.ErrorStatus = repository.ErrorStatus{}
+	if !reflect.DeepEqual(errorAggregate, expected) {
+		t.Errorf("Expected error %+v, Found %+v", expected, errorAggregate)
+	}
+	if _, err := r.GetError(ctx, serviceName, "unknown", 10); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("Expected not found fetching an unknown error, Found %v", err)
+	}
+}
+
+func testGetOccurrences(t *testing.T, r repository.ErrorsRepository) {
+	ctx := context.Background()
+	query := repository.OccurrencesQuery{Limit: 2}
+	if _, err := r.GetOccurrences(ctx, serviceName, "unknown", query); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("Expected not found fetching the occurrences of an unknown error, Found %v", err)
+	}
+	errorAggregate := newError("test-error-0", 5, 100)
+	// occurrences with the same timestamp are listed once, in an order that depends on the repository
+	errorAggregate.LatestErrors[2].Timestamp = errorAggregate.LatestErrors[1].Timestamp
+	r.ReplaceErrors(ctx, serviceName, []repository.ErrorAggregate{errorAggregate}) // nolint[errcheck]
+
+	occurrences := []repository.ErrorWithContext{}
+	for pages := 0; pages < 5; pages++ {
+		page, err := r.GetOccurrences(ctx, serviceName, "test-error-0", query)
+		if err != nil {
+			t.Fatalf("Fail to fetch occurrences: %s", err)
+		}
+		if len(page.Occurrences) > query.Limit {
+			t.Errorf("Expected at most %d occurrences, Found %d", query.Limit, len(page.Occurrences))
+		}
+		occurrences = append(occurrences, page.Occurrences...)
+		if page.NextCursor == "" {
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+	// the tied occurrences are compared sorted by uuid
+	if len(occurrences) == 5 && occurrences[1].UUID > occurrences[2].UUID {
+		occurrences[1], occurrences[2] = occurrences[2], occurrences[1]
+	}
+	expected := []repository.ErrorWithContext{errorAggregate.LatestErrors[0], errorAggregate.LatestErrors[2],
+		errorAggregate.LatestErrors[1], errorAggregate.LatestErrors[3], errorAggregate.LatestErrors[4]}
+	if !reflect.DeepEqual(occurrences, expected) {
+		t.Errorf("Expected occurrences %+v, Found %+v", expected, occurrences)
+	}
+
+	if _, err := r.GetOccurrences(ctx, serviceName, "test-error-0",
+		repository.OccurrencesQuery{Cursor: "invalid"}); err == nil {
+		t.Errorf("Expected an error fetching occurrences with an invalid cursor")
+	}
+}
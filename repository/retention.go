@@ -0,0 +1,154 @@
+package repository
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/periskop-dev/periskop/config"
+	"github.com/periskop-dev/periskop/metrics"
+)
+
+// PruneResult is the number of errors and occurrences removed by each retention policy
+type PruneResult struct {
+	// ExpiredErrors are the errors not seen for longer than the max age
+	ExpiredErrors int
+	// ResolvedErrors are the errors resolved for longer than the resolved max age
+	ResolvedErrors int
+	// ExcessErrors are the least recently seen errors of services exceeding the max errors per service
+	ExcessErrors int
+	// Occurrences are the oldest occurrences of errors exceeding the max occurrences
+	Occurrences int
+	// Keys are the sorted aggregation keys of the pruned errors, by service
+	Keys map[string][]string
+}
+
+// add adds the result of pruning a service, whose pruned errors are given by aggregation key
+func (p *PruneResult) add(serviceName string, other PruneResult, pruned map[string]bool) {
+	p.ExpiredErrors += other.ExpiredErrors
+	p.ResolvedErrors += other.ResolvedErrors
+	p.ExcessErrors += other.ExcessErrors
+	p.Occurrences += other.Occurrences
+	if len(pruned) == 0 {
+		return
+	}
+	if p.Keys == nil {
+		p.Keys = make(map[string][]string)
+	}
+	keys := make([]string, 0, len(pruned))
+	for key := range pruned {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	p.Keys[serviceName] = keys
+}
+
+// Errors returns the number of errors removed by any retention policy
+func (p PruneResult) Errors() int {
+	return p.ExpiredErrors + p.ResolvedErrors + p.ExcessErrors
+}
+
+// prunedErrors selects the errors of a service removed by the retention policies, by aggregation key.
+// The errors must include their status.
+func prunedErrors(errorAggregates []ErrorAggregate, retention config.Retention,
+	now time.Time) (map[string]bool, PruneResult) {
+	pruned := make(map[string]bool)
+	result := PruneResult{}
+	kept := make([]ErrorAggregate, 0, len(errorAggregates))
+	for _, errorAggregate := range errorAggregates {
+		switch {
+		case retention.MaxAge > 0 && lastSeenAt(errorAggregate) < now.Add(-retention.MaxAge).Unix():
+			pruned[errorAggregate.AggregationKey] = true
+			result.ExpiredErrors++
+		case retention.ResolvedMaxAge > 0 && errorAggregate.Status == StatusResolved &&
+			errorAggregate.LastResolvedAt < now.Add(-retention.ResolvedMaxAge).Unix():
+			pruned[errorAggregate.AggregationKey] = true
+			result.ResolvedErrors++
+		default:
+			kept = append(kept, errorAggregate)
+		}
+	}
+
+	if retention.MaxErrorsPerService > 0 && len(kept) > retention.MaxErrorsPerService {
+		sort.SliceStable(kept, func(i, j int) bool {
+			return lastSeenAt(kept[i]) > lastSeenAt(kept[j])
+		})
+		for _, errorAggregate := range kept[retention.MaxErrorsPerService:] {
+			pruned[errorAggregate.AggregationKey] = true
+			result.ExcessErrors++
+		}
+	}
+	return pruned, result
+}
+
+// withoutErrors returns a scraper state without the counters of the given errors. The counts reported by
+// the targets are kept, so the errors aren't stored again until they have new occurrences.
+func withoutErrors(state ScraperState, keys map[string]bool) ScraperState {
+	errorAggregates := make([]ErrorAggregate, 0, len(state.ErrorAggregates))
+	for _, errorAggregate := range state.ErrorAggregates {
+		if !keys[errorAggregate.AggregationKey] {
+			errorAggregates = append(errorAggregates, errorAggregate)
+		}
+	}
+	state.ErrorAggregates = errorAggregates
+	return state
+}
+
+// lastSeenAt returns the unix time when an error was last seen, errors stored by previous versions
+// only have their creation time
+func lastSeenAt(errorAggregate ErrorAggregate) int64 {
+	if errorAggregate.LastSeen > errorAggregate.CreatedAt {
+		return errorAggregate.LastSeen
+	}
+	return errorAggregate.CreatedAt
+}
+
+// Janitor applies the retention policies to a repository periodically
+type Janitor struct {
+	repository ErrorsRepository
+	retention  config.Retention
+	// forget is called with the keys of the errors pruned from every service, so their scrapers forget them
+	forget func(serviceName string, keys []string)
+}
+
+// NewJanitor creates a janitor of a repository, forget is called with the errors pruned from every service
+func NewJanitor(r ErrorsRepository, retention config.Retention,
+	forget func(serviceName string, keys []string)) Janitor {
+	return Janitor{repository: r, retention: retention, forget: forget}
+}
+
+// Run prunes the repository every retention interval until the context is cancelled
+func (j Janitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(j.retention.GetInterval())
+	defer ticker.Stop()
+	for {
+		j.Prune(ctx, time.Now()) // nolint[errcheck]
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Prune applies the retention policies once, reporting what was pruned in metrics
+func (j Janitor) Prune(ctx context.Context, now time.Time) (PruneResult, error) {
+	result, err := j.repository.Prune(ctx, j.retention, now)
+	metrics.PrunedErrors.WithLabelValues("max_age").Add(float64(result.ExpiredErrors))
+	metrics.PrunedErrors.WithLabelValues("resolved_max_age").Add(float64(result.ResolvedErrors))
+	metrics.PrunedErrors.WithLabelValues("max_errors_per_service").Add(float64(result.ExcessErrors))
+	metrics.PrunedOccurrences.Add(float64(result.Occurrences))
+	if j.forget != nil {
+		for serviceName, keys := range result.Keys {
+			j.forget(serviceName, keys)
+		}
+	}
+	if err != nil {
+		metrics.ServiceErrors.WithLabelValues("prune").Inc()
+		log.Printf("Failed to prune the repository: %s", err)
+		return result, err
+	}
+	log.Printf("Pruned %d errors and %d occurrences", result.Errors(), result.Occurrences)
+	return result, nil
+}
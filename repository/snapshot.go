@@ -0,0 +1,199 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/periskop-dev/periskop/config"
+	"github.com/periskop-dev/periskop/metrics"
+)
+
+// snapshotVersion is the version of the snapshot format, snapshots of other versions aren't loaded
+const snapshotVersion = 1
+
+// memorySnapshot is the state of a memory repository written to snapshots
+type memorySnapshot struct {
+	Version int `json:"version"`
+	// map service name -> list of errors
+	Errors map[string][]ErrorAggregate `json:"errors"`
+	// map service name -> error key -> status of the error
+	ErrorStatuses map[string]map[string]ErrorStatus `json:"error_statuses"`
+	// map service name -> scraper state
+	ScraperStates map[string]ScraperState `json:"scraper_states"`
+	// map service name -> list of scraped targets
+	Targets map[string][]Target `json:"targets"`
+	// map service name -> error key -> occurrences series
+	Occurrences map[string]map[string]occurrenceSeries `json:"occurrences"`
+}
+
+// Snapshotable is a repository whose whole state can be written to and restored from a snapshot
+type Snapshotable interface {
+	WriteSnapshot(w io.Writer) error
+	RestoreSnapshot(r io.Reader) error
+}
+
+// WriteSnapshot writes the state of the repository as json
+func (r *memoryRepository) WriteSnapshot(w io.Writer) error {
+	snapshot := memorySnapshot{
+		Version:       snapshotVersion,
+		Errors:        make(map[string][]ErrorAggregate),
+		ErrorStatuses: make(map[string]map[string]ErrorStatus),
+		ScraperStates: make(map[string]ScraperState),
+		Targets:       make(map[string][]Target),
+	}
+
+	// errors and statuses are read under the lock, so the statuses always belong to the snapshotted errors
+	r.errorsMutex.Lock()
+	r.AggregatedError.Range(func(key, value interface{}) bool {
+		snapshot.Errors[key.(string)] = value.([]ErrorAggregate)
+		return true
+	})
+	r.ErrorStatuses.Range(func(key, value interface{}) bool {
+		snapshot.ErrorStatuses[key.(string)] = value.(map[string]ErrorStatus)
+		return true
+	})
+	r.errorsMutex.Unlock()
+
+	r.ScraperStates.Range(func(key, value interface{}) bool {
+		snapshot.ScraperStates[key.(string)] = value.(ScraperState)
+		return true
+	})
+	r.Targets.Range(func(key, value interface{}) bool {
+		snapshot.Targets[key.(string)] = value.([]Target)
+		return true
+	})
+
+	// occurrences series are modified in place, so they are encoded while holding the lock
+	r.occurrencesMutex.RLock()
+	defer r.occurrencesMutex.RUnlock()
+	snapshot.Occurrences = r.Occurrences
+	return json.NewEncoder(w).Encode(snapshot)
+}
+
+// RestoreSnapshot restores the state of the repository from a snapshot written by WriteSnapshot
+func (r *memoryRepository) RestoreSnapshot(reader io.Reader) error {
+	var snapshot memorySnapshot
+	if err := json.NewDecoder(reader).Decode(&snapshot); err != nil {
+		return fmt.Errorf("invalid snapshot: %w", err)
+	}
+	if snapshot.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d, expected %d", snapshot.Version, snapshotVersion)
+	}
+
+	r.errorsMutex.Lock()
+	for serviceName, errors := range snapshot.Errors {
+		r.AggregatedError.Store(serviceName, errors)
+	}
+	for serviceName, statuses := range snapshot.ErrorStatuses {
+		r.ErrorStatuses.Store(serviceName, statuses)
+	}
+	r.errorsMutex.Unlock()
+
+	for serviceName, state := range snapshot.ScraperStates {
+		r.ScraperStates.Store(serviceName, state)
+	}
+	for serviceName, targets := range snapshot.Targets {
+		r.Targets.Store(serviceName, targets)
+	}
+
+	r.occurrencesMutex.Lock()
+	defer r.occurrencesMutex.Unlock()
+	if snapshot.Occurrences != nil {
+		r.Occurrences = snapshot.Occurrences
+	}
+	return nil
+}
+
+// LoadSnapshot restores a repository from the snapshot file at path. A missing file isn't an error, the repository
+// is left empty.
+func LoadSnapshot(r Snapshotable, path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		log.Printf("No snapshot found at %s, starting with an empty repository", path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := r.RestoreSnapshot(file); err != nil {
+		return fmt.Errorf("failed to load snapshot %s: %w", path, err)
+	}
+	log.Printf("Loaded snapshot %s", path)
+	return nil
+}
+
+// SaveSnapshot writes a snapshot of a repository to path. The snapshot is written to a temporary file which then
+// replaces the previous snapshot, so a failed write never corrupts it.
+func SaveSnapshot(r Snapshotable, path string) error {
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name()) // nolint[errcheck]
+
+	if err := r.WriteSnapshot(file); err != nil {
+		file.Close() // nolint[errcheck]
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close() // nolint[errcheck]
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// Snapshotter writes snapshots of a repository periodically
+type Snapshotter struct {
+	repository Snapshotable
+	snapshot   config.Snapshot
+	// mutex serializes the periodic snapshots and the flush on shutdown
+	mutex sync.Mutex
+}
+
+// NewSnapshotter creates a snapshotter, failing if the repository doesn't support snapshots
+func NewSnapshotter(r ErrorsRepository, snapshot config.Snapshot) (*Snapshotter, error) {
+	snapshotable, ok := r.(Snapshotable)
+	if !ok {
+		return nil, fmt.Errorf("repository doesn't support snapshots")
+	}
+	return &Snapshotter{repository: snapshotable, snapshot: snapshot}, nil
+}
+
+// Run writes a snapshot every snapshot interval until the context is cancelled
+func (s *Snapshotter) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.snapshot.GetInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.Flush() // nolint[errcheck]
+		}
+	}
+}
+
+// Flush writes a snapshot, reporting failures in metrics
+func (s *Snapshotter) Flush() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := SaveSnapshot(s.repository, s.snapshot.Path); err != nil {
+		metrics.ServiceErrors.WithLabelValues("snapshot").Inc()
+		log.Printf("Failed to write snapshot %s: %s", s.snapshot.Path, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package repository
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/periskop-dev/periskop/config"
+)
+
+func TestSnapshotRestoresMemoryRepository(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	now := time.Unix(1600000200, 0)
+
+	r := NewMemoryRepository()
+	r.ReplaceErrors(ctx, serviceName, []ErrorAggregate{ // nolint[errcheck]
+		{AggregationKey: "test-error-0", TotalCount: 2, LatestErrors: []ErrorWithContext{{UUID: "uuid0"}}},
+		{AggregationKey: "test-error-1", TotalCount: 1},
+	})
+	r.ResolveError(ctx, serviceName, "test-error-1")                                         // nolint[errcheck]
+	r.StoreTargets(ctx, serviceName, []Target{{Endpoint: "10.0.0.1:8080"}})                  // nolint[errcheck]
+	r.AddOccurrences(ctx, serviceName, map[string]int{"test-error-0": 2}, now)               // nolint[errcheck]
+	r.StoreScraperState(ctx, serviceName, ScraperState{ErrorAggregates: []ErrorAggregate{}}) // nolint[errcheck]
+	if err := SaveSnapshot(r.(Snapshotable), path); err != nil {
+		t.Fatalf("Fail to save snapshot: %s", err)
+	}
+
+	restored := NewMemoryRepository()
+	if err := LoadSnapshot(restored.(Snapshotable), path); err != nil {
+		t.Fatalf("Fail to load snapshot: %s", err)
+	}
+	errors, _ := restored.GetErrors(ctx, serviceName, 10)
+	if len(errors) != 1 || errors[0].AggregationKey != "test-error-0" || len(errors[0].LatestErrors) != 1 {
+		t.Errorf("Expected the open error with its occurrences, Found %+v", errors)
+	}
+	if resolved, _ := restored.SearchResolved(ctx, serviceName, "test-error-1"); !resolved {
+		t.Errorf("Error should be kept as resolved")
+	}
+	targets, _ := restored.GetTargets(ctx)
+	if !reflect.DeepEqual(targets[serviceName], []Target{{Endpoint: "10.0.0.1:8080"}}) {
+		t.Errorf("Unexpected targets %+v", targets)
+	}
+	if _, err := restored.GetScraperState(ctx, serviceName); err != nil {
+		t.Errorf("Expected the scraper state to be restored, Found %s", err)
+	}
+	histogram, _ := restored.GetOccurrencesHistogram(ctx, serviceName, "test-error-0", now.Add(-time.Minute),
+		now.Add(time.Minute), 2*time.Minute)
+	if len(histogram) != 1 || histogram[0].Count != 2 {
+		t.Errorf("Expected 2 occurrences, Found %+v", histogram)
+	}
+}
+
+func TestLoadMissingSnapshot(t *testing.T) {
+	r := NewMemoryRepository()
+	if err := LoadSnapshot(r.(Snapshotable), filepath.Join(t.TempDir(), "snapshot.json")); err != nil {
+		t.Errorf("Expected a missing snapshot to be ignored, Found %s", err)
+	}
+	if services, _ := r.GetServices(context.Background()); len(services) != 0 {
+		t.Errorf("Expected an empty repository, Found %v", services)
+	}
+}
+
+func TestLoadInvalidSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	for _, content := range []string{"not json", `{"version": 0}`} {
+		os.WriteFile(path, []byte(content), 0600) // nolint[errcheck]
+		if err := LoadSnapshot(NewMemoryRepository().(Snapshotable), path); err == nil {
+			t.Errorf("Expected an error loading snapshot %s", content)
+		}
+	}
+}
+
+func TestSnapshotterFlush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	r := NewMemoryRepository()
+	r.ReplaceErrors(context.Background(), serviceName, []ErrorAggregate{{AggregationKey: "test-error-0"}}) // nolint[errcheck]
+
+	snapshotter, err := NewSnapshotter(r, config.Snapshot{Path: path})
+	if err != nil {
+		t.Fatalf("Fail to create snapshotter: %s", err)
+	}
+	if err := snapshotter.Flush(); err != nil {
+		t.Fatalf("Fail to flush snapshot: %s", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Expected snapshot to be written, Found %s", err)
+	}
+	if _, err := NewSnapshotter(newBoltTestRepository(t), config.Snapshot{Path: path}); err == nil {
+		t.Errorf("Expected an error creating a snapshotter of a bolt repository")
+	}
+}
@@ -0,0 +1,199 @@
+package repository
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Lifecycle states of an aggregated error
+const (
+	StatusOpen     = "open"
+	StatusResolved = "resolved"
+	// StatusIgnored errors never resurface
+	StatusIgnored = "ignored"
+	// StatusSnoozed errors are reopened after a time or after a number of new occurrences
+	StatusSnoozed = "snoozed"
+	// StatusRegressed errors reappeared after being resolved
+	StatusRegressed = "regressed"
+)
+
+// SystemActor is the actor of the status changes made by Periskop itself
+const SystemActor = "periskop"
+
+// MaxStatusHistory is the number of transitions kept in the history of an error, older ones are forgotten
+const MaxStatusHistory = 100
+
+// StatusTransition records a change in the status of an aggregated error
+type StatusTransition struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Timestamp int64  `json:"timestamp"`
+	// TotalCount is the number of occurrences of the error when the transition happened
+	TotalCount int    `json:"total_count"`
+	Actor      string `json:"actor,omitempty"`
+	Note       string `json:"note,omitempty"`
+}
+
+// ErrorStatus is the lifecycle state of an aggregated error along with its history of transitions
+type ErrorStatus struct {
+	Status string `json:"status"`
+	// SnoozedUntil is the unix time when a snoozed error is reopened
+	SnoozedUntil int64 `json:"snoozed_until,omitempty"`
+	// SnoozedUntilCount is the total count from which a snoozed error is reopened
+	SnoozedUntilCount int `json:"snoozed_until_count,omitempty"`
+	// LastResolvedAt is the unix time when the error was last resolved
+	LastResolvedAt int64 `json:"last_resolved_at,omitempty"`
+	// Regression is set when the error reappears after being resolved, until it's resolved again
+	Regression    *Regression        `json:"regression,omitempty"`
+	StatusHistory []StatusTransition `json:"status_history,omitempty"`
+}
+
+// Regression is the reappearance of a resolved error
+type Regression struct {
+	DetectedAt int64 `json:"detected_at"`
+	// Occurrence is the newest occurrence of the error when the regression was detected
+	Occurrence *ErrorWithContext `json:"occurrence,omitempty"`
+}
+
+// StatusChange is a requested change of status of an aggregated error
+type StatusChange struct {
+	Status string `json:"status"`
+	// SnoozeUntil is the unix time until the error is snoozed
+	SnoozeUntil int64 `json:"snooze_until,omitempty"`
+	// SnoozeCount is the number of new occurrences until the error is reopened
+	SnoozeCount int `json:"snooze_count,omitempty"`
+	// Actor is who requested the change
+	Actor string `json:"-"`
+	Note  string `json:"note,omitempty"`
+	// Regression is set by Periskop when it detects a regression
+	Regression *Regression `json:"-"`
+}
+
+// NewErrorStatus returns the status of a newly seen error
+func NewErrorStatus() ErrorStatus {
+	return ErrorStatus{Status: StatusOpen}
+}
+
+// Validate checks a status change requested by a user. Regressions can only be detected by the scraper.
+func (c StatusChange) Validate() error {
+	switch c.Status {
+	case StatusOpen, StatusResolved, StatusIgnored:
+		return nil
+	case StatusSnoozed:
+		if c.SnoozeUntil <= 0 && c.SnoozeCount <= 0 {
+			return fmt.Errorf("snoozed status needs either snooze_until or snooze_count")
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid status %s, expected one of %s, %s, %s or %s", c.Status,
+		StatusOpen, StatusResolved, StatusIgnored, StatusSnoozed)
+}
+
+// IsVisible returns true if errors with this status are listed
+func (s ErrorStatus) IsVisible() bool {
+	return s.Status == "" || s.Status == StatusOpen || s.Status == StatusRegressed
+}
+
+// Apply returns the status after the given change, recording the transition in the history and keeping only the
+// last MaxStatusHistory transitions. totalCount is the number of occurrences of the error at the time of the change.
+func (s ErrorStatus) Apply(change StatusChange, totalCount int, now time.Time) ErrorStatus {
+	from := s.Status
+	if from == "" {
+		from = StatusOpen
+	}
+	kept := s.StatusHistory
+	if len(kept) >= MaxStatusHistory {
+		kept = kept[len(kept)-MaxStatusHistory+1:]
+	}
+	history := make([]StatusTransition, 0, len(kept)+1)
+	history = append(history, kept...)
+	history = append(history, StatusTransition{
+		From:       from,
+		To:         change.Status,
+		Timestamp:  now.Unix(),
+		TotalCount: totalCount,
+		Actor:      change.Actor,
+		Note:       change.Note,
+	})
+
+	next := ErrorStatus{
+		Status:         change.Status,
+		LastResolvedAt: s.LastResolvedAt,
+		Regression:     s.Regression,
+		StatusHistory:  history,
+	}
+	if change.Status == StatusResolved {
+		next.LastResolvedAt = now.Unix()
+		next.Regression = nil
+	}
+	if change.Regression != nil {
+		next.Regression = change.Regression
+	}
+	if change.Status == StatusSnoozed {
+		next.SnoozedUntil = change.SnoozeUntil
+		if change.SnoozeCount > 0 {
+			next.SnoozedUntilCount = totalCount + change.SnoozeCount
+		}
+	}
+	return next
+}
+
+// Reopen returns the change reopening a resolved or snoozed error given its current aggregation.
+// Resolved errors with new occurrences regress, snoozed errors are reopened once the snooze is over.
+func (s ErrorStatus) Reopen(errorAggregate ErrorAggregate, now time.Time) (StatusChange, bool) {
+	switch s.Status {
+	case StatusResolved:
+		if errorAggregate.TotalCount > s.lastTotalCount() {
+			regression := &Regression{DetectedAt: now.Unix()}
+			if len(errorAggregate.LatestErrors) > 0 {
+				occurrence := errorAggregate.LatestErrors[0]
+				regression.Occurrence = &occurrence
+			}
+			return StatusChange{Status: StatusRegressed, Actor: SystemActor, Regression: regression}, true
+		}
+	case StatusSnoozed:
+		if (s.SnoozedUntil > 0 && now.Unix() >= s.SnoozedUntil) ||
+			(s.SnoozedUntilCount > 0 && errorAggregate.TotalCount >= s.SnoozedUntilCount) {
+			return StatusChange{Status: StatusOpen, Actor: SystemActor}, true
+		}
+	}
+	return StatusChange{}, false
+}
+
+// Resolutions returns the transitions that resolved the error, oldest first
+func (s ErrorStatus) Resolutions() []StatusTransition {
+	resolutions := []StatusTransition{}
+	for _, transition := range s.StatusHistory {
+		if transition.To == StatusResolved {
+			resolutions = append(resolutions, transition)
+		}
+	}
+	return resolutions
+}
+
+// lastTotalCount returns the total count of the error when its status last changed
+func (s ErrorStatus) lastTotalCount() int {
+	if len(s.StatusHistory) == 0 {
+		return 0
+	}
+	return s.StatusHistory[len(s.StatusHistory)-1].TotalCount
+}
+
+func (s *ErrorStatus) Scan(src interface{}) error {
+	switch value := src.(type) {
+	case nil:
+		return nil
+	case []byte:
+		return json.Unmarshal(value, &s)
+	case string:
+		return json.Unmarshal([]byte(value), &s)
+	}
+	return fmt.Errorf("unsupported type %T for error status", src)
+}
+
+func (s ErrorStatus) Value() (driver.Value, error) {
+	val, err := json.Marshal(s)
+	return string(val), err
+}
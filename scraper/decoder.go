@@ -0,0 +1,268 @@
+package scraper
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	contentTypeJSON     = "application/json"
+	contentTypeProtobuf = "application/x-protobuf"
+	// acceptHeader prefers the binary protobuf representation, falling back to JSON
+	// for targets whose client libraries only support the JSON format
+	acceptHeader = contentTypeProtobuf + ";q=1.0, " + contentTypeJSON + ";q=0.5"
+)
+
+// decodePayload decodes a response body according to its content type.
+// Anything that isn't protobuf is decoded as snake_cased JSON for backward compatibility.
+func decodePayload(contentType string, body []byte) (responsePayload, error) {
+	var rp responsePayload
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && mediaType == contentTypeProtobuf {
+		err := decodeErrors(body, &rp)
+		return rp, err
+	}
+	err := json.Unmarshal(body, &rp)
+	return rp, err
+}
+
+// Field numbers as defined in representation/errors.proto
+const (
+	errorsAggregatedErrorsField = 1
+	errorsTargetUUIDField       = 2
+
+	aggregatedErrorKeyField          = 1
+	aggregatedErrorTotalCountField   = 2
+	aggregatedErrorSeverityField     = 3
+	aggregatedErrorLatestErrorsField = 4
+
+	errorInstanceErrorField       = 1
+	errorInstanceUUIDField        = 2
+	errorInstanceTimestampField   = 3
+	errorInstanceSeverityField    = 4
+	errorInstanceHTTPContextField = 5
+
+	errorClassField      = 1
+	errorMessageField    = 2
+	errorStacktraceField = 3
+	errorCauseField      = 4
+
+	httpContextMethodField  = 1
+	httpContextURLField     = 2
+	httpContextHeadersField = 3
+	httpContextBodyField    = 4
+
+	mapEntryKeyField   = 1
+	mapEntryValueField = 2
+)
+
+// fieldHandler is called for every field of a message, b holds the remaining bytes starting
+// at the field value. It returns the number of bytes consumed, negative on malformed input.
+type fieldHandler func(num protowire.Number, typ protowire.Type, b []byte) (int, error)
+
+// decodeMessage walks through the fields of a protobuf message calling handler for each of them
+func decodeMessage(b []byte, handler fieldHandler) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		n, err := handler(num, typ, b)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// consumeBytes reads a length-delimited field and passes its content to decode
+func consumeBytes(num protowire.Number, typ protowire.Type, b []byte, decode func([]byte) error) (int, error) {
+	if typ != protowire.BytesType {
+		return skipField(num, typ, b)
+	}
+	v, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return n, nil
+	}
+	return n, decode(v)
+}
+
+// skipField ignores fields that are unknown or have an unexpected wire type
+func skipField(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+	return protowire.ConsumeFieldValue(num, typ, b), nil
+}
+
+// consumeString reads a string field into s
+func consumeString(num protowire.Number, typ protowire.Type, b []byte, s *string) (int, error) {
+	return consumeBytes(num, typ, b, func(v []byte) error {
+		*s = string(v)
+		return nil
+	})
+}
+
+// consumeTimestamp reads a RFC3339 formatted string field into t
+func consumeTimestamp(num protowire.Number, typ protowire.Type, b []byte, t *time.Time) (int, error) {
+	return consumeBytes(num, typ, b, func(v []byte) error {
+		parsed, err := time.Parse(time.RFC3339, string(v))
+		if err != nil {
+			return err
+		}
+		*t = parsed
+		return nil
+	})
+}
+
+func decodeErrors(b []byte, rp *responsePayload) error {
+	err := decodeMessage(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case errorsAggregatedErrorsField:
+			return consumeBytes(num, typ, b, func(v []byte) error {
+				var item errorAggregate
+				if err := decodeAggregatedError(v, &item); err != nil {
+					return err
+				}
+				createdAtOfOccurrences(&item)
+				rp.ErrorAggregate = append(rp.ErrorAggregate, item)
+				return nil
+			})
+		case errorsTargetUUIDField:
+			return consumeString(num, typ, b, &rp.Target)
+		}
+		return skipField(num, typ, b)
+	})
+	if err != nil {
+		return fmt.Errorf("decoding protobuf payload: %v", err)
+	}
+	return nil
+}
+
+func decodeAggregatedError(b []byte, item *errorAggregate) error {
+	return decodeMessage(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case aggregatedErrorKeyField:
+			return consumeString(num, typ, b, &item.AggregationKey)
+		case aggregatedErrorTotalCountField:
+			if typ != protowire.VarintType {
+				break
+			}
+			v, n := protowire.ConsumeVarint(b)
+			item.TotalCount = int(v)
+			return n, nil
+		case aggregatedErrorSeverityField:
+			return consumeString(num, typ, b, &item.Severity)
+		case aggregatedErrorLatestErrorsField:
+			return consumeBytes(num, typ, b, func(v []byte) error {
+				var occurrence errorWithContext
+				if err := decodeErrorInstance(v, &occurrence); err != nil {
+					return err
+				}
+				item.LatestErrors = append(item.LatestErrors, occurrence)
+				return nil
+			})
+		}
+		return skipField(num, typ, b)
+	})
+}
+
+// createdAtOfOccurrences sets the creation time of an error decoded from protobuf, which doesn't include it, to the
+// time of its oldest reported occurrence
+func createdAtOfOccurrences(item *errorAggregate) {
+	for _, occurrence := range item.LatestErrors {
+		if item.CreatedAt.IsZero() || occurrence.Timestamp.Before(item.CreatedAt) {
+			item.CreatedAt = occurrence.Timestamp
+		}
+	}
+}
+
+func decodeErrorInstance(b []byte, occurrence *errorWithContext) error {
+	return decodeMessage(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case errorInstanceErrorField:
+			return consumeBytes(num, typ, b, func(v []byte) error {
+				return decodeError(v, &occurrence.Error)
+			})
+		case errorInstanceUUIDField:
+			return consumeString(num, typ, b, &occurrence.UUID)
+		case errorInstanceTimestampField:
+			return consumeTimestamp(num, typ, b, &occurrence.Timestamp)
+		case errorInstanceSeverityField:
+			return consumeString(num, typ, b, &occurrence.Severity)
+		case errorInstanceHTTPContextField:
+			return consumeBytes(num, typ, b, func(v []byte) error {
+				occurrence.HTTPContext = &httpContext{}
+				return decodeHTTPContext(v, occurrence.HTTPContext)
+			})
+		}
+		return skipField(num, typ, b)
+	})
+}
+
+func decodeError(b []byte, e *errorInstance) error {
+	return decodeMessage(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case errorClassField:
+			return consumeString(num, typ, b, &e.Class)
+		case errorMessageField:
+			return consumeString(num, typ, b, &e.Message)
+		case errorStacktraceField:
+			return consumeBytes(num, typ, b, func(v []byte) error {
+				e.Stacktrace = append(e.Stacktrace, string(v))
+				return nil
+			})
+		case errorCauseField:
+			return consumeBytes(num, typ, b, func(v []byte) error {
+				e.Cause = &errorInstance{}
+				return decodeError(v, e.Cause)
+			})
+		}
+		return skipField(num, typ, b)
+	})
+}
+
+func decodeHTTPContext(b []byte, ctx *httpContext) error {
+	return decodeMessage(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case httpContextMethodField:
+			return consumeString(num, typ, b, &ctx.RequestMethod)
+		case httpContextURLField:
+			return consumeString(num, typ, b, &ctx.RequestURL)
+		case httpContextHeadersField:
+			return consumeBytes(num, typ, b, func(v []byte) error {
+				if ctx.RequestHeaders == nil {
+					ctx.RequestHeaders = make(map[string]string)
+				}
+				return decodeMapEntry(v, ctx.RequestHeaders)
+			})
+		case httpContextBodyField:
+			return consumeString(num, typ, b, &ctx.RequestBody)
+		}
+		return skipField(num, typ, b)
+	})
+}
+
+// decodeMapEntry decodes a map<string, string> entry, encoded on the wire as a nested message
+func decodeMapEntry(b []byte, m map[string]string) error {
+	var key, value string
+	err := decodeMessage(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case mapEntryKeyField:
+			return consumeString(num, typ, b, &key)
+		case mapEntryValueField:
+			return consumeString(num, typ, b, &value)
+		}
+		return skipField(num, typ, b)
+	})
+	if err != nil {
+		return err
+	}
+	m[key] = value
+	return nil
+}
@@ -0,0 +1,62 @@
+package scraper
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestDecodePayloadProtobufMatchesJSON(t *testing.T) {
+	jsonContent, _ := ioutil.ReadFile("sample-response1.json")
+	protobufContent, _ := ioutil.ReadFile("sample-response1.pb")
+
+	fromJSON, err := decodePayload("application/json; charset=utf-8", jsonContent)
+	if err != nil {
+		t.Fatalf("Failed to decode JSON payload: %s", err)
+	}
+	fromProtobuf, err := decodePayload("application/x-protobuf", protobufContent)
+	if err != nil {
+		t.Fatalf("Failed to decode protobuf payload: %s", err)
+	}
+
+	if !reflect.DeepEqual(fromJSON, fromProtobuf) {
+		t.Errorf("Protobuf payload differs from JSON, got %+v, expected %+v", fromProtobuf, fromJSON)
+	}
+}
+
+func TestDecodePayloadFallbacksToJSON(t *testing.T) {
+	content, _ := ioutil.ReadFile("sample-response1.json")
+
+	rp, err := decodePayload("", content)
+	if err != nil {
+		t.Fatalf("Failed to decode payload: %s", err)
+	}
+	if len(rp.ErrorAggregate) != 1 {
+		t.Errorf("Expected 1 element, Found %d", len(rp.ErrorAggregate))
+	}
+}
+
+func TestDecodePayloadMalformedProtobuf(t *testing.T) {
+	content, _ := ioutil.ReadFile("sample-response1.pb")
+
+	if _, err := decodePayload("application/x-protobuf", content[:len(content)-10]); err == nil {
+		t.Errorf("Expected an error decoding a truncated payload")
+	}
+}
+
+func TestDecodeMapEntryTruncated(t *testing.T) {
+	entry := protowire.AppendTag(nil, mapEntryKeyField, protowire.BytesType)
+	entry = protowire.AppendString(entry, "key")
+	entry = protowire.AppendTag(entry, mapEntryValueField, protowire.BytesType)
+	entry = protowire.AppendString(entry, "value")
+
+	m := make(map[string]string)
+	if err := decodeMapEntry(entry[:len(entry)-2], m); err == nil {
+		t.Errorf("Expected an error decoding a truncated entry")
+	}
+	if len(m) != 0 {
+		t.Errorf("Expected partially decoded entries to be skipped, Found %v", m)
+	}
+}
@@ -0,0 +1,43 @@
+package scraper
+
+import "sync"
+
+// forgottenErrors holds the keys of the errors pruned from the repository, until the scraper forgets them.
+// It's shared by the copies of the scraper.
+type forgottenErrors struct {
+	mutex sync.Mutex
+	keys  map[string]bool
+}
+
+func newForgottenErrors() *forgottenErrors {
+	return &forgottenErrors{keys: make(map[string]bool)}
+}
+
+// take returns the keys of the errors to forget, emptying them
+func (f *forgottenErrors) take() map[string]bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	keys := f.keys
+	f.keys = make(map[string]bool)
+	return keys
+}
+
+// Forget makes the scraper forget errors pruned from the repository before its next scrape cycle,
+// so it doesn't keep them in memory nor in its state. Errors still reported by the targets are only
+// stored again when they have new occurrences.
+func (scraper Scraper) Forget(keys []string) {
+	scraper.forgotten.mutex.Lock()
+	defer scraper.forgotten.mutex.Unlock()
+	for _, key := range keys {
+		scraper.forgotten.keys[key] = true
+	}
+}
+
+// forget removes errors along with their stored total counts. The counts reported by the targets are kept,
+// so only the new occurrences of the errors are counted.
+func (errorAggregates errorAggregateMap) forget(keys map[string]bool, storedTotalCounts map[string]int) {
+	for key := range keys {
+		delete(errorAggregates, key)
+		delete(storedTotalCounts, key)
+	}
+}
@@ -13,6 +13,9 @@ type errorAggregate struct {
 	Severity       string             `json:"severity"`
 	LatestErrors   []errorWithContext `json:"latest_errors"`
 	CreatedAt      time.Time          `json:"created_at"`
+	// FirstSeen and LastSeen are tracked by Periskop, they aren't reported by targets
+	FirstSeen time.Time `json:"-"`
+	LastSeen  time.Time `json:"-"`
 }
 
 type errorWithContext struct {
@@ -1,24 +1,57 @@
 package scraper
 
 import (
-	"encoding/json"
+	"compress/gzip"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"sync"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/periskop-dev/periskop-go"
+	"github.com/periskop-dev/periskop/config"
 	"github.com/periskop-dev/periskop/metrics"
+	"github.com/periskop-dev/periskop/repository"
+	prometheus_config "github.com/prometheus/common/config"
 )
 
 const httpClientTimeoutSeconds = 30
 
+// acceptEncodingHeader lists the compression algorithms supported when reading responses
+const acceptEncodingHeader = "gzip, zstd"
+
 type Request struct {
-	Target        string
-	ResultChannel chan<- responsePayload
+	Target string
+	// Endpoint is the address and path of the target, as reported by the targets API
+	Endpoint        string
+	MaxResponseSize int64
+	// Client is the HTTP client configured with the TLS and authentication settings of the service
+	Client *http.Client
+	// Headers are extra headers added to the request
+	Headers       map[string]string
+	ResultChannel chan<- scrapeResult
 	WaitGroup     *sync.WaitGroup
 }
 
+// scrapeResult holds the payload scraped from a target along with the health of the scrape
+type scrapeResult struct {
+	Payload responsePayload
+	Target  repository.Target
+}
+
+// scrapeError is a failed scrape, classified by one of the repository.ScrapeResult* values
+type scrapeError struct {
+	result string
+	err    error
+}
+
+func (e scrapeError) Error() string {
+	return e.err.Error()
+}
+
 type Processor struct {
 	numWorkers      int
 	requestsChannel chan Request
@@ -35,16 +68,39 @@ func worker(p Processor) {
 	for {
 		select {
 		case r := <-p.requestsChannel:
-			if errorAggregates, err := p.fetcher(r.Target); err == nil {
-				r.ResultChannel <- errorAggregates
-			} else {
-				r.ResultChannel <- responsePayload{}
-			}
+			start := time.Now()
+			errorAggregates, err := p.fetcher(r)
+			r.ResultChannel <- newScrapeResult(r, errorAggregates, err, start)
 			r.WaitGroup.Done()
 		}
 	}
 }
 
+func newScrapeResult(r Request, rp responsePayload, err error, start time.Time) scrapeResult {
+	target := repository.Target{
+		Endpoint:           r.Endpoint,
+		LastScrape:         start.Unix(),
+		LastScrapeDuration: time.Since(start).Seconds(),
+		LastScrapeResult:   repository.ScrapeResultOK,
+	}
+	if err != nil {
+		target.LastError = err.Error()
+		target.LastScrapeResult = repository.ScrapeResultHTTPError
+		if scrapeErr, ok := err.(scrapeError); ok {
+			target.LastScrapeResult = scrapeErr.result
+		}
+		return scrapeResult{Target: target}
+	}
+
+	target.TargetUUID = rp.Target
+	// Fallback to target if no target_uuid is present for backward compatibility
+	// Can lead to issues with counters as it is not guaranteed to be unique
+	if len(rp.Target) == 0 {
+		rp.Target = r.Target
+	}
+	return scrapeResult{Payload: rp, Target: target}
+}
+
 func (p Processor) Enqueue(r Request) {
 	p.requestsChannel <- r
 }
@@ -57,11 +113,12 @@ func NewProcessor(numWorkers int) Processor {
 	}
 }
 
-type ErrorsFetcher func(string) (responsePayload, error)
+type ErrorsFetcher func(Request) (responsePayload, error)
 
 func defaultErrorsFetcher() ErrorsFetcher {
-	return func(target string) (responsePayload, error) {
-		body, err := fetch(target)
+	return func(r Request) (responsePayload, error) {
+		target := r.Target
+		body, contentType, err := fetch(r)
 		if err != nil {
 			metrics.ErrorCollector.Report(periskop.ErrorReport{
 				Err: err,
@@ -71,36 +128,99 @@ func defaultErrorsFetcher() ErrorsFetcher {
 				},
 				ErrKey: "scrapped-url-error",
 			})
-			return responsePayload{}, err
+			return responsePayload{}, newFetchError(err)
 		}
 
-		var rp responsePayload
-		if err := json.Unmarshal(body, &rp); err != nil {
+		rp, err := decodePayload(contentType, body)
+		if err != nil {
 			metrics.ErrorCollector.ReportWithHTTPContext(err, &periskop.HTTPContext{
 				RequestMethod: "GET",
 				RequestURL:    target,
 			})
-			return responsePayload{}, err
-		}
-
-		// Fallback to target if no target_uuid is present for backward compatibility
-		// Can lead to issues with counters as it is not guaranteed to be unique
-		if len(rp.Target) == 0 {
-			rp.Target = target
+			return responsePayload{}, scrapeError{result: repository.ScrapeResultDecodeError, err: err}
 		}
 		return rp, nil
 	}
 }
 
-func fetch(target string) ([]byte, error) {
-	var netClient = &http.Client{
-		Timeout: time.Second * httpClientTimeoutSeconds,
+// newFetchError classifies an error requesting a target as a timeout or an HTTP error
+func newFetchError(err error) scrapeError {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return scrapeError{result: repository.ScrapeResultTimeout, err: err}
 	}
-	resp, err := netClient.Get(target)
+	return scrapeError{result: repository.ScrapeResultHTTPError, err: err}
+}
+
+// newHTTPClient creates the client used to scrape the targets of a service
+func newHTTPClient(scraperConfig config.Scraper) (*http.Client, error) {
+	client, err := prometheus_config.NewClientFromConfig(scraperConfig.HTTPClientConfig, "periskop", false)
 	if err != nil {
 		return nil, err
 	}
+	client.Timeout = time.Second * httpClientTimeoutSeconds
+	return client, nil
+}
+
+// fetch requests the errors of a target, returning the response body and its content type
+func fetch(r Request) ([]byte, string, error) {
+	req, err := http.NewRequest(http.MethodGet, r.Target, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	for name, value := range r.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Accept", acceptHeader)
+	req.Header.Set("Accept-Encoding", acceptEncodingHeader)
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
 
 	defer resp.Body.Close()
-	return ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, "", fmt.Errorf("server returned HTTP status %s", resp.Status)
+	}
+	body, err := readBody(resp.Body, resp.Header, r.MaxResponseSize)
+	return body, resp.Header.Get("Content-Type"), err
+}
+
+// readBody decompresses a body according to its Content-Encoding header.
+// It fails as soon as the decompressed body is bigger than maxResponseSize bytes.
+func readBody(body io.Reader, header http.Header, maxResponseSize int64) ([]byte, error) {
+	reader := body
+	switch header.Get("Content-Encoding") {
+	case "gzip":
+		gzipReader, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	case "zstd":
+		zstdReader, err := zstd.NewReader(body,
+			zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(maxResponseSize)))
+		if err != nil {
+			return nil, err
+		}
+		defer zstdReader.Close()
+		reader = zstdReader
+	case "", "identity":
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %s", header.Get("Content-Encoding"))
+	}
+
+	// Read one extra byte to detect bodies over the limit
+	content, err := ioutil.ReadAll(io.LimitReader(reader, maxResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) > maxResponseSize {
+		return nil, responseTooLargeError(maxResponseSize)
+	}
+	return content, nil
+}
+
+func responseTooLargeError(maxResponseSize int64) error {
+	return fmt.Errorf("response body exceeds the maximum size of %d bytes", maxResponseSize)
 }
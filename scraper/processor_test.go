@@ -0,0 +1,158 @@
+package scraper
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/periskop-dev/periskop/config"
+	"github.com/periskop-dev/periskop/repository"
+	prometheus_config "github.com/prometheus/common/config"
+)
+
+func newCompressedServer(t *testing.T, encoding string, body []byte) *httptest.Server {
+	var compressed bytes.Buffer
+	switch encoding {
+	case "gzip":
+		w := gzip.NewWriter(&compressed)
+		w.Write(body) // nolint[errcheck]
+		w.Close()
+	case "zstd":
+		w, err := zstd.NewWriter(&compressed)
+		if err != nil {
+			t.Fatalf("Failed to create zstd writer: %s", err)
+		}
+		w.Write(body) // nolint[errcheck]
+		w.Close()
+	default:
+		compressed.Write(body)
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if encoding != "" {
+			w.Header().Set("Content-Encoding", encoding)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(compressed.Bytes()) // nolint[errcheck]
+	}))
+}
+
+func TestFetchDecompressesResponses(t *testing.T) {
+	content, _ := ioutil.ReadFile("sample-response1.json")
+
+	for _, encoding := range []string{"", "gzip", "zstd"} {
+		server := newCompressedServer(t, encoding, content)
+		body, _, err := fetch(Request{Target: server.URL, MaxResponseSize: int64(len(content)), Client: http.DefaultClient})
+		server.Close()
+
+		if err != nil {
+			t.Errorf("Failed to fetch %q encoded response: %s", encoding, err)
+		}
+		if !bytes.Equal(body, content) {
+			t.Errorf("Wrong body for %q encoded response, got %d bytes, expected %d", encoding, len(body), len(content))
+		}
+	}
+}
+
+func TestFetchAbortsResponsesOverMaxSize(t *testing.T) {
+	content, _ := ioutil.ReadFile("sample-response1.json")
+
+	for _, encoding := range []string{"", "gzip", "zstd"} {
+		server := newCompressedServer(t, encoding, content)
+		_, _, err := fetch(Request{Target: server.URL, MaxResponseSize: int64(len(content) - 1), Client: http.DefaultClient})
+		server.Close()
+
+		if err == nil {
+			t.Errorf("Expected an error fetching a %q encoded response over the maximum size", encoding)
+		}
+	}
+}
+
+func TestScrapeInstancesReportsTargetHealth(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/ok":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"aggregated_errors":[],"target_uuid":"uuid"}`)) // nolint[errcheck]
+		case "/invalid":
+			w.Write([]byte("not json")) // nolint[errcheck]
+		default:
+			http.Error(w, "failure", http.StatusInternalServerError)
+		}
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	processor := NewProcessor(1)
+	processor.Run()
+
+	expectedResults := map[string]string{
+		"/ok":      repository.ScrapeResultOK,
+		"/invalid": repository.ScrapeResultDecodeError,
+		"/failure": repository.ScrapeResultHTTPError,
+	}
+	for endpoint, expectedResult := range expectedResults {
+		for result := range scrapeInstances([]string{address}, config.Scraper{Endpoint: endpoint}, http.DefaultClient, processor) {
+			if result.Target.LastScrapeResult != expectedResult {
+				t.Errorf("Expected %s result for %s, Found %s", expectedResult, endpoint, result.Target.LastScrapeResult)
+			}
+			if result.Target.Endpoint != address+endpoint {
+				t.Errorf("Expected %s endpoint, Found %s", address+endpoint, result.Target.Endpoint)
+			}
+			if expectedResult != repository.ScrapeResultOK && result.Target.LastError == "" {
+				t.Errorf("Expected an error message for %s", endpoint)
+			}
+			if expectedResult == repository.ScrapeResultOK && result.Target.TargetUUID != "uuid" {
+				t.Errorf("Expected uuid target_uuid, Found %s", result.Target.TargetUUID)
+			}
+		}
+	}
+}
+
+func TestScrapeInstancesWithTLSAndAuthentication(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer token" || req.Header.Get("X-Scope") != "errors" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"aggregated_errors":[]}`)) // nolint[errcheck]
+	}))
+	defer server.Close()
+
+	caFile, _ := ioutil.TempFile("", "periskop-ca")
+	defer os.Remove(caFile.Name())
+	pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}) // nolint[errcheck]
+	caFile.Close()
+
+	scraperConfig := config.Scraper{
+		Endpoint: "/errors",
+		Scheme:   "https",
+		Headers:  map[string]string{"X-Scope": "errors"},
+		HTTPClientConfig: prometheus_config.HTTPClientConfig{
+			BearerToken: "token",
+			TLSConfig:   prometheus_config.TLSConfig{CAFile: caFile.Name()},
+		},
+	}
+	client, err := newHTTPClient(scraperConfig)
+	if err != nil {
+		t.Fatalf("Failed to create HTTP client: %s", err)
+	}
+
+	processor := NewProcessor(1)
+	processor.Run()
+
+	address := strings.TrimPrefix(server.URL, "https://")
+	for result := range scrapeInstances([]string{address}, scraperConfig, client, processor) {
+		if result.Target.LastScrapeResult != repository.ScrapeResultOK {
+			t.Errorf("Expected ok result, Found %s: %s", result.Target.LastScrapeResult, result.Target.LastError)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package scraper
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/periskop-dev/periskop/api"
+	"github.com/periskop-dev/periskop/repository"
+)
+
+// pushTargetPrefix prefixes the endpoint of pushed instances in the targets API
+const pushTargetPrefix = "push/"
+
+// pushedPayload is the last payload pushed by a short-lived instance
+type pushedPayload struct {
+	instance string
+	payload  responsePayload
+	pushedAt time.Time
+}
+
+// map instance -> last pushed payload
+type pushedPayloadsMap map[string]pushedPayload
+
+// pushedInstances tracks when every instance of a service last pushed, to bound the number of pushing instances.
+// It's shared by the push requests, instances are forgotten once they expire.
+type pushedInstances struct {
+	mutex    sync.Mutex
+	lastPush map[string]time.Time
+}
+
+func newPushedInstances() *pushedInstances {
+	return &pushedInstances{lastPush: make(map[string]time.Time)}
+}
+
+// full returns whether a push of an instance exceeds the maximum number of instances, forgetting the expired ones.
+// It must be called holding the mutex.
+func (p *pushedInstances) full(instance string, now time.Time, expiry time.Duration, maxInstances int) bool {
+	if _, exists := p.lastPush[instance]; exists || len(p.lastPush) < maxInstances {
+		return false
+	}
+	for known, pushedAt := range p.lastPush {
+		if now.Sub(pushedAt) > expiry {
+			delete(p.lastPush, known)
+		}
+	}
+	return len(p.lastPush) >= maxInstances
+}
+
+// Push decodes the errors pushed by an instance of the service. Pushed errors are aggregated
+// along with the scraped ones in every scrape until the instance expires.
+// Pushes never wait for the scraper: they fail with api.ErrPushQueueFull when too many pushes are waiting to
+// be processed, and with api.ErrTooManyPushedInstances when the service has too many pushing instances.
+// Pushes without the configured bearer token fail with api.ErrPushUnauthorized.
+func (scraper Scraper) Push(instance string, header http.Header, body io.Reader) error {
+	if !scraper.ServiceConfig.Push.Enabled {
+		return fmt.Errorf("push is not enabled for service %s", scraper.ServiceConfig.Name)
+	}
+	if !authorized(header, string(scraper.ServiceConfig.Push.BearerToken)) {
+		return api.ErrPushUnauthorized
+	}
+	content, err := readBody(body, header, scraper.ServiceConfig.Scraper.GetMaxResponseSize())
+	if err != nil {
+		return err
+	}
+	rp, err := decodePayload(header.Get("Content-Type"), content)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	pushConfig := scraper.ServiceConfig.Push
+	scraper.pushedInstances.mutex.Lock()
+	defer scraper.pushedInstances.mutex.Unlock()
+	if scraper.pushedInstances.full(instance, now, pushConfig.GetExpiry(), pushConfig.GetMaxInstances()) {
+		return api.ErrTooManyPushedInstances
+	}
+	select {
+	case scraper.pushes <- pushedPayload{instance: instance, payload: rp, pushedAt: now}:
+		scraper.pushedInstances.lastPush[instance] = now
+		return nil
+	default:
+		return api.ErrPushQueueFull
+	}
+}
+
+// authorized returns whether a push sends the bearer token, pushes are always authorized without a token
+func authorized(header http.Header, token string) bool {
+	if token == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(header.Get("Authorization")), []byte("Bearer "+token)) == 1
+}
+
+// add stores the payload pushed by an instance, replacing its previous one
+func (pushedPayloads pushedPayloadsMap) add(pushed pushedPayload, targetErrorsCount targetErrorsCountMap) {
+	// Fallback to the instance name if no target_uuid is present
+	if len(pushed.payload.Target) == 0 {
+		pushed.payload.Target = pushTargetPrefix + pushed.instance
+	}
+	if previous, exists := pushedPayloads[pushed.instance]; exists && previous.payload.Target != pushed.payload.Target {
+		delete(targetErrorsCount, previous.payload.Target)
+	}
+	pushedPayloads[pushed.instance] = pushed
+}
+
+// expire removes the instances that haven't pushed during the expiry time, along with their error counters
+func (pushedPayloads pushedPayloadsMap) expire(expiry time.Duration, now time.Time,
+	targetErrorsCount targetErrorsCountMap) {
+	for instance, pushed := range pushedPayloads {
+		if now.Sub(pushed.pushedAt) > expiry {
+			delete(targetErrorsCount, pushed.payload.Target)
+			delete(pushedPayloads, instance)
+		}
+	}
+}
+
+// results returns the pushed payloads as scrape results, ordered by instance
+func (pushedPayloads pushedPayloadsMap) results() []scrapeResult {
+	results := make([]scrapeResult, 0, len(pushedPayloads))
+	for _, pushed := range pushedPayloads {
+		results = append(results, scrapeResult{
+			Payload: pushed.payload,
+			Target: repository.Target{
+				Endpoint:         pushTargetPrefix + pushed.instance,
+				TargetUUID:       pushed.payload.Target,
+				LastScrape:       pushed.pushedAt.Unix(),
+				LastScrapeResult: repository.ScrapeResultOK,
+			},
+		})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Target.Endpoint < results[j].Target.Endpoint
+	})
+	return results
+}
+
+func isPushTarget(target repository.Target) bool {
+	return strings.HasPrefix(target.Endpoint, pushTargetPrefix)
+}
@@ -0,0 +1,124 @@
+package scraper
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/periskop-dev/periskop/api"
+	"github.com/periskop-dev/periskop/config"
+	"github.com/periskop-dev/periskop/repository"
+	"github.com/periskop-dev/periskop/servicediscovery"
+)
+
+func TestPushDecodesPayload(t *testing.T) {
+	repo := repository.NewMemoryRepository()
+	serviceConfig := config.Service{Name: "test", Push: config.Push{Enabled: true}}
+	s, err := NewScraper(servicediscovery.NewResolver(serviceConfig), &repo, serviceConfig, NewProcessor(1), nil)
+	if err != nil {
+		t.Fatalf("Failed to create scraper: %s", err)
+	}
+
+	content, _ := ioutil.ReadFile("sample-response1.pb")
+	header := http.Header{"Content-Type": []string{"application/x-protobuf"}}
+	if err := s.Push("job-1", header, bytes.NewReader(content)); err != nil {
+		t.Fatalf("Failed to push payload: %s", err)
+	}
+
+	pushed := <-s.pushes
+	if pushed.instance != "job-1" {
+		t.Errorf("Expected job-1 instance, Found %s", pushed.instance)
+	}
+	if len(pushed.payload.ErrorAggregate) != 1 {
+		t.Errorf("Expected 1 element, Found %d", len(pushed.payload.ErrorAggregate))
+	}
+
+	if err := s.Push("job-1", header, bytes.NewReader(content[:10])); err == nil {
+		t.Errorf("Expected an error pushing a malformed payload")
+	}
+}
+
+func TestPushedPayloadsExpire(t *testing.T) {
+	var targetErrorsCount = make(targetErrorsCountMap)
+	var errorAggregates = make(errorAggregateMap)
+	var pushedPayloads = make(pushedPayloadsMap)
+	errorInstancesAccumulator := make(errorInstancesAccumulatorMap)
+	retention := newOccurrencesRetention(config.Scraper{})
+
+	content, _ := ioutil.ReadFile("sample-response1.json")
+	rp, _ := decodePayload("application/json", content)
+	now := time.Now()
+	pushedPayloads.add(pushedPayload{instance: "job-1", payload: rp, pushedAt: now.Add(-2 * time.Hour)},
+		targetErrorsCount)
+	pushedPayloads.add(pushedPayload{instance: "job-2", payload: rp, pushedAt: now}, targetErrorsCount)
+
+	for _, result := range pushedPayloads.results() {
+		errorAggregates.combine("test", result.Payload, targetErrorsCount, errorInstancesAccumulator, retention)
+	}
+	if count := errorAggregates["com.soundcloud.Foon@e28e036e"].TotalCount; count != 4 {
+		t.Errorf("Expected 4 errors, Found %d", count)
+	}
+
+	pushedPayloads.expire(time.Hour, now, targetErrorsCount)
+	results := pushedPayloads.results()
+	if len(results) != 1 || results[0].Target.Endpoint != "push/job-2" {
+		t.Errorf("Expected only push/job-2 target, Found %+v", results)
+	}
+	if _, exists := targetErrorsCount["push/job-1"]; exists {
+		t.Errorf("Error counters of expired instance push/job-1 should be removed")
+	}
+}
+
+func TestPushRequiresBearerToken(t *testing.T) {
+	repo := repository.NewMemoryRepository()
+	serviceConfig := config.Service{Name: "test", Push: config.Push{Enabled: true, BearerToken: "secret"}}
+	s, err := NewScraper(servicediscovery.NewResolver(serviceConfig), &repo, serviceConfig, NewProcessor(1), nil)
+	if err != nil {
+		t.Fatalf("Failed to create scraper: %s", err)
+	}
+	push := func(authorization string) error {
+		header := http.Header{"Content-Type": []string{"application/json"}, "Authorization": []string{authorization}}
+		return s.Push("job-1", header, strings.NewReader(`{"aggregated_errors": []}`))
+	}
+
+	for _, authorization := range []string{"", "Bearer wrong", "Basic c2VjcmV0"} {
+		if err := push(authorization); err != api.ErrPushUnauthorized {
+			t.Errorf("Expected unauthorized error with %q, Found %v", authorization, err)
+		}
+	}
+	if err := push("Bearer secret"); err != nil {
+		t.Errorf("Failed to push payload with the token: %s", err)
+	}
+}
+
+func TestPushRejectsWithoutBlocking(t *testing.T) {
+	repo := repository.NewMemoryRepository()
+	serviceConfig := config.Service{Name: "test", Push: config.Push{Enabled: true, MaxInstances: 2}}
+	s, err := NewScraper(servicediscovery.NewResolver(serviceConfig), &repo, serviceConfig, NewProcessor(1), nil)
+	if err != nil {
+		t.Fatalf("Failed to create scraper: %s", err)
+	}
+	header := http.Header{"Content-Type": []string{"application/json"}}
+	push := func(instance string) error {
+		return s.Push(instance, header, strings.NewReader(`{"aggregated_errors": []}`))
+	}
+
+	for _, instance := range []string{"job-1", "job-2", "job-1"} {
+		if err := push(instance); err != nil {
+			t.Fatalf("Failed to push payload of %s: %s", instance, err)
+		}
+	}
+	if err := push("job-3"); err != api.ErrTooManyPushedInstances {
+		t.Errorf("Expected too many instances error, Found %v", err)
+	}
+
+	for len(s.pushes) < pushesBufferSize {
+		s.pushes <- pushedPayload{}
+	}
+	if err := push("job-1"); err != api.ErrPushQueueFull {
+		t.Errorf("Expected queue full error, Found %v", err)
+	}
+}
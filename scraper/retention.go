@@ -0,0 +1,78 @@
+package scraper
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/periskop-dev/periskop/config"
+)
+
+// occurrencesRetention bounds the latest occurrences accumulated for every error during a scrape cycle
+type occurrencesRetention struct {
+	maxOccurrences int
+	strategy       string
+	// map error key -> number of distinct occurrences seen, used by reservoir sampling
+	seen map[string]int
+	// map error key -> set of UUIDs of the occurrences seen
+	seenUUIDs map[string]map[string]bool
+	random    *rand.Rand
+}
+
+func newOccurrencesRetention(scraperConfig config.Scraper) occurrencesRetention {
+	return occurrencesRetention{
+		maxOccurrences: scraperConfig.GetMaxLatestErrors(),
+		strategy:       scraperConfig.GetLatestErrorsStrategy(),
+		seen:           make(map[string]int),
+		seenUUIDs:      make(map[string]map[string]bool),
+		random:         rand.New(rand.NewSource(time.Now().UnixNano())), // nolint[gosec]
+	}
+}
+
+// retain adds the occurrences reported by a target to the ones previously accumulated for an error,
+// skipping duplicated occurrences and keeping at most maxOccurrences of them.
+func (r occurrencesRetention) retain(key string, accumulated []errorWithContext,
+	occurrences []errorWithContext) []errorWithContext {
+	if r.strategy == config.LatestErrorsStrategyReservoir {
+		return r.reservoirSample(key, accumulated, occurrences)
+	}
+	return r.newest(accumulated, occurrences)
+}
+
+// newest keeps the most recent occurrences
+func (r occurrencesRetention) newest(accumulated []errorWithContext, occurrences []errorWithContext) []errorWithContext {
+	combined := combineLastErrors(accumulated, occurrences)
+	if len(combined) > r.maxOccurrences {
+		combined = combined[:r.maxOccurrences]
+	}
+	return combined
+}
+
+// reservoirSample keeps a uniform sample of all the occurrences reported by the targets,
+// so the occurrences of every target have the same chance to be kept.
+func (r occurrencesRetention) reservoirSample(key string, accumulated []errorWithContext,
+	occurrences []errorWithContext) []errorWithContext {
+	sample := append([]errorWithContext(nil), accumulated...)
+	if _, exists := r.seenUUIDs[key]; !exists {
+		r.seenUUIDs[key] = make(map[string]bool)
+	}
+	for _, occurrence := range occurrences {
+		if isDuplicated(r.seenUUIDs[key], occurrence) {
+			continue
+		}
+		r.seenUUIDs[key][occurrence.UUID] = true
+		r.seen[key]++
+		if len(sample) < r.maxOccurrences {
+			sample = append(sample, occurrence)
+		} else if i := r.random.Intn(r.seen[key]); i < r.maxOccurrences {
+			sample[i] = occurrence
+		}
+	}
+	sort.Sort(errorOccurrences(sample))
+	return sample
+}
+
+// isDuplicated checks if an occurrence was already seen, occurrences without UUID can't be deduplicated
+func isDuplicated(uuids map[string]bool, occurrence errorWithContext) bool {
+	return occurrence.UUID != "" && uuids[occurrence.UUID]
+}
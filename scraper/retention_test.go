@@ -0,0 +1,68 @@
+package scraper
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/periskop-dev/periskop/config"
+)
+
+func newOccurrences(prefix string, n int) []errorWithContext {
+	occurrences := make([]errorWithContext, 0, n)
+	for i := 0; i < n; i++ {
+		occurrences = append(occurrences, errorWithContext{
+			UUID:      fmt.Sprintf("%s-%d", prefix, i),
+			Timestamp: time.Unix(int64(i), 0),
+		})
+	}
+	return occurrences
+}
+
+func TestRetainNewestOccurrences(t *testing.T) {
+	retention := newOccurrencesRetention(config.Scraper{MaxLatestErrors: 3})
+	first := newOccurrences("first", 2)
+	second := newOccurrences("second", 5)
+
+	result := retention.retain("key", first, second)
+	result = retention.retain("key", result, second)
+
+	expectedUUIDs := []string{"second-4", "second-3", "second-2"}
+	if len(result) != len(expectedUUIDs) {
+		t.Fatalf("Expected %d elements, Found %d", len(expectedUUIDs), len(result))
+	}
+	for i, element := range result {
+		if element.UUID != expectedUUIDs[i] {
+			t.Errorf("Expected %s, Found %s", expectedUUIDs[i], element.UUID)
+		}
+	}
+}
+
+func TestRetainReservoirSampleOfOccurrences(t *testing.T) {
+	retention := newOccurrencesRetention(config.Scraper{
+		MaxLatestErrors:      10,
+		LatestErrorsStrategy: config.LatestErrorsStrategyReservoir,
+	})
+
+	var result []errorWithContext
+	for target := 0; target < 5; target++ {
+		occurrences := newOccurrences(fmt.Sprintf("target%d", target), 20)
+		result = retention.retain("key", result, occurrences)
+		// duplicated occurrences are skipped
+		result = retention.retain("key", result, occurrences[:5])
+	}
+
+	if len(result) != 10 {
+		t.Errorf("Expected 10 elements, Found %d", len(result))
+	}
+	if retention.seen["key"] != 100 {
+		t.Errorf("Expected 100 seen occurrences, Found %d", retention.seen["key"])
+	}
+	uuids := make(map[string]bool)
+	for _, occurrence := range result {
+		uuids[occurrence.UUID] = true
+	}
+	if len(uuids) != len(result) {
+		t.Errorf("Found duplicated occurrences in %+v", result)
+	}
+}
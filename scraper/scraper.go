@@ -1,17 +1,23 @@
 package scraper
 
 import (
+	"context"
 	"log"
+	"net/http"
 	"sort"
 	"sync"
 	"time"
 
 	"github.com/periskop-dev/periskop/config"
+	"github.com/periskop-dev/periskop/events"
 	"github.com/periskop-dev/periskop/metrics"
 	"github.com/periskop-dev/periskop/repository"
 	"github.com/periskop-dev/periskop/servicediscovery"
 )
 
+// pushesBufferSize is the number of pushed payloads that can be queued while the service is being scraped
+const pushesBufferSize = 64
+
 // map error key -> errorAggregate
 type errorAggregateMap map[string]errorAggregate
 
@@ -25,114 +31,240 @@ type Scraper struct {
 	Resolver      servicediscovery.Resolver
 	Repository    *repository.ErrorsRepository
 	ServiceConfig config.Service
-	processor     Processor
+	// Events receives the changes of the errors of the service once they are stored
+	Events    *events.Broker
+	processor Processor
+	client    *http.Client
+	pushes    chan pushedPayload
+	// pushedInstances is shared by the copies of the scraper handling pushes
+	pushedInstances *pushedInstances
+	// forgotten holds the errors pruned from the repository until the next scrape cycle
+	forgotten *forgottenErrors
 }
 
-// NewScraper create a new scraper for a given service name
+// NewScraper create a new scraper for a given service name, publishing the changes of its errors to a broker
 func NewScraper(resolver servicediscovery.Resolver, r *repository.ErrorsRepository,
-	serviceConfig config.Service, processor Processor) Scraper {
-	return Scraper{
-		Resolver:      resolver,
-		Repository:    r,
-		ServiceConfig: serviceConfig,
-		processor:     processor,
+	serviceConfig config.Service, processor Processor, broker *events.Broker) (Scraper, error) {
+	client, err := newHTTPClient(serviceConfig.Scraper)
+	if err != nil {
+		return Scraper{}, err
 	}
+	return Scraper{
+		Resolver:        resolver,
+		Repository:      r,
+		ServiceConfig:   serviceConfig,
+		Events:          broker,
+		processor:       processor,
+		client:          client,
+		pushes:          make(chan pushedPayload, pushesBufferSize),
+		pushedInstances: newPushedInstances(),
+		forgotten:       newForgottenErrors(),
+	}, nil
 }
 
-func (errorAggregates errorAggregateMap) combine(serviceName string, r *repository.ErrorsRepository,
-	rp responsePayload, targetErrorsCount targetErrorsCountMap, errorInstancesAccumulator errorInstancesAccumulatorMap) {
+func (errorAggregates errorAggregateMap) combine(serviceName string, rp responsePayload,
+	targetErrorsCount targetErrorsCountMap, errorInstancesAccumulator errorInstancesAccumulatorMap,
+	retention occurrencesRetention) {
+	now := time.Now()
 	for _, item := range rp.ErrorAggregate {
 		if _, exists := targetErrorsCount[rp.Target]; !exists {
 			targetErrorsCount[rp.Target] = make(map[string]int)
 		}
 		prevErrorInstances := errorInstancesAccumulator[item.AggregationKey]
 		var errorCountDelta int
-		lastestErrors := combineLastErrors(prevErrorInstances, item.LatestErrors)
+		lastestErrors := retention.retain(item.AggregationKey, prevErrorInstances, item.LatestErrors)
 
 		if existing, exists := errorAggregates[item.AggregationKey]; exists {
 			prevCount := targetErrorsCount[rp.Target][item.AggregationKey]
-			if prevCount <= item.TotalCount {
-				// Set the CreatedAt of its oldest occurrence
-				createdAt := existing.CreatedAt
-				if item.CreatedAt.Before(createdAt) {
-					createdAt = item.CreatedAt
-				}
+			errorCountDelta = item.TotalCount - prevCount
+			if item.TotalCount < prevCount {
+				// The counter of the target was reset (e.g. after a restart reusing the same target),
+				// so every error it reports is new
+				log.Printf("%s: counter reset detected for '%s' in target '%s': prev %d, current %d",
+					serviceName, item.AggregationKey, rp.Target, prevCount, item.TotalCount)
+				metrics.CounterResets.WithLabelValues(serviceName).Inc()
+				errorCountDelta = item.TotalCount
+			}
 
-				errorCountDelta = item.TotalCount - prevCount
-				errorAggregates[item.AggregationKey] = errorAggregate{
-					TotalCount:     existing.TotalCount + errorCountDelta,
-					AggregationKey: existing.AggregationKey,
-					Severity:       item.Severity,
-					LatestErrors:   lastestErrors,
-					CreatedAt:      createdAt,
-				}
-				updateValues(item, errorCountDelta, lastestErrors,
-					serviceName, r, rp,
-					targetErrorsCount, errorInstancesAccumulator)
-			} else {
-				log.Printf("warning: count of errors for '%s' target is inconsistent: prev %d, current %d.",
-					rp.Target,
-					prevCount,
-					item.TotalCount,
-				)
-				log.Printf(" Counters won't be updated\n")
+			// Set the CreatedAt of its oldest occurrence
+			createdAt := existing.CreatedAt
+			if item.CreatedAt.Before(createdAt) {
+				createdAt = item.CreatedAt
 			}
+
+			firstSeen, lastSeen := seenTimes(item, errorCountDelta, existing.FirstSeen, existing.LastSeen, now)
+
+			errorAggregates[item.AggregationKey] = errorAggregate{
+				TotalCount:     existing.TotalCount + errorCountDelta,
+				AggregationKey: existing.AggregationKey,
+				Severity:       item.Severity,
+				LatestErrors:   lastestErrors,
+				CreatedAt:      createdAt,
+				FirstSeen:      firstSeen,
+				LastSeen:       lastSeen,
+			}
+			updateValues(item, errorCountDelta, lastestErrors,
+				serviceName, rp,
+				targetErrorsCount, errorInstancesAccumulator)
 		} else {
-			errorAggregates[item.AggregationKey] = item
-			updateValues(item, item.TotalCount, lastestErrors,
-				serviceName, r, rp,
+			errorCountDelta = item.TotalCount
+			// The target reported the error before it was pruned, only its new occurrences bring it back
+			if prevCount, reported := targetErrorsCount[rp.Target][item.AggregationKey]; reported &&
+				item.TotalCount >= prevCount {
+				errorCountDelta = item.TotalCount - prevCount
+			}
+			if errorCountDelta > 0 {
+				aggregate := item
+				aggregate.TotalCount = errorCountDelta
+				aggregate.FirstSeen, aggregate.LastSeen = seenTimes(item, errorCountDelta, time.Time{}, time.Time{},
+					now)
+				errorAggregates[item.AggregationKey] = aggregate
+			}
+			updateValues(item, errorCountDelta, lastestErrors,
+				serviceName, rp,
 				targetErrorsCount, errorInstancesAccumulator)
 		}
 	}
 }
 
+// totalCounts returns the total count of every error
+func (errorAggregates errorAggregateMap) totalCounts() map[string]int {
+	totalCounts := make(map[string]int, len(errorAggregates))
+	for key, item := range errorAggregates {
+		totalCounts[key] = item.TotalCount
+	}
+	return totalCounts
+}
+
+// newOccurrences returns the number of occurrences of every error since the given total counts,
+// which is the sum of the count deltas of all the targets. Errors without new occurrences are skipped.
+func (errorAggregates errorAggregateMap) newOccurrences(previousTotalCounts map[string]int) map[string]int {
+	occurrences := make(map[string]int)
+	for key, item := range errorAggregates {
+		if delta := item.TotalCount - previousTotalCounts[key]; delta > 0 {
+			occurrences[key] = delta
+		}
+	}
+	return occurrences
+}
+
 func updateValues(item errorAggregate, errorCountDelta int, latestErrors []errorWithContext,
-	serviceName string, r *repository.ErrorsRepository, rp responsePayload,
+	serviceName string, rp responsePayload,
 	targetErrorsCount targetErrorsCountMap, errorInstancesAccumulator errorInstancesAccumulatorMap) {
 	metrics.ErrorOccurrences.WithLabelValues(serviceName, item.Severity, rp.Target,
 		item.AggregationKey).Add(float64(errorCountDelta))
 	targetErrorsCount[rp.Target][item.AggregationKey] = item.TotalCount
 	errorInstancesAccumulator[item.AggregationKey] = latestErrors
-	// If an error that was previously mark as resolved is scrapped again
-	// it's going to be added to list of errors
-	if (*r).SearchResolved(serviceName, item.AggregationKey) {
-		(*r).RemoveResolved(serviceName, item.AggregationKey)
+}
+
+// seenTimes returns when an error was first and last seen, given the previous ones and the error reported by a target.
+// Errors are seen when they happen, or when they are scraped if the target doesn't report their occurrences.
+func seenTimes(item errorAggregate, errorCountDelta int, firstSeen time.Time, lastSeen time.Time,
+	now time.Time) (time.Time, time.Time) {
+	oldest, newest := item.CreatedAt, time.Time{}
+	for _, occurrence := range item.LatestErrors {
+		if oldest.IsZero() || occurrence.Timestamp.Before(oldest) {
+			oldest = occurrence.Timestamp
+		}
+		if occurrence.Timestamp.After(newest) {
+			newest = occurrence.Timestamp
+		}
+	}
+	if oldest.IsZero() {
+		oldest = now
+	}
+	if firstSeen.IsZero() || oldest.Before(firstSeen) {
+		firstSeen = oldest
+	}
+
+	if errorCountDelta > 0 {
+		if newest.IsZero() {
+			newest = now
+		}
+		if newest.After(lastSeen) {
+			lastSeen = newest
+		}
+	}
+	if lastSeen.IsZero() {
+		lastSeen = firstSeen
 	}
+	return firstSeen, lastSeen
 }
 
+// combineLastErrors combines two lists of occurrences, sorted by timestamp and without duplicated occurrences
 func combineLastErrors(first []errorWithContext, second []errorWithContext) []errorWithContext {
-	combined := append(first, second...)
+	combined := make([]errorWithContext, 0, len(first)+len(second))
+	uuids := make(map[string]bool, len(first)+len(second))
+	for _, occurrences := range [][]errorWithContext{first, second} {
+		for _, occurrence := range occurrences {
+			if !isDuplicated(uuids, occurrence) {
+				combined = append(combined, occurrence)
+				uuids[occurrence.UUID] = true
+			}
+		}
+	}
 	sort.Sort(errorOccurrences(combined))
 	return combined
 }
 
 // Scrape runs go routines scrapping the list of targets of this service,
-// processes the errors and stores them into the repository.
-func (scraper Scraper) Scrape() {
+// processes the errors and stores them into the repository, until the context is cancelled.
+// Scrape cycles whose results can't be stored are counted as failures, and their errors are stored
+// again in the next cycle.
+func (scraper Scraper) Scrape(ctx context.Context) {
 	serviceConfig := scraper.ServiceConfig
 	resolutions := scraper.Resolver.Resolve()
 	var resolvedAddresses = servicediscovery.EmptyResolvedAddresses()
 	timer := time.NewTimer(scraper.ServiceConfig.Scraper.RefreshInterval)
 
-	var targetErrorsCount = make(targetErrorsCountMap)
-	var errorAggregates = make(errorAggregateMap)
+	targetErrorsCount, errorAggregates := restoreState(ctx, serviceConfig.Name, scraper.Repository)
+	// total counts of the errors when they were last stored, only the errors that changed since then are stored
+	storedTotalCounts := errorAggregates.totalCounts()
+	var pushedPayloads = make(pushedPayloadsMap)
 	for {
 		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+
 		case newResult := <-resolutions:
 			resolvedAddresses = newResult
-			storeTargets(serviceConfig.Name, serviceConfig.Scraper.Endpoint, scraper.Repository, resolvedAddresses)
+			err := storeTargets(ctx, serviceConfig.Name, serviceConfig.Scraper.Endpoint, scraper.Repository,
+				resolvedAddresses)
+			if err != nil {
+				log.Printf("%s: failed to store targets: %s", serviceConfig.Name, err)
+			}
 			log.Printf("Received new dns resolution result for %s. Address resolved: %d\n", serviceConfig.Name,
 				len(resolvedAddresses.Addresses))
 
+		case pushed := <-scraper.pushes:
+			pushedPayloads.add(pushed, targetErrorsCount)
+
 		case <-timer.C:
 			timer.Stop()
+			errorAggregates.forget(scraper.forgotten.take(), storedTotalCounts)
 			errorInstancesAccumulator := make(errorInstancesAccumulatorMap)
-			for responsePayload := range scrapeInstances(resolvedAddresses.Addresses, serviceConfig.Scraper.Endpoint,
-				scraper.processor) {
-				errorAggregates.combine(serviceConfig.Name, scraper.Repository,
-					responsePayload, targetErrorsCount, errorInstancesAccumulator)
+			retention := newOccurrencesRetention(serviceConfig.Scraper)
+			targets := make([]repository.Target, 0, len(resolvedAddresses.Addresses))
+			for result := range scrapeInstances(resolvedAddresses.Addresses, serviceConfig.Scraper,
+				scraper.client, scraper.processor) {
+				errorAggregates.combine(serviceConfig.Name, result.Payload, targetErrorsCount,
+					errorInstancesAccumulator, retention)
+				targets = append(targets, result.Target)
+			}
+			pushedPayloads.expire(serviceConfig.Push.GetExpiry(), time.Now(), targetErrorsCount)
+			for _, result := range pushedPayloads.results() {
+				errorAggregates.combine(serviceConfig.Name, result.Payload, targetErrorsCount,
+					errorInstancesAccumulator, retention)
+				targets = append(targets, result.Target)
+			}
+			err := scraper.store(ctx, storedTotalCounts, targetErrorsCount, errorAggregates, targets)
+			if err != nil {
+				metrics.ScrapeCycleFailures.WithLabelValues(serviceConfig.Name).Inc()
+				log.Printf("%s: failed to store scrape results: %s", serviceConfig.Name, err)
+			} else {
+				storedTotalCounts = errorAggregates.totalCounts()
 			}
-			storeErrors(serviceConfig.Name, scraper.Repository, errorAggregates)
 
 			numInstances := len(resolvedAddresses.Addresses)
 			numErrors := len(errorAggregates)
@@ -144,16 +276,46 @@ func (scraper Scraper) Scrape() {
 	}
 }
 
-func scrapeInstances(addresses []string, endpoint string, processor Processor) <-chan responsePayload {
+// store stores the results of a scrape cycle: errors and occurrences since the given stored total counts,
+// scraper state and targets. The changes of the errors are published once everything is stored, failed cycles
+// are stored again in the next one. Occurrences are recorded last, since they are added rather than replaced and
+// would be counted twice if a failure after recording them stored the cycle again.
+func (scraper Scraper) store(ctx context.Context, storedTotalCounts map[string]int,
+	targetErrorsCount targetErrorsCountMap, errorAggregates errorAggregateMap, targets []repository.Target) error {
+	serviceName := scraper.ServiceConfig.Name
+	changes, err := storeErrors(ctx, serviceName, scraper.Repository, errorAggregates, storedTotalCounts)
+	if err != nil {
+		return err
+	}
+	if err := storeState(ctx, serviceName, scraper.Repository, targetErrorsCount, errorAggregates); err != nil {
+		return err
+	}
+	if err := (*scraper.Repository).StoreTargets(ctx, serviceName, sortTargets(targets)); err != nil {
+		return err
+	}
+	occurrences := errorAggregates.newOccurrences(storedTotalCounts)
+	if err := (*scraper.Repository).AddOccurrences(ctx, serviceName, occurrences, time.Now()); err != nil {
+		return err
+	}
+	scraper.Events.Publish(changes...)
+	return nil
+}
+
+func scrapeInstances(addresses []string, scraperConfig config.Scraper, client *http.Client,
+	processor Processor) <-chan scrapeResult {
 	var wg sync.WaitGroup
-	out := make(chan responsePayload, len(addresses))
+	out := make(chan scrapeResult, len(addresses))
 
 	wg.Add(len(addresses))
 	for _, address := range addresses {
 		request := Request{
-			Target:        "http://" + address + endpoint,
-			ResultChannel: out,
-			WaitGroup:     &wg,
+			Target:          scraperConfig.GetScheme() + "://" + address + scraperConfig.Endpoint,
+			Endpoint:        address + scraperConfig.Endpoint,
+			MaxResponseSize: scraperConfig.GetMaxResponseSize(),
+			Client:          client,
+			Headers:         scraperConfig.Headers,
+			ResultChannel:   out,
+			WaitGroup:       &wg,
 		}
 
 		go processor.Enqueue(request)
@@ -167,32 +329,127 @@ func scrapeInstances(addresses []string, endpoint string, processor Processor) <
 	return out
 }
 
-func storeErrors(serviceName string, r *repository.ErrorsRepository, errorAggregates errorAggregateMap) {
+// storeErrors stores the errors that are new or have new occurrences since the given stored total counts,
+// returning their changes. Unchanged errors aren't stored again, so the errors pruned from the repository
+// don't come back until they happen again.
+func storeErrors(ctx context.Context, serviceName string, r *repository.ErrorsRepository,
+	errorAggregates errorAggregateMap, storedTotalCounts map[string]int) ([]events.Event, error) {
 	errors := make([]repository.ErrorAggregate, 0, len(errorAggregates))
+	changedErrors := make([]repository.ErrorAggregate, 0, len(errorAggregates))
+	changes := []events.Event{}
 	for _, value := range errorAggregates {
-		if !(*r).SearchResolved(serviceName, value.AggregationKey) {
-			severity := severityWithFallback(value.Severity)
-			errors = append(errors, repository.ErrorAggregate{
-				AggregationKey: value.AggregationKey,
-				Severity:       severity,
-				TotalCount:     value.TotalCount,
-				LatestErrors:   toRepositoryErrorsWithContent(value.LatestErrors),
-				CreatedAt:      value.CreatedAt.Unix(),
-			})
+		severity := severityWithFallback(value.Severity)
+		errors = append(errors, repository.ErrorAggregate{
+			AggregationKey: value.AggregationKey,
+			Severity:       severity,
+			TotalCount:     value.TotalCount,
+			LatestErrors:   toRepositoryErrorsWithContent(value.LatestErrors),
+			CreatedAt:      value.CreatedAt.Unix(),
+			FirstSeen:      value.FirstSeen.Unix(),
+			LastSeen:       value.LastSeen.Unix(),
+		})
+		if storedCount, stored := storedTotalCounts[value.AggregationKey]; !stored || value.TotalCount > storedCount {
+			changedErrors = append(changedErrors, errors[len(errors)-1])
+			changes = append(changes, newChangeEvent(serviceName, errors[len(errors)-1], storedCount, stored))
 		}
 	}
-	(*r).ReplaceErrors(serviceName, errors)
+	if err := (*r).ReplaceErrors(ctx, serviceName, changedErrors); err != nil {
+		return nil, err
+	}
+	reopened, err := reopenErrors(ctx, serviceName, r, errors, time.Now())
+	return append(changes, reopened...), err
 }
 
-func storeTargets(serviceName string, path string,
-	r *repository.ErrorsRepository, addr servicediscovery.ResolvedAddresses) {
+// newChangeEvent returns the event of an error that is new or has new occurrences since it was stored
+func newChangeEvent(serviceName string, errorAggregate repository.ErrorAggregate, storedCount int,
+	stored bool) events.Event {
+	event := events.Event{
+		Type:           events.EventNewError,
+		Service:        serviceName,
+		AggregationKey: errorAggregate.AggregationKey,
+		Severity:       errorAggregate.Severity,
+		TotalCount:     errorAggregate.TotalCount,
+	}
+	if stored {
+		event.Type = events.EventCountChanged
+		event.PreviousCount = storedCount
+	}
+	if len(errorAggregate.LatestErrors) > 0 {
+		occurrence := errorAggregate.LatestErrors[0]
+		event.LatestError = &occurrence
+	}
+	return event
+}
+
+// reopenErrors reopens the resolved errors that have new occurrences and the snoozed errors
+// whose snooze is over, returning their changes of status. Ignored errors never resurface.
+func reopenErrors(ctx context.Context, serviceName string, r *repository.ErrorsRepository,
+	errors []repository.ErrorAggregate, now time.Time) ([]events.Event, error) {
+	changes := []events.Event{}
+	statuses, err := (*r).GetErrorStatuses(ctx, serviceName)
+	if err != nil {
+		return changes, err
+	}
+	for _, errorAggregate := range errors {
+		status, exists := statuses[errorAggregate.AggregationKey]
+		if !exists {
+			continue
+		}
+		if change, reopen := status.Reopen(errorAggregate, now); reopen {
+			log.Printf("%s: error %s changed from %s to %s", serviceName, errorAggregate.AggregationKey,
+				status.Status, change.Status)
+			if change.Status == repository.StatusRegressed {
+				metrics.ErrorRegressions.WithLabelValues(serviceName, errorAggregate.AggregationKey).Inc()
+			}
+			if err := (*r).SetErrorStatus(ctx, serviceName, errorAggregate.AggregationKey, change); err != nil {
+				return changes, err
+			}
+			event := events.NewStatusEvent(serviceName, errorAggregate.AggregationKey, change)
+			event.Severity = errorAggregate.Severity
+			event.TotalCount = errorAggregate.TotalCount
+			changes = append(changes, event)
+		}
+	}
+	return changes, nil
+}
+
+// storeTargets stores the resolved targets of a service, keeping the scrape status of already known targets
+func storeTargets(ctx context.Context, serviceName string, path string,
+	r *repository.ErrorsRepository, addr servicediscovery.ResolvedAddresses) error {
+	storedTargets, err := (*r).GetTargets(ctx)
+	if err != nil {
+		return err
+	}
+	knownTargets := make(map[string]repository.Target)
+	for _, target := range storedTargets[serviceName] {
+		knownTargets[target.Endpoint] = target
+	}
+
 	targets := make([]repository.Target, 0, len(addr.Addresses))
+	for _, target := range knownTargets {
+		if isPushTarget(target) {
+			targets = append(targets, target)
+		}
+	}
 	for _, host := range addr.Addresses {
-		targets = append(targets, repository.Target{
-			Endpoint: host + path,
-		})
+		endpoint := host + path
+		if target, exists := knownTargets[endpoint]; exists {
+			targets = append(targets, target)
+		} else {
+			targets = append(targets, repository.Target{
+				Endpoint: endpoint,
+			})
+		}
 	}
-	(*r).StoreTargets(serviceName, targets)
+	return (*r).StoreTargets(ctx, serviceName, sortTargets(targets))
+}
+
+// sortTargets sorts targets by endpoint to keep a stable order in the targets API
+func sortTargets(targets []repository.Target) []repository.Target {
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].Endpoint < targets[j].Endpoint
+	})
+	return targets
 }
 
 func toRepositoryErrorsWithContent(occurrences []errorWithContext) []repository.ErrorWithContext {
@@ -1,10 +1,16 @@
 package scraper
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"reflect"
 	"testing"
+	"time"
 
+	"github.com/periskop-dev/periskop/config"
+	"github.com/periskop-dev/periskop/events"
 	"github.com/periskop-dev/periskop/repository"
 )
 
@@ -36,14 +42,14 @@ func TestScrapeCombine(t *testing.T) {
 	var targetErrorsCount = make(targetErrorsCountMap)
 	var errorAggregates = make(errorAggregateMap)
 	errorInstancesAccumulator := make(errorInstancesAccumulatorMap)
-	repo := repository.NewMemoryRepository()
+	retention := newOccurrencesRetention(config.Scraper{})
 
 	firstContent, _ := ioutil.ReadFile("sample-response1.json")
 	var rp responsePayload
 	json.Unmarshal(firstContent, &rp) // nolint[errcheck]
 	rp.Target = "test"
 
-	errorAggregates.combine("test", &repo, rp, targetErrorsCount, errorInstancesAccumulator)
+	errorAggregates.combine("test", rp, targetErrorsCount, errorInstancesAccumulator, retention)
 
 	count := targetErrorsCount["test"]["com.soundcloud.Foon@e28e036e"]
 	if count != 2 {
@@ -56,43 +62,54 @@ func TestScrapeCombine(t *testing.T) {
 	}
 
 	rp.ErrorAggregate[0].TotalCount = 4
-	errorAggregates.combine("test", &repo, rp, targetErrorsCount, errorInstancesAccumulator)
+	errorAggregates.combine("test", rp, targetErrorsCount, errorInstancesAccumulator, retention)
 
 	count = targetErrorsCount["test"]["com.soundcloud.Foon@e28e036e"]
 	if count != 4 {
 		t.Errorf("Expected 4 element, Found %d", count)
 	}
 
+	// occurrences already accumulated are not duplicated
 	countErrorInstances = len(errorInstancesAccumulator["com.soundcloud.Foon@e28e036e"])
-	if countErrorInstances != 4 {
+	if countErrorInstances != 2 {
 		t.Errorf("Expected 2 element, Found %d", countErrorInstances)
 	}
 }
 
-func TestScapeCombineNotUpdate(t *testing.T) {
+func TestScrapeCombineCounterReset(t *testing.T) {
 	var targetErrorsCount = make(targetErrorsCountMap)
 	var errorAggregates = make(errorAggregateMap)
 	errorInstancesAccumulator := make(errorInstancesAccumulatorMap)
-	repo := repository.NewMemoryRepository()
+	retention := newOccurrencesRetention(config.Scraper{})
 
 	firstContent, _ := ioutil.ReadFile("sample-response1.json")
 	var rp responsePayload
 	json.Unmarshal(firstContent, &rp) // nolint[errcheck]
 	rp.Target = "test"
 
-	errorAggregates.combine("test", &repo, rp, targetErrorsCount, errorInstancesAccumulator)
+	errorAggregates.combine("test", rp, targetErrorsCount, errorInstancesAccumulator, retention)
 
+	// the target restarted and reported a single error since then
 	rp.ErrorAggregate[0].TotalCount = 1
-	errorAggregates.combine("test", &repo, rp, targetErrorsCount, errorInstancesAccumulator)
+	errorAggregates.combine("test", rp, targetErrorsCount, errorInstancesAccumulator, retention)
 
 	count := targetErrorsCount["test"]["com.soundcloud.Foon@e28e036e"]
-	if count != 2 {
-		t.Errorf("Expected 2 element, Found %d", count)
+	if count != 1 {
+		t.Errorf("Expected 1 element, Found %d", count)
 	}
 
-	countErrorInstances := len(errorInstancesAccumulator["com.soundcloud.Foon@e28e036e"])
-	if countErrorInstances != 2 {
-		t.Errorf("Expected 2 element, Found %d", countErrorInstances)
+	totalCount := errorAggregates["com.soundcloud.Foon@e28e036e"].TotalCount
+	if totalCount != 3 {
+		t.Errorf("Expected 3 errors, Found %d", totalCount)
+	}
+
+	// the counter keeps increasing from the reset value
+	rp.ErrorAggregate[0].TotalCount = 5
+	errorAggregates.combine("test", rp, targetErrorsCount, errorInstancesAccumulator, retention)
+
+	totalCount = errorAggregates["com.soundcloud.Foon@e28e036e"].TotalCount
+	if totalCount != 7 {
+		t.Errorf("Expected 7 errors, Found %d", totalCount)
 	}
 }
 
@@ -100,18 +117,18 @@ func TestScapeCombineCreatedAt(t *testing.T) {
 	var targetErrorsCount = make(targetErrorsCountMap)
 	var errorAggregates = make(errorAggregateMap)
 	errorInstancesAccumulator := make(errorInstancesAccumulatorMap)
-	repo := repository.NewMemoryRepository()
+	retention := newOccurrencesRetention(config.Scraper{})
 
 	firstContent, _ := ioutil.ReadFile("sample-response1.json")
 	var rp responsePayload
 	json.Unmarshal(firstContent, &rp) // nolint[errcheck]
 	rp.Target = "test1"
-	errorAggregates.combine("test1", &repo, rp, targetErrorsCount, errorInstancesAccumulator)
+	errorAggregates.combine("test1", rp, targetErrorsCount, errorInstancesAccumulator, retention)
 
 	secondContent, _ := ioutil.ReadFile("sample-response2.json")
 	json.Unmarshal(secondContent, &rp) // nolint[errcheck]
 	rp.Target = "test2"
-	errorAggregates.combine("test2", &repo, rp, targetErrorsCount, errorInstancesAccumulator)
+	errorAggregates.combine("test2", rp, targetErrorsCount, errorInstancesAccumulator, retention)
 
 	createdAtHour := errorAggregates["com.soundcloud.Foon@e28e036e"].CreatedAt.Hour()
 
@@ -119,3 +136,352 @@ func TestScapeCombineCreatedAt(t *testing.T) {
 		t.Errorf("Expected 15h, Found %d", createdAtHour)
 	}
 }
+
+func TestScrapeRestoreState(t *testing.T) {
+	ctx := context.Background()
+	var targetErrorsCount = make(targetErrorsCountMap)
+	var errorAggregates = make(errorAggregateMap)
+	repo := repository.NewMemoryRepository()
+
+	firstContent, _ := ioutil.ReadFile("sample-response1.json")
+	var rp responsePayload
+	json.Unmarshal(firstContent, &rp) // nolint[errcheck]
+	rp.Target = "test"
+
+	errorAggregates.combine("test", rp, targetErrorsCount, make(errorInstancesAccumulatorMap),
+		newOccurrencesRetention(config.Scraper{}))
+	storeState(ctx, "test", &repo, targetErrorsCount, errorAggregates)
+
+	// a restarted scraper shouldn't count again the errors already reported by the target
+	targetErrorsCount, errorAggregates = restoreState(ctx, "test", &repo)
+	errorAggregates.combine("test", rp, targetErrorsCount, make(errorInstancesAccumulatorMap),
+		newOccurrencesRetention(config.Scraper{}))
+
+	totalCount := errorAggregates["com.soundcloud.Foon@e28e036e"].TotalCount
+	if totalCount != 2 {
+		t.Errorf("Expected 2 errors, Found %d", totalCount)
+	}
+	createdAtHour := errorAggregates["com.soundcloud.Foon@e28e036e"].CreatedAt.UTC().Hour()
+	if createdAtHour != 16 {
+		t.Errorf("Expected 16h, Found %d", createdAtHour)
+	}
+
+	// only counters and metadata are persisted, occurrences are already stored with the errors
+	state, _ := repo.GetScraperState(ctx, "test")
+	for _, item := range state.ErrorAggregates {
+		if len(item.LatestErrors) != 0 {
+			t.Errorf("Expected no occurrences in the scraper state, Found %d", len(item.LatestErrors))
+		}
+	}
+}
+
+func TestScrapeRestoreStateKeepsSeenTimes(t *testing.T) {
+	ctx := context.Background()
+	var targetErrorsCount = make(targetErrorsCountMap)
+	var errorAggregates = make(errorAggregateMap)
+	repo := repository.NewMemoryRepository()
+
+	content, _ := ioutil.ReadFile("sample-response1.json")
+	var rp responsePayload
+	json.Unmarshal(content, &rp) // nolint[errcheck]
+	rp.Target = "test"
+
+	errorAggregates.combine("test", rp, targetErrorsCount, make(errorInstancesAccumulatorMap),
+		newOccurrencesRetention(config.Scraper{}))
+	item := errorAggregates["com.soundcloud.Foon@e28e036e"]
+	firstSeen := time.Unix(item.CreatedAt.Unix(), 0).Add(-24 * time.Hour)
+	lastSeen := time.Unix(item.LastSeen.Unix(), 0)
+	item.FirstSeen = firstSeen
+	errorAggregates["com.soundcloud.Foon@e28e036e"] = item
+	storeState(ctx, "test", &repo, targetErrorsCount, errorAggregates) // nolint[errcheck]
+
+	// the seen times survive a restart of the scraper
+	targetErrorsCount, errorAggregates = restoreState(ctx, "test", &repo)
+	errorAggregates.combine("test", rp, targetErrorsCount, make(errorInstancesAccumulatorMap),
+		newOccurrencesRetention(config.Scraper{}))
+
+	restored := errorAggregates["com.soundcloud.Foon@e28e036e"]
+	if !restored.FirstSeen.Equal(firstSeen) {
+		t.Errorf("Expected first seen at %s, Found %s", firstSeen, restored.FirstSeen)
+	}
+	if !restored.LastSeen.Equal(lastSeen) {
+		t.Errorf("Expected last seen at %s, Found %s", lastSeen, restored.LastSeen)
+	}
+}
+
+func TestScrapeForgetsPrunedErrors(t *testing.T) {
+	var targetErrorsCount = make(targetErrorsCountMap)
+	var errorAggregates = make(errorAggregateMap)
+	content, _ := ioutil.ReadFile("sample-response1.json")
+	var rp responsePayload
+	json.Unmarshal(content, &rp) // nolint[errcheck]
+	rp.Target = "test"
+	key := "com.soundcloud.Foon@e28e036e"
+
+	errorAggregates.combine("test", rp, targetErrorsCount, make(errorInstancesAccumulatorMap),
+		newOccurrencesRetention(config.Scraper{}))
+	storedTotalCounts := errorAggregates.totalCounts()
+
+	scraper := Scraper{forgotten: newForgottenErrors()}
+	scraper.Forget([]string{key})
+	errorAggregates.forget(scraper.forgotten.take(), storedTotalCounts)
+	if _, exists := storedTotalCounts[key]; exists || len(errorAggregates) != 0 {
+		t.Fatalf("Expected the pruned error to be forgotten, Found %+v", errorAggregates)
+	}
+
+	// errors reported again without new occurrences stay pruned
+	errorAggregates.combine("test", rp, targetErrorsCount, make(errorInstancesAccumulatorMap),
+		newOccurrencesRetention(config.Scraper{}))
+	if len(errorAggregates) != 0 {
+		t.Errorf("Expected the pruned error not to come back, Found %+v", errorAggregates)
+	}
+
+	// errors with new occurrences come back, counting only the new ones
+	rp.ErrorAggregate[0].TotalCount += 3
+	errorAggregates.combine("test", rp, targetErrorsCount, make(errorInstancesAccumulatorMap),
+		newOccurrencesRetention(config.Scraper{}))
+	if totalCount := errorAggregates[key].TotalCount; totalCount != 3 {
+		t.Errorf("Expected 3 errors, Found %d", totalCount)
+	}
+	if len(scraper.forgotten.take()) != 0 {
+		t.Errorf("Expected the forgotten errors to be taken once")
+	}
+}
+
+func TestScrapeReopenErrors(t *testing.T) {
+	ctx := context.Background()
+	repo := repository.NewMemoryRepository()
+	errors := []repository.ErrorAggregate{
+		{AggregationKey: "resolved", TotalCount: 2},
+		{AggregationKey: "regressed", TotalCount: 2},
+		{AggregationKey: "ignored", TotalCount: 2},
+		{AggregationKey: "snoozed", TotalCount: 2},
+	}
+	repo.ReplaceErrors(ctx, "test", errors)
+	for _, key := range []string{"resolved", "regressed"} {
+		repo.SetErrorStatus(ctx, "test", key, repository.StatusChange{Status: repository.StatusResolved}) // nolint[errcheck]
+	}
+	ignore := repository.StatusChange{Status: repository.StatusIgnored}
+	repo.SetErrorStatus(ctx, "test", "ignored", ignore) // nolint[errcheck]
+	snooze := repository.StatusChange{Status: repository.StatusSnoozed, SnoozeCount: 2}
+	repo.SetErrorStatus(ctx, "test", "snoozed", snooze) // nolint[errcheck]
+
+	// new occurrences of every error but the resolved one
+	occurrence := repository.ErrorWithContext{UUID: "uuid1", Timestamp: 100}
+	errors = []repository.ErrorAggregate{
+		{AggregationKey: "resolved", TotalCount: 2},
+		{AggregationKey: "regressed", TotalCount: 3, LatestErrors: []repository.ErrorWithContext{occurrence}},
+		{AggregationKey: "ignored", TotalCount: 10},
+		{AggregationKey: "snoozed", TotalCount: 4},
+	}
+	repo.ReplaceErrors(ctx, "test", errors)
+	changes, _ := reopenErrors(ctx, "test", &repo, errors, time.Now())
+
+	expectedStatuses := map[string]string{
+		"resolved":  repository.StatusResolved,
+		"regressed": repository.StatusRegressed,
+		"ignored":   repository.StatusIgnored,
+		"snoozed":   repository.StatusOpen,
+	}
+	for key, expected := range expectedStatuses {
+		if status, _ := repo.GetErrorStatus(ctx, "test", key); status.Status != expected {
+			t.Errorf("Expected %s status for %s, Found %s", expected, key, status.Status)
+		}
+	}
+
+	status, _ := repo.GetErrorStatus(ctx, "test", "regressed")
+	if status.Regression == nil || status.Regression.Occurrence == nil || status.Regression.Occurrence.UUID != "uuid1" {
+		t.Errorf("Expected regression triggered by uuid1, Found %+v", status.Regression)
+	}
+	if status.LastResolvedAt == 0 {
+		t.Errorf("Expected last resolution time to be kept after regression")
+	}
+	if status, _ := repo.GetErrorStatus(ctx, "test", "snoozed"); status.Regression != nil {
+		t.Errorf("Reopened snoozed errors aren't regressions")
+	}
+
+	changeTypes := make(map[string]string)
+	for _, change := range changes {
+		changeTypes[change.AggregationKey] = change.Type
+	}
+	expectedTypes := map[string]string{"regressed": events.EventRegressed, "snoozed": events.EventStatusChanged}
+	if !reflect.DeepEqual(changeTypes, expectedTypes) {
+		t.Errorf("Expected changes %v, Found %v", expectedTypes, changeTypes)
+	}
+}
+
+func TestScrapeSeenTimes(t *testing.T) {
+	var targetErrorsCount = make(targetErrorsCountMap)
+	var errorAggregates = make(errorAggregateMap)
+	retention := newOccurrencesRetention(config.Scraper{})
+
+	firstContent, _ := ioutil.ReadFile("sample-response1.json")
+	var rp responsePayload
+	json.Unmarshal(firstContent, &rp) // nolint[errcheck]
+	rp.Target = "test"
+	errorAggregates.combine("test", rp, targetErrorsCount, make(errorInstancesAccumulatorMap), retention)
+
+	item := errorAggregates["com.soundcloud.Foon@e28e036e"]
+	if !item.FirstSeen.Equal(item.CreatedAt) {
+		t.Errorf("Expected first seen at %s, Found %s", item.CreatedAt, item.FirstSeen)
+	}
+	newest := item.LatestErrors[0].Timestamp
+	for _, occurrence := range item.LatestErrors {
+		if occurrence.Timestamp.After(newest) {
+			newest = occurrence.Timestamp
+		}
+	}
+	if !item.LastSeen.Equal(newest) {
+		t.Errorf("Expected last seen at the newest occurrence %s, Found %s", newest, item.LastSeen)
+	}
+
+	// errors scraped again without new occurrences aren't seen again
+	errorAggregates.combine("test", rp, targetErrorsCount, make(errorInstancesAccumulatorMap), retention)
+	if again := errorAggregates["com.soundcloud.Foon@e28e036e"]; !again.LastSeen.Equal(item.LastSeen) {
+		t.Errorf("Expected last seen at %s, Found %s", item.LastSeen, again.LastSeen)
+	}
+
+	// new occurrences without timestamp are seen when scraped
+	now := time.Now()
+	rp.ErrorAggregate[0].TotalCount++
+	rp.ErrorAggregate[0].LatestErrors = nil
+	errorAggregates.combine("test", rp, targetErrorsCount, make(errorInstancesAccumulatorMap), retention)
+	if again := errorAggregates["com.soundcloud.Foon@e28e036e"]; again.LastSeen.Before(now) {
+		t.Errorf("Expected last seen after %s, Found %s", now, again.LastSeen)
+	}
+}
+
+func TestScrapeNewOccurrences(t *testing.T) {
+	errorAggregates := errorAggregateMap{
+		"existing": {AggregationKey: "existing", TotalCount: 5},
+		"new":      {AggregationKey: "new", TotalCount: 2},
+		"same":     {AggregationKey: "same", TotalCount: 1},
+	}
+	occurrences := errorAggregates.newOccurrences(map[string]int{"existing": 3, "same": 1})
+	expected := map[string]int{"existing": 2, "new": 2}
+	if !reflect.DeepEqual(occurrences, expected) {
+		t.Errorf("Expected %v, Found %v", expected, occurrences)
+	}
+}
+
+// unavailableRepository fails to store errors like a repository whose database is down
+type unavailableRepository struct {
+	repository.ErrorsRepository
+}
+
+func (unavailableRepository) ReplaceErrors(ctx context.Context, serviceName string,
+	errors []repository.ErrorAggregate) error {
+	return fmt.Errorf("connection refused")
+}
+
+func TestScrapeStoreFailure(t *testing.T) {
+	var repo repository.ErrorsRepository = unavailableRepository{}
+	scraper := Scraper{Repository: &repo, ServiceConfig: config.Service{Name: "test"}}
+	errorAggregates := errorAggregateMap{"key": {AggregationKey: "key", TotalCount: 1}}
+
+	// the rest of results aren't stored when the errors can't be stored, nor their changes published
+	scraper.Events = events.NewBroker()
+	subscription := scraper.Events.Subscribe("")
+	err := scraper.store(context.Background(), map[string]int{}, make(targetErrorsCountMap), errorAggregates, nil)
+	if err == nil {
+		t.Errorf("Expected an error storing the scrape results")
+	}
+	if len(subscription.Events()) != 0 {
+		t.Errorf("Expected no events for a failed scrape cycle, Found %d", len(subscription.Events()))
+	}
+}
+
+// flakyTargetsRepository fails to store targets once
+type flakyTargetsRepository struct {
+	repository.ErrorsRepository
+	failed *bool
+}
+
+func (r flakyTargetsRepository) StoreTargets(ctx context.Context, serviceName string,
+	targets []repository.Target) error {
+	if !*r.failed {
+		*r.failed = true
+		return fmt.Errorf("connection refused")
+	}
+	return r.ErrorsRepository.StoreTargets(ctx, serviceName, targets)
+}
+
+func TestScrapeStoreFailureDoesNotCountOccurrencesTwice(t *testing.T) {
+	ctx := context.Background()
+	memory := repository.NewMemoryRepository()
+	var repo repository.ErrorsRepository = flakyTargetsRepository{memory, new(bool)}
+	scraper := Scraper{Repository: &repo, ServiceConfig: config.Service{Name: "test"}}
+	errorAggregates := errorAggregateMap{"key": {AggregationKey: "key", TotalCount: 3}}
+	storedTotalCounts := map[string]int{"key": 1}
+
+	// the failed cycle is stored again from the same stored total counts
+	if err := scraper.store(ctx, storedTotalCounts, make(targetErrorsCountMap), errorAggregates, nil); err == nil {
+		t.Fatalf("Expected an error storing the scrape results")
+	}
+	if err := scraper.store(ctx, storedTotalCounts, make(targetErrorsCountMap), errorAggregates, nil); err != nil {
+		t.Fatalf("Fail to store scrape results: %s", err)
+	}
+	now := time.Now()
+	buckets, _ := memory.GetOccurrencesHistogram(ctx, "test", "key", now.Add(-time.Hour), now.Add(time.Minute),
+		time.Hour)
+	total := 0
+	for _, bucket := range buckets {
+		total += bucket.Count
+	}
+	if total != 2 {
+		t.Errorf("Expected 2 occurrences, Found %d", total)
+	}
+}
+
+func TestScrapeStoreChangedErrors(t *testing.T) {
+	ctx := context.Background()
+	repo := repository.NewMemoryRepository()
+	errorAggregates := errorAggregateMap{
+		"unchanged": {AggregationKey: "unchanged", TotalCount: 1},
+		"changed":   {AggregationKey: "changed", TotalCount: 3},
+		"new":       {AggregationKey: "new", TotalCount: 1},
+	}
+
+	// unchanged errors may have been pruned from the repository, so they aren't stored again
+	changes, err := storeErrors(ctx, "test", &repo, errorAggregates, map[string]int{"unchanged": 1, "changed": 2})
+	if err != nil {
+		t.Errorf("Fail to store errors: %s", err)
+	}
+	stored, _ := repo.GetErrors(ctx, "test", 10)
+	keys := make(map[string]bool)
+	for _, errorAggregate := range stored {
+		keys[errorAggregate.AggregationKey] = true
+	}
+	if !reflect.DeepEqual(keys, map[string]bool{"changed": true, "new": true}) {
+		t.Errorf("Expected only changed and new errors to be stored, Found %v", keys)
+	}
+
+	changeTypes := make(map[string]string)
+	for _, change := range changes {
+		changeTypes[change.AggregationKey] = change.Type
+	}
+	expectedTypes := map[string]string{"changed": events.EventCountChanged, "new": events.EventNewError}
+	if !reflect.DeepEqual(changeTypes, expectedTypes) {
+		t.Errorf("Expected changes %v, Found %v", expectedTypes, changeTypes)
+	}
+}
+
+func TestScrapeStorePublishesChanges(t *testing.T) {
+	repo := repository.NewMemoryRepository()
+	broker := events.NewBroker()
+	scraper := Scraper{Repository: &repo, ServiceConfig: config.Service{Name: "test"}, Events: broker}
+	subscription := broker.Subscribe("test")
+	defer subscription.Close()
+	errorAggregates := errorAggregateMap{"key": {AggregationKey: "key", TotalCount: 3}}
+
+	err := scraper.store(context.Background(), map[string]int{"key": 1}, make(targetErrorsCountMap), errorAggregates,
+		nil)
+	if err != nil {
+		t.Fatalf("Fail to store scrape results: %s", err)
+	}
+	event := <-subscription.Events()
+	if event.Type != events.EventCountChanged || event.TotalCount != 3 || event.PreviousCount != 1 ||
+		event.Severity != "error" {
+		t.Errorf("Unexpected event %+v", event)
+	}
+}
@@ -0,0 +1,83 @@
+package scraper
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/periskop-dev/periskop/repository"
+)
+
+// restoreState loads the aggregation state persisted by a previous run of the scraper of a service,
+// so the errors already counted are not added again after a restart. Errors are restored without occurrences,
+// which are collected again in the next scrape.
+func restoreState(ctx context.Context, serviceName string,
+	r *repository.ErrorsRepository) (targetErrorsCountMap, errorAggregateMap) {
+	targetErrorsCount := make(targetErrorsCountMap)
+	errorAggregates := make(errorAggregateMap)
+
+	state, err := (*r).GetScraperState(ctx, serviceName)
+	if errors.Is(err, repository.ErrNotFound) {
+		log.Printf("%s: no scraper state restored: %s", serviceName, err)
+		return targetErrorsCount, errorAggregates
+	}
+	if err != nil {
+		log.Printf("%s: failed to restore scraper state, errors will be counted again: %s", serviceName, err)
+		return targetErrorsCount, errorAggregates
+	}
+	for target, errorsCount := range state.TargetErrorsCount {
+		targetErrorsCount[target] = make(map[string]int, len(errorsCount))
+		for key, count := range errorsCount {
+			targetErrorsCount[target][key] = count
+		}
+	}
+	for _, item := range state.ErrorAggregates {
+		errorAggregates[item.AggregationKey] = errorAggregate{
+			AggregationKey: item.AggregationKey,
+			TotalCount:     item.TotalCount,
+			Severity:       item.Severity,
+			CreatedAt:      time.Unix(item.CreatedAt, 0),
+			FirstSeen:      unixTime(item.FirstSeen),
+			LastSeen:       unixTime(item.LastSeen),
+		}
+	}
+	log.Printf("%s: restored scraper state of %d targets and %d errors", serviceName,
+		len(targetErrorsCount), len(errorAggregates))
+	return targetErrorsCount, errorAggregates
+}
+
+// storeState persists the aggregation state of the scraper of a service: the counters and metadata of the errors.
+// Their occurrences are already stored along with the errors, and every scrape reports them again.
+func storeState(ctx context.Context, serviceName string, r *repository.ErrorsRepository,
+	targetErrorsCount targetErrorsCountMap, errorAggregates errorAggregateMap) error {
+	state := repository.ScraperState{
+		TargetErrorsCount: make(map[string]map[string]int, len(targetErrorsCount)),
+		ErrorAggregates:   make([]repository.ErrorAggregate, 0, len(errorAggregates)),
+	}
+	for target, errorsCount := range targetErrorsCount {
+		state.TargetErrorsCount[target] = make(map[string]int, len(errorsCount))
+		for key, count := range errorsCount {
+			state.TargetErrorsCount[target][key] = count
+		}
+	}
+	for _, value := range errorAggregates {
+		state.ErrorAggregates = append(state.ErrorAggregates, repository.ErrorAggregate{
+			AggregationKey: value.AggregationKey,
+			Severity:       value.Severity,
+			TotalCount:     value.TotalCount,
+			CreatedAt:      value.CreatedAt.Unix(),
+			FirstSeen:      value.FirstSeen.Unix(),
+			LastSeen:       value.LastSeen.Unix(),
+		})
+	}
+	return (*r).StoreScraperState(ctx, serviceName, state)
+}
+
+// unixTime converts a unix time to time, states stored by previous versions have no time set
+func unixTime(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}